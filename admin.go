@@ -0,0 +1,327 @@
+/*************************************************************************
+> File Name: admin.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-19 11:20:47 星期一
+> Content: 管理接口 挂载在非代理请求的/admin/路径下
+*************************************************************************/
+
+package gproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrAdminUnauthorized = errors.New("admin token is required")
+	ErrAdminForbidden    = errors.New("admin api is only available from loopback")
+	ErrAdminCrossOrigin  = errors.New("cross origin admin request")
+	adminPrefix          = "/admin/"
+	// 浏览器通过?token=打开管理页面后 之后的请求使用该cookie
+	adminTokenCookie = "gproxy_admin_token"
+)
+
+// 需要注册管理接口的中间件可实现该接口 添加中间件时自动注册
+type AdminMiddleware interface {
+	RegisterAdmin(mux *http.ServeMux)
+}
+
+func (p *SimpleProxyServer) registerAdmin() {
+	p.admin.HandleFunc("GET /admin/flows", p.listFlowsHandler)
+	p.admin.HandleFunc("DELETE /admin/flows", p.clearFlowsHandler)
+	p.admin.HandleFunc("GET /admin/flows/har", p.harHandler)
+	p.admin.HandleFunc("GET /admin/flows/{id}", p.getFlowHandler)
+	p.admin.HandleFunc("POST /admin/flows/{id}/replay", p.replayHandler)
+	p.admin.HandleFunc("GET /admin/websockets", p.listWebSocketsHandler)
+	p.admin.HandleFunc("POST /admin/websockets/{session}/send", p.sendWebSocketHandler)
+	p.admin.HandleFunc("GET /admin/grpc/methods", p.listGRPCMethodsHandler)
+	p.admin.HandleFunc("POST /admin/grpc/protosets", p.loadProtoSetHandler)
+	p.admin.HandleFunc("GET /admin/reverse", p.reverseStatusHandler)
+	p.admin.HandleFunc("PUT /admin/reverse/routes", p.setReverseRoutesHandler)
+	p.admin.HandleFunc("GET /admin/pac", p.pacOptionsHandler)
+	p.admin.HandleFunc("PUT /admin/pac", p.setPACOptionsHandler)
+	p.admin.HandleFunc("GET /admin/dns/lookup", p.dnsLookupHandler)
+	p.admin.HandleFunc("GET /admin/dns/cache", p.dnsCacheHandler)
+	p.admin.HandleFunc("DELETE /admin/dns/cache", p.flushDNSCacheHandler)
+}
+
+// 管理接口的访问控制 配置了AdminToken时校验令牌 否则只允许本机访问
+// 抓包记录中有其他客户端的Authorization及Cookie 所有管理接口均经过这里
+func (p *SimpleProxyServer) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	// 其他站点的页面不能通过浏览器调用管理接口
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			writeJSONError(w, ErrAdminCrossOrigin, http.StatusForbidden)
+			return
+		}
+	}
+	if p.AdminToken == "" {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			writeJSONError(w, ErrAdminForbidden, http.StatusForbidden)
+			return
+		}
+		p.admin.ServeHTTP(w, r)
+		return
+	}
+	token := r.URL.Query().Get("token")
+	fromQuery := token != ""
+	if !fromQuery {
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			token = bearer
+		} else if c, err := r.Cookie(adminTokenCookie); err == nil {
+			token = c.Value
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(p.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gproxy admin"`)
+		writeJSONError(w, ErrAdminUnauthorized, http.StatusUnauthorized)
+		return
+	}
+	if fromQuery {
+		http.SetCookie(w, &http.Cookie{
+			Name:     adminTokenCookie,
+			Value:    token,
+			Path:     adminPrefix,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	p.admin.ServeHTTP(w, r)
+}
+
+// 在AdminAddr上单独提供管理接口
+func (p *SimpleProxyServer) serveAdminAddr() {
+	server := p.newProxyServer(p.AdminAddr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, adminPrefix) {
+			http.NotFound(w, r)
+			return
+		}
+		p.serveAdmin(w, r)
+	}))
+	p.Logger.Infof("Starting Admin On %s", p.AdminAddr)
+	if err := server.ListenAndServe(); err != nil {
+		p.Logger.WithField("err", err.Error()).Error("Start Admin Failed!")
+	}
+}
+
+func (p *SimpleProxyServer) listFlowsHandler(w http.ResponseWriter, _ *http.Request) {
+	if p.flows == nil {
+		writeJSONError(w, ErrCaptureDisabled, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, p.flows.List(), http.StatusOK)
+}
+
+func (p *SimpleProxyServer) clearFlowsHandler(w http.ResponseWriter, _ *http.Request) {
+	if p.flows == nil {
+		writeJSONError(w, ErrCaptureDisabled, http.StatusNotFound)
+		return
+	}
+	p.flows.Clear()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 导出全部抓包记录为HAR
+func (p *SimpleProxyServer) harHandler(w http.ResponseWriter, _ *http.Request) {
+	if p.flows == nil {
+		writeJSONError(w, ErrCaptureDisabled, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment;filename=gproxy.har")
+	writeJSON(w, p.flows.HAR(), http.StatusOK)
+}
+
+func (p *SimpleProxyServer) getFlowHandler(w http.ResponseWriter, r *http.Request) {
+	if p.flows == nil {
+		writeJSONError(w, ErrCaptureDisabled, http.StatusNotFound)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+	flow := p.flows.Get(id)
+	if flow == nil {
+		writeJSONError(w, ErrFlowNotFound, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, flow, http.StatusOK)
+}
+
+// 重放请求 请求体为可选的ReplayOptions
+func (p *SimpleProxyServer) replayHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+	opt := &ReplayOptions{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(opt); err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	result, err := p.Replay(id, opt)
+	switch {
+	case errors.Is(err, ErrFlowNotFound), errors.Is(err, ErrCaptureDisabled):
+		writeJSONError(w, err, http.StatusNotFound)
+	case err != nil:
+		writeJSONError(w, err, http.StatusBadRequest)
+	default:
+		writeJSON(w, result, http.StatusOK)
+	}
+}
+
+func (p *SimpleProxyServer) listWebSocketsHandler(w http.ResponseWriter, _ *http.Request) {
+	infos := []WebSocketInfo{}
+	for _, c := range p.webSocketConns() {
+		infos = append(infos, c.info)
+	}
+	writeJSON(w, infos, http.StatusOK)
+}
+
+// 向websocket连接注入消息 请求体为WebSocketSend
+func (p *SimpleProxyServer) sendWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := strconv.ParseInt(r.PathValue("session"), 10, 64)
+	if err != nil {
+		writeJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+	var msg WebSocketSend
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		writeJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+	opcode, payload := WebSocketText, []byte(msg.Text)
+	if msg.Binary != nil {
+		opcode, payload = WebSocketBinary, msg.Binary
+	}
+	for _, c := range p.webSocketConns() {
+		if c.info.Session == session {
+			if err := c.send(msg.Direction, opcode, payload); err != nil {
+				writeJSONError(w, err, http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeJSONError(w, ErrWebSocketNotFound, http.StatusNotFound)
+}
+
+// 已加载的gRPC方法
+func (p *SimpleProxyServer) listGRPCMethodsHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, p.protos.Methods(), http.StatusOK)
+}
+
+// 加载请求体中的.protoset 返回加载后的全部方法
+func (p *SimpleProxyServer) loadProtoSetHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := p.protos.Load(data); err != nil {
+		writeJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, p.protos.Methods(), http.StatusOK)
+}
+
+// 反向代理的路由及后端状态
+func (p *SimpleProxyServer) reverseStatusHandler(w http.ResponseWriter, _ *http.Request) {
+	if p.reverse == nil {
+		writeJSONError(w, ErrReverseDisabled, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, p.reverse.Status(), http.StatusOK)
+}
+
+// 替换反向代理的全部路由 请求体为[]ReverseRoute
+func (p *SimpleProxyServer) setReverseRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	if p.reverse == nil {
+		writeJSONError(w, ErrReverseDisabled, http.StatusNotFound)
+		return
+	}
+	var routes []ReverseRoute
+	if err := json.NewDecoder(r.Body).Decode(&routes); err != nil {
+		writeJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := p.reverse.SetRoutes(routes); err != nil {
+		writeJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, p.reverse.Status(), http.StatusOK)
+}
+
+// PAC文件的配置
+func (p *SimpleProxyServer) pacOptionsHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, p.pacOptions(), http.StatusOK)
+}
+
+// 替换PAC文件的配置 请求体为PACOptions
+func (p *SimpleProxyServer) setPACOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	opt := &PACOptions{}
+	if err := json.NewDecoder(r.Body).Decode(opt); err != nil {
+		writeJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := p.SetPACOptions(opt); err != nil {
+		writeJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, opt, http.StatusOK)
+}
+
+// 使用代理的解析器解析?host=指定的域名
+func (p *SimpleProxyServer) dnsLookupHandler(w http.ResponseWriter, r *http.Request) {
+	if p.resolver == nil {
+		writeJSONError(w, ErrDNSDisabled, http.StatusNotFound)
+		return
+	}
+	result, err := p.resolver.Lookup(r.Context(), r.URL.Query().Get("host"))
+	if err != nil {
+		writeJSONError(w, err, http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, result, http.StatusOK)
+}
+
+func (p *SimpleProxyServer) dnsCacheHandler(w http.ResponseWriter, _ *http.Request) {
+	if p.resolver == nil {
+		writeJSONError(w, ErrDNSDisabled, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, p.resolver.Cache(), http.StatusOK)
+}
+
+func (p *SimpleProxyServer) flushDNSCacheHandler(w http.ResponseWriter, _ *http.Request) {
+	if p.resolver == nil {
+		writeJSONError(w, ErrDNSDisabled, http.StatusNotFound)
+		return
+	}
+	p.resolver.FlushCache()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, err error, code int) {
+	writeJSON(w, map[string]string{"error": err.Error()}, code)
+}
@@ -0,0 +1,324 @@
+/*************************************************************************
+> File Name: blocklist.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-19 21:37:08 星期一
+> Content: 按域名列表屏蔽广告及统计请求 支持hosts格式及Adblock格式的列表
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// hosts文件中不应屏蔽的本地域名
+var hostsLocalNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"0.0.0.0":               true,
+}
+
+// 屏蔽列表的信息
+type Blocklist struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Domains  int       `json:"domains"`
+	Hits     int64     `json:"hits"`
+	LoadedAt time.Time `json:"loadedAt"`
+}
+
+type blocklist struct {
+	Blocklist
+	hits *atomic.Int64
+}
+
+// 域名的屏蔽规则
+type blockRule struct {
+	list int
+	// 同时作用于子域名
+	subdomains bool
+	// 例外规则 不屏蔽
+	allow bool
+}
+
+// 按域名的各级标签从顶级域名开始逐级保存的前缀树 即域名的后缀树
+type blockNode struct {
+	children map[string]*blockNode
+	rule     *blockRule
+}
+
+func (n *blockNode) insert(domain string, rule *blockRule) {
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if n.children == nil {
+			n.children = make(map[string]*blockNode)
+		}
+		child, ok := n.children[labels[i]]
+		if !ok {
+			child = &blockNode{}
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	// 例外规则优先 其次是作用范围更大的规则
+	if n.rule == nil || rule.allow || (!n.rule.allow && rule.subdomains && !n.rule.subdomains) {
+		n.rule = rule
+	}
+}
+
+// 返回最具体的匹配规则
+func (n *blockNode) match(host string) *blockRule {
+	labels := strings.Split(host, ".")
+	var found *blockRule
+	for i := len(labels) - 1; i >= 0; i-- {
+		n = n.children[labels[i]]
+		if n == nil {
+			break
+		}
+		if n.rule != nil && (i == 0 || n.rule.subdomains) {
+			found = n.rule
+		}
+	}
+	return found
+}
+
+// 屏蔽中间件 普通请求返回204 CONNECT请求直接拒绝而不进行MITM
+type BlocklistMiddleware struct {
+	mu    sync.RWMutex
+	paths []string
+	lists []*blocklist
+	root  *blockNode
+}
+
+// 从本地文件加载屏蔽列表
+func NewBlocklistMiddleware(paths ...string) (*BlocklistMiddleware, error) {
+	m := &BlocklistMiddleware{paths: paths}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// 重新加载全部列表 命中次数保留
+func (m *BlocklistMiddleware) Reload() error {
+	m.mu.RLock()
+	hits := make(map[string]*atomic.Int64, len(m.lists))
+	for _, l := range m.lists {
+		hits[l.Path] = l.hits
+	}
+	m.mu.RUnlock()
+	root := &blockNode{}
+	lists := make([]*blocklist, 0, len(m.paths))
+	for i, path := range m.paths {
+		n, err := loadBlocklist(root, path, i)
+		if err != nil {
+			return err
+		}
+		l := &blocklist{
+			Blocklist: Blocklist{Name: filepath.Base(path), Path: path, Domains: n, LoadedAt: time.Now()},
+			hits:      hits[path],
+		}
+		if l.hits == nil {
+			l.hits = &atomic.Int64{}
+		}
+		lists = append(lists, l)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.root, m.lists = root, lists
+	return nil
+}
+
+// 加载一个列表到前缀树中 返回加载的域名数
+func loadBlocklist(root *blockNode, path string, list int) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var n int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		for _, rule := range parseBlocklistLine(scanner.Text()) {
+			rule.rule.list = list
+			root.insert(rule.domain, rule.rule)
+			n++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return n, errors.New(path + ": " + err.Error())
+	}
+	return n, nil
+}
+
+type blocklistEntry struct {
+	domain string
+	rule   *blockRule
+}
+
+// 解析列表中的一行 支持以下格式
+// hosts: 0.0.0.0 ads.example.com 只屏蔽该域名
+// 域名: ads.example.com 只屏蔽该域名 *.example.com 屏蔽子域名
+// Adblock: ||example.com^ 屏蔽该域名及子域名 @@||example.com^ 为例外规则
+func parseBlocklistLine(line string) []blocklistEntry {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '!' || line[0] == '[' {
+		return nil
+	}
+	if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@||") {
+		allow := strings.HasPrefix(line, "@@")
+		rest := strings.TrimPrefix(strings.TrimPrefix(line, "@@"), "||")
+		domain, opts, ok := strings.Cut(rest, "^")
+		// 只支持整个域名的规则 带路径或选项的规则无法在域名级别生效
+		if !ok || opts != "" && opts != "$important" {
+			return nil
+		}
+		if domain = normalizeBlockDomain(domain); domain == "" {
+			return nil
+		}
+		return []blocklistEntry{{domain: domain, rule: &blockRule{subdomains: true, allow: allow}}}
+	}
+	fields := strings.Fields(line)
+	if net.ParseIP(fields[0]) != nil {
+		var entries []blocklistEntry
+		for _, f := range fields[1:] {
+			if domain := normalizeBlockDomain(f); domain != "" && !hostsLocalNames[domain] {
+				entries = append(entries, blocklistEntry{domain: domain, rule: &blockRule{}})
+			}
+		}
+		return entries
+	}
+	if len(fields) != 1 {
+		return nil
+	}
+	domain, subdomains := fields[0], false
+	if strings.HasPrefix(domain, "*.") {
+		domain, subdomains = domain[2:], true
+	}
+	if domain = normalizeBlockDomain(domain); domain == "" {
+		return nil
+	}
+	return []blocklistEntry{{domain: domain, rule: &blockRule{subdomains: subdomains}}}
+}
+
+// 规范化域名 不是合法域名时返回空
+func normalizeBlockDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" || strings.ContainsAny(domain, "/*:?=&$|^ ") || strings.Contains(domain, "..") {
+		return ""
+	}
+	return domain
+}
+
+// 返回屏蔽该域名的列表
+func (m *BlocklistMiddleware) match(host string) *blocklist {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rule := m.root.match(host)
+	if rule == nil || rule.allow {
+		return nil
+	}
+	return m.lists[rule.list]
+}
+
+// 域名是否被屏蔽 返回屏蔽该域名的列表名
+func (m *BlocklistMiddleware) Blocked(host string) (string, bool) {
+	l := m.match(host)
+	if l == nil {
+		return "", false
+	}
+	return l.Name, true
+}
+
+// 列表的信息及命中次数
+func (m *BlocklistMiddleware) Lists() []Blocklist {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	lists := make([]Blocklist, 0, len(m.lists))
+	for _, l := range m.lists {
+		info := l.Blocklist
+		info.Hits = l.hits.Load()
+		lists = append(lists, info)
+	}
+	return lists
+}
+
+func (m *BlocklistMiddleware) RequestCondition(req *http.Request, _ *goproxy.ProxyCtx) bool {
+	return req.URL != nil && m.match(req.URL.Hostname()) != nil
+}
+
+func (m *BlocklistMiddleware) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	l := m.match(req.URL.Hostname())
+	if l == nil {
+		return req, nil
+	}
+	l.hits.Add(1)
+	ctx.Logf("Blocked %s by %s", req.URL, l.Name)
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusNoContent, "")
+	resp.Header.Set("X-Gproxy-Blocked", l.Name)
+	return req, resp
+}
+
+func (m *BlocklistMiddleware) ResponseCondition(_ *http.Response, _ *goproxy.ProxyCtx) bool {
+	return false
+}
+
+func (m *BlocklistMiddleware) OnResponse(resp *http.Response, _ *goproxy.ProxyCtx) *http.Response {
+	return resp
+}
+
+// 屏蔽的CONNECT请求直接拒绝
+func (m *BlocklistMiddleware) OnConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+	l := m.match(hostname)
+	if l == nil {
+		return nil, host
+	}
+	l.hits.Add(1)
+	ctx.Logf("Blocked CONNECT %s by %s", host, l.Name)
+	ctx.Resp = goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusForbidden, "Blocked by "+l.Name)
+	ctx.Resp.Header.Set("X-Gproxy-Blocked", l.Name)
+	return goproxy.RejectConnect, host
+}
+
+// 注册屏蔽列表相关的管理接口
+func (m *BlocklistMiddleware) RegisterAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/blocklist", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, m.Lists(), http.StatusOK)
+	})
+	mux.HandleFunc("POST /admin/blocklist/reload", func(w http.ResponseWriter, _ *http.Request) {
+		if err := m.Reload(); err != nil {
+			writeJSONError(w, err, http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, m.Lists(), http.StatusOK)
+	})
+	// ?host=example.com 检查域名是否被屏蔽
+	mux.HandleFunc("GET /admin/blocklist/check", func(w http.ResponseWriter, r *http.Request) {
+		list, blocked := m.Blocked(r.URL.Query().Get("host"))
+		writeJSON(w, map[string]interface{}{"blocked": blocked, "list": list}, http.StatusOK)
+	})
+}
@@ -0,0 +1,464 @@
+/*************************************************************************
+> File Name: breakpoint.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-19 13:05:12 星期一
+> Content: 断点中间件 挂起匹配的请求/响应 由管理接口编辑后放行
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+var (
+	defaultBreakpointTimeout = 5 * time.Minute
+	breakpointsHtml          = path.Join(curDir, "./html/breakpoints.html")
+	ErrBreakpointNotFound    = errors.New("held flow not found")
+)
+
+const (
+	BreakpointPhaseRequest  = "request"
+	BreakpointPhaseResponse = "response"
+)
+
+// 放行挂起流量的方式
+const (
+	// 放行(可附带修改)
+	BreakpointResume = "resume"
+	// 丢弃 向客户端返回502
+	BreakpointDrop = "drop"
+	// 不再请求上游 直接返回构造的响应
+	BreakpointRespond = "respond"
+)
+
+// 断点规则
+type BreakpointRule struct {
+	// 匹配url的正则 为空时匹配全部
+	URLPattern string `json:"urlPattern"`
+	// 为空时匹配全部方法
+	Method string `json:"method"`
+	// 在请求发出前挂起
+	Request bool `json:"request"`
+	// 在响应返回前挂起
+	Response bool `json:"response"`
+	re       *regexp.Regexp
+}
+
+func (r *BreakpointRule) match(req *http.Request) bool {
+	if req == nil || req.URL == nil {
+		return false
+	}
+	if r.Method != "" && r.Method != req.Method {
+		return false
+	}
+	return r.re == nil || r.re.MatchString(req.URL.String())
+}
+
+// 被挂起的请求或响应
+type HeldFlow struct {
+	ID      int64     `json:"id"`
+	Phase   string    `json:"phase"`
+	Session int64     `json:"session"`
+	HeldAt  time.Time `json:"heldAt"`
+	// 超时后自动放行的时间
+	Deadline   time.Time   `json:"deadline"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	StatusCode int         `json:"statusCode,omitempty"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	action     chan *BreakpointEdit
+}
+
+// 放行时对挂起流量的处理 零值字段保持不变
+type BreakpointEdit struct {
+	Action     string      `json:"action"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+}
+
+// 断点中间件
+type BreakpointMiddleware struct {
+	// 超时后自动放行
+	Timeout time.Duration
+	mu      sync.Mutex
+	nextID  int64
+	rules   []*BreakpointRule
+	held    map[int64]*HeldFlow
+}
+
+func NewBreakpointMiddleware(timeout time.Duration) *BreakpointMiddleware {
+	if timeout <= 0 {
+		timeout = defaultBreakpointTimeout
+	}
+	return &BreakpointMiddleware{Timeout: timeout, held: make(map[int64]*HeldFlow)}
+}
+
+// 添加断点规则
+func (m *BreakpointMiddleware) AddRule(rule BreakpointRule) error {
+	if rule.URLPattern != "" {
+		re, err := regexp.Compile(rule.URLPattern)
+		if err != nil {
+			return err
+		}
+		rule.re = re
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rules = append(m.rules, &rule)
+	return nil
+}
+
+func (m *BreakpointMiddleware) Rules() []BreakpointRule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rules := make([]BreakpointRule, 0, len(m.rules))
+	for _, r := range m.rules {
+		rules = append(rules, *r)
+	}
+	return rules
+}
+
+// 清空断点规则 已挂起的流量不受影响
+func (m *BreakpointMiddleware) ClearRules() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rules = nil
+}
+
+func (m *BreakpointMiddleware) matched(req *http.Request, phase string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range m.rules {
+		if (phase == BreakpointPhaseRequest && !r.Request) || (phase == BreakpointPhaseResponse && !r.Response) {
+			continue
+		}
+		if r.match(req) {
+			return true
+		}
+	}
+	return false
+}
+
+// 当前挂起的流量
+func (m *BreakpointMiddleware) Held() []*HeldFlow {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	held := make([]*HeldFlow, 0, len(m.held))
+	for _, h := range m.held {
+		held = append(held, h)
+	}
+	sort.Slice(held, func(i, j int) bool { return held[i].ID < held[j].ID })
+	return held
+}
+
+func (m *BreakpointMiddleware) Get(id int64) *HeldFlow {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.held[id]
+}
+
+// 处理挂起的流量 edit.Action为空时视为放行
+func (m *BreakpointMiddleware) Release(id int64, edit *BreakpointEdit) error {
+	if edit == nil {
+		edit = &BreakpointEdit{}
+	}
+	if edit.Action == "" {
+		edit.Action = BreakpointResume
+	}
+	switch edit.Action {
+	case BreakpointResume, BreakpointDrop, BreakpointRespond:
+	default:
+		return errors.New("unknown breakpoint action: " + edit.Action)
+	}
+	m.mu.Lock()
+	h, ok := m.held[id]
+	delete(m.held, id)
+	m.mu.Unlock()
+	if !ok {
+		return ErrBreakpointNotFound
+	}
+	// 从held中取出的一方负责发送 挂起的协程一定会接收
+	h.action <- edit
+	return nil
+}
+
+func (m *BreakpointMiddleware) Resume(id int64, edit *BreakpointEdit) error {
+	if edit == nil {
+		edit = &BreakpointEdit{}
+	}
+	edit.Action = BreakpointResume
+	return m.Release(id, edit)
+}
+
+func (m *BreakpointMiddleware) Drop(id int64) error {
+	return m.Release(id, &BreakpointEdit{Action: BreakpointDrop})
+}
+
+func (m *BreakpointMiddleware) Respond(id int64, edit *BreakpointEdit) error {
+	if edit == nil {
+		edit = &BreakpointEdit{}
+	}
+	edit.Action = BreakpointRespond
+	return m.Release(id, edit)
+}
+
+// 挂起当前协程 直到被处理、超时或客户端断开
+func (m *BreakpointMiddleware) park(h *HeldFlow, req *http.Request) *BreakpointEdit {
+	h.HeldAt = time.Now()
+	h.Deadline = h.HeldAt.Add(m.Timeout)
+	h.action = make(chan *BreakpointEdit, 1)
+	// 避免挂起期间触发服务端的写超时
+	extendWriteDeadline(req, m.Timeout)
+	m.mu.Lock()
+	m.nextID++
+	h.ID = m.nextID
+	m.held[h.ID] = h
+	m.mu.Unlock()
+
+	timer := time.NewTimer(m.Timeout)
+	defer timer.Stop()
+	var edit *BreakpointEdit
+	select {
+	case edit = <-h.action:
+		return edit
+	case <-timer.C:
+		edit = &BreakpointEdit{Action: BreakpointResume}
+	case <-req.Context().Done():
+		edit = &BreakpointEdit{Action: BreakpointDrop}
+	}
+	m.mu.Lock()
+	_, ok := m.held[h.ID]
+	delete(m.held, h.ID)
+	m.mu.Unlock()
+	if !ok {
+		// 已被管理接口取出 以其操作为准
+		return <-h.action
+	}
+	return edit
+}
+
+func (m *BreakpointMiddleware) RequestCondition(req *http.Request, _ *goproxy.ProxyCtx) bool {
+	return m.matched(req, BreakpointPhaseRequest)
+}
+
+func (m *BreakpointMiddleware) ResponseCondition(resp *http.Response, ctx *goproxy.ProxyCtx) bool {
+	// 流式的响应无法完整读取后再放行
+	return resp != nil && !isStreamingBody(resp.Header) && m.matched(ctx.Req, BreakpointPhaseResponse)
+}
+
+func (m *BreakpointMiddleware) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	h := &HeldFlow{
+		Phase:   BreakpointPhaseRequest,
+		Session: ctx.Session,
+		Method:  req.Method,
+		URL:     req.URL.String(),
+		Header:  req.Header.Clone(),
+	}
+	// 流式的请求体(gRPC、ndjson等)不读取 只挂起请求头 放行后继续转发原请求体
+	streaming := isStreamingBody(req.Header)
+	if req.Body != nil && !streaming {
+		h.Body, _ = io.ReadAll(req.Body)
+		req.Body.Close()
+	}
+	edit := m.park(h, req)
+	switch edit.Action {
+	case BreakpointDrop:
+		return req, dropResponse(req)
+	case BreakpointRespond:
+		return req, editResponse(req, edit)
+	}
+	if edit.Method != "" {
+		req.Method = edit.Method
+	}
+	if edit.URL != "" {
+		if u, err := url.Parse(edit.URL); err == nil && u.IsAbs() {
+			req.URL = u
+			req.Host = u.Host
+		} else {
+			ctx.Warnf("Ignore invalid breakpoint url %s", edit.URL)
+		}
+	}
+	if edit.Header != nil {
+		req.Header = edit.Header
+	}
+	if streaming {
+		return req, nil
+	}
+	body := h.Body
+	if edit.Body != nil {
+		body = edit.Body
+	}
+	setRequestBody(req, body)
+	return req, nil
+}
+
+func (m *BreakpointMiddleware) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	h := &HeldFlow{
+		Phase:      BreakpointPhaseResponse,
+		Session:    ctx.Session,
+		Method:     ctx.Req.Method,
+		URL:        ctx.Req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header.Clone(),
+	}
+	if resp.Body != nil {
+		h.Body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	edit := m.park(h, ctx.Req)
+	switch edit.Action {
+	case BreakpointDrop:
+		return dropResponse(ctx.Req)
+	case BreakpointRespond:
+		return editResponse(ctx.Req, edit)
+	}
+	if edit.StatusCode != 0 {
+		resp.StatusCode = edit.StatusCode
+		resp.Status = strconv.Itoa(edit.StatusCode) + " " + http.StatusText(edit.StatusCode)
+	}
+	if edit.Header != nil {
+		resp.Header = edit.Header
+	}
+	body := h.Body
+	if edit.Body != nil {
+		body = edit.Body
+	}
+	setResponseBody(resp, body)
+	return resp
+}
+
+// 注册断点相关的管理接口
+func (m *BreakpointMiddleware) RegisterAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/ui/breakpoints", m.uiHandler)
+	mux.HandleFunc("GET /admin/breakpoints/rules", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, m.Rules(), http.StatusOK)
+	})
+	mux.HandleFunc("POST /admin/breakpoints/rules", func(w http.ResponseWriter, r *http.Request) {
+		var rule BreakpointRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		if err := m.AddRule(rule); err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, m.Rules(), http.StatusOK)
+	})
+	mux.HandleFunc("DELETE /admin/breakpoints/rules", func(w http.ResponseWriter, _ *http.Request) {
+		m.ClearRules()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /admin/breakpoints", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, m.Held(), http.StatusOK)
+	})
+	mux.HandleFunc("GET /admin/breakpoints/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		h := m.Get(id)
+		if h == nil {
+			writeJSONError(w, ErrBreakpointNotFound, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, h, http.StatusOK)
+	})
+	mux.HandleFunc("POST /admin/breakpoints/{id}/{action}", m.releaseHandler)
+}
+
+// 放行/丢弃/构造响应 请求体为可选的BreakpointEdit
+func (m *BreakpointMiddleware) releaseHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+	edit := &BreakpointEdit{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(edit); err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	edit.Action = r.PathValue("action")
+	err = m.Release(id, edit)
+	switch {
+	case errors.Is(err, ErrBreakpointNotFound):
+		writeJSONError(w, err, http.StatusNotFound)
+	case err != nil:
+		writeJSONError(w, err, http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (m *BreakpointMiddleware) uiHandler(w http.ResponseWriter, _ *http.Request) {
+	body, err := os.ReadFile(breakpointsHtml)
+	if err != nil {
+		writeJSONError(w, err, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func dropResponse(req *http.Request) *http.Response {
+	return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, "Dropped by gproxy breakpoint")
+}
+
+// 由BreakpointEdit构造响应
+func editResponse(req *http.Request, edit *BreakpointEdit) *http.Response {
+	code := edit.StatusCode
+	if code == 0 {
+		code = http.StatusOK
+	}
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, code, "")
+	resp.Status = strconv.Itoa(code) + " " + http.StatusText(code)
+	if edit.Header != nil {
+		resp.Header = edit.Header
+	}
+	setResponseBody(resp, edit.Body)
+	return resp
+}
+
+// 替换请求体并修正长度
+func setRequestBody(req *http.Request, body []byte) {
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+	req.Header.Del("Content-Length")
+	if len(body) == 0 && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		req.Body = http.NoBody
+	}
+}
+
+// 替换响应体并修正长度
+func setResponseBody(resp *http.Response, body []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	resp.Header.Del("Content-Length")
+}
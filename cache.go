@@ -0,0 +1,731 @@
+/*************************************************************************
+> File Name: cache.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-19 20:06:14 星期一
+> Content: 遵循RFC 9111的共享缓存 支持新鲜度计算、重新验证及Vary
+*************************************************************************/
+
+package gproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+var (
+	defaultMaxCacheObjectSize = int64(64 << 20)
+	// 只有Last-Modified时推算出的新鲜时长的上限
+	maxHeuristicFreshness = 24 * time.Hour
+	ErrCacheMiss          = errors.New("cache miss")
+	ErrCacheEntryTooLarge = errors.New("cache entry too large")
+)
+
+// 常见的不可变的制品url
+var DefaultPinPatterns = []*regexp.Regexp{
+	// go模块代理中指定版本的zip/mod/info
+	regexp.MustCompile(`/@v/v[^/]+\.(zip|mod|info)$`),
+	// npm的tarball
+	regexp.MustCompile(`/-/[^/]+\.tgz$`),
+	// PyPI的wheel及源码包
+	regexp.MustCompile(`/packages/.+\.(whl|tar\.gz|zip)$`),
+	// 按摘要获取的容器镜像层及manifest
+	regexp.MustCompile(`/v2/.+/(blobs|manifests)/sha256:[0-9a-f]{64}$`),
+}
+
+// 可以缓存的状态码 RFC 9110 15.1
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// 转发304时不应覆盖缓存的响应头
+var notModifiedSkipHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Content-Encoding":  true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"X-Cache":           true,
+}
+
+// 缓存的响应 不含响应体
+type CacheEntry struct {
+	Key        string      `json:"key"`
+	URL        string      `json:"url"`
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+	// Vary指定的请求头在存储时的值
+	VaryHeader   map[string]string `json:"varyHeader,omitempty"`
+	RequestTime  time.Time         `json:"requestTime"`
+	ResponseTime time.Time         `json:"responseTime"`
+	Size         int64             `json:"size"`
+	// 永久缓存 不再向上游验证
+	Pinned bool `json:"pinned,omitempty"`
+}
+
+// 缓存的存储
+type CacheStorage interface {
+	// 未缓存时返回ErrCacheMiss
+	Get(key string) (*CacheEntry, io.ReadCloser, error)
+	// 返回写入响应体的writer 调用Commit后生效
+	Put(entry *CacheEntry) (CacheWriter, error)
+	// 只更新响应头等元数据 用于重新验证之后
+	Update(entry *CacheEntry) error
+	Delete(key string) error
+	Entries() ([]*CacheEntry, error)
+}
+
+type CacheWriter interface {
+	io.Writer
+	Commit() error
+	Abort()
+}
+
+type CacheOptions struct {
+	// 为nil时使用默认大小的内存存储
+	Storage CacheStorage
+	// 超过该大小的响应不缓存
+	MaxEntrySize int64
+	// 匹配的url视为不可变 忽略上游的新鲜时长永久缓存 可使用DefaultPinPatterns
+	// 带Authorization的请求、private及no-store的响应仍不缓存
+	// 需要搭配磁盘存储 内存存储仍会按LRU淘汰
+	Pin []*regexp.Regexp
+	// 上游不可达或返回5xx时使用已过期的缓存
+	ServeStaleOnError bool
+}
+
+// 缓存中间件 https请求需要开启HttpsMitm
+type CacheMiddleware struct {
+	opt    CacheOptions
+	hits   atomic.Int64
+	misses atomic.Int64
+	// 需要在响应阶段处理的请求
+	pending sync.Map
+}
+
+// 一次缓存查找的状态
+type cacheLookup struct {
+	key         string
+	requestTime time.Time
+	// 正在重新验证的缓存
+	entry *CacheEntry
+	// 响应可以存储
+	store bool
+	// 不安全的方法 成功后使缓存失效
+	invalidate bool
+	// 上游出错 已使用过期的缓存响应
+	stale bool
+	// 请求头 goproxy发送前会删除Accept-Encoding等请求头 Vary需使用原始的值
+	header http.Header
+}
+
+// 去掉重新验证时代理添加的条件请求头
+func (l *cacheLookup) clearValidators(req *http.Request) {
+	if l.entry != nil {
+		req.Header.Del("If-None-Match")
+		req.Header.Del("If-Modified-Since")
+	}
+}
+
+func NewCacheMiddleware(opt CacheOptions) *CacheMiddleware {
+	if opt.Storage == nil {
+		opt.Storage = NewMemoryCacheStorage(0)
+	}
+	if opt.MaxEntrySize <= 0 {
+		opt.MaxEntrySize = defaultMaxCacheObjectSize
+	}
+	return &CacheMiddleware{opt: opt}
+}
+
+func (m *CacheMiddleware) Storage() CacheStorage {
+	return m.opt.Storage
+}
+
+func cacheKey(req *http.Request) string {
+	u := *req.URL
+	u.Fragment = ""
+	return u.String()
+}
+
+func (m *CacheMiddleware) pinned(key string) bool {
+	for _, re := range m.opt.Pin {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *CacheMiddleware) RequestCondition(req *http.Request, _ *goproxy.ProxyCtx) bool {
+	return req.URL != nil
+}
+
+func (m *CacheMiddleware) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	now := time.Now()
+	key := cacheKey(req)
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		if !isSafeMethod(req.Method) {
+			m.pending.Store(ctx, &cacheLookup{key: key, invalidate: true})
+		}
+		return req, nil
+	}
+	// 不处理范围请求
+	if req.Header.Get("Range") != "" {
+		return req, nil
+	}
+	reqCC := requestCacheControl(req.Header)
+	lookup := &cacheLookup{key: key, requestTime: now, store: req.Method == http.MethodGet, header: req.Header.Clone()}
+	entry, body, err := m.opt.Storage.Get(key)
+	if err != nil && !errors.Is(err, ErrCacheMiss) {
+		ctx.Warnf("Cannot read cache of %s: %v", key, err)
+	}
+	if err == nil && !entry.varyMatches(req) {
+		body.Close()
+		entry = nil
+	}
+	if entry != nil {
+		if entry.servable(reqCC, now) {
+			m.hits.Add(1)
+			return req, cachedResponse(req, entry, body, now)
+		}
+		body.Close()
+		// 客户端自身没有发送条件请求时 由代理向上游验证缓存
+		if req.Method == http.MethodGet && !isConditional(req) {
+			if etag := entry.Header.Get("ETag"); etag != "" {
+				req.Header.Set("If-None-Match", etag)
+				lookup.entry = entry
+			}
+			if lm := entry.Header.Get("Last-Modified"); lm != "" {
+				req.Header.Set("If-Modified-Since", lm)
+				lookup.entry = entry
+			}
+		}
+		if m.opt.ServeStaleOnError {
+			m.staleOnError(lookup, ctx)
+		}
+	}
+	if _, ok := reqCC["only-if-cached"]; ok {
+		m.misses.Add(1)
+		resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusGatewayTimeout, "Not in cache")
+		resp.Header.Set("X-Cache", "MISS")
+		return req, resp
+	}
+	m.pending.Store(ctx, lookup)
+	return req, nil
+}
+
+func (m *CacheMiddleware) ResponseCondition(_ *http.Response, ctx *goproxy.ProxyCtx) bool {
+	_, ok := m.pending.Load(ctx)
+	return ok
+}
+
+func (m *CacheMiddleware) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	v, _ := m.pending.LoadAndDelete(ctx)
+	lookup := v.(*cacheLookup)
+	if resp == nil {
+		return resp
+	}
+	if lookup.stale {
+		return resp
+	}
+	if lookup.invalidate {
+		if resp.StatusCode < 400 {
+			m.opt.Storage.Delete(lookup.key)
+		}
+		return resp
+	}
+	now := time.Now()
+	if lookup.entry != nil && resp.StatusCode == http.StatusNotModified {
+		if cached := m.revalidated(lookup, resp, ctx, now); cached != nil {
+			resp.Body.Close()
+			m.hits.Add(1)
+			return cached
+		}
+	}
+	m.misses.Add(1)
+	header := resp.Header.Clone()
+	resp.Header.Set("X-Cache", "MISS")
+	pinned := lookup.store && resp.StatusCode == http.StatusOK && m.pinned(lookup.key) && shareable(ctx.Req, resp)
+	if !lookup.store || isStreamingBody(resp.Header) || !(pinned || storable(ctx.Req, resp)) || resp.ContentLength > m.opt.MaxEntrySize {
+		return resp
+	}
+	entry := &CacheEntry{
+		Key:          lookup.key,
+		URL:          lookup.key,
+		StatusCode:   resp.StatusCode,
+		Header:       header,
+		VaryHeader:   varyHeader(lookup.header, resp.Header),
+		RequestTime:  lookup.requestTime,
+		ResponseTime: now,
+		Pinned:       pinned,
+	}
+	if pinned {
+		entry.Header.Del("Set-Cookie")
+	}
+	for _, key := range []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Proxy-Connection"} {
+		entry.Header.Del(key)
+	}
+	if entry.Header.Get("Date") == "" {
+		entry.Header.Set("Date", now.UTC().Format(http.TimeFormat))
+	}
+	w, err := m.opt.Storage.Put(entry)
+	if err != nil {
+		ctx.Warnf("Cannot store cache of %s: %v", lookup.key, err)
+		return resp
+	}
+	resp.Body = &cacheTeeBody{ReadCloser: resp.Body, w: w, entry: entry, max: m.opt.MaxEntrySize}
+	return resp
+}
+
+// 上游返回304 使用更新后的缓存响应 缓存不可用时返回nil
+func (m *CacheMiddleware) revalidated(lookup *cacheLookup, resp *http.Response, ctx *goproxy.ProxyCtx, now time.Time) *http.Response {
+	// 条件请求头是代理添加的 客户端需要完整的响应
+	lookup.clearValidators(ctx.Req)
+	entry := lookup.entry
+	for k, v := range resp.Header {
+		if !notModifiedSkipHeaders[k] {
+			entry.Header[k] = v
+		}
+	}
+	entry.RequestTime, entry.ResponseTime = lookup.requestTime, now
+	if err := m.opt.Storage.Update(entry); err != nil {
+		ctx.Warnf("Cannot update cache of %s: %v", lookup.key, err)
+	}
+	_, body, err := m.opt.Storage.Get(lookup.key)
+	if err != nil {
+		ctx.Warnf("Cannot read cache of %s: %v", lookup.key, err)
+		return nil
+	}
+	return cachedResponse(ctx.Req, entry, body, now)
+}
+
+// 上游不可达或返回5xx时使用已过期的缓存
+// 通过替换RoundTripper实现 MITM的请求出错时goproxy不会执行响应的勾子
+func (m *CacheMiddleware) staleOnError(lookup *cacheLookup, ctx *goproxy.ProxyCtx) {
+	next := ctx.RoundTripper
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		var resp *http.Response
+		var err error
+		if next != nil {
+			resp, err = next.RoundTrip(req, ctx)
+		} else {
+			resp, err = ctx.Proxy.Tr.RoundTrip(req)
+		}
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			return resp, nil
+		}
+		entry, body, gerr := m.opt.Storage.Get(lookup.key)
+		if gerr != nil {
+			return resp, err
+		}
+		if err != nil {
+			ctx.Warnf("Serve stale cache of %s: %v", lookup.key, err)
+		} else {
+			ctx.Warnf("Serve stale cache of %s: upstream responded %s", lookup.key, resp.Status)
+			resp.Body.Close()
+		}
+		lookup.stale = true
+		lookup.clearValidators(req)
+		cached := cachedResponse(req, entry, body, time.Now())
+		cached.Header.Set("X-Cache", "STALE")
+		return cached, nil
+	})
+}
+
+// 按URL清除缓存 prefix为true时清除以url开头的全部缓存 url为空时清除全部
+func (m *CacheMiddleware) Purge(url string, prefix bool) (int, error) {
+	if url != "" && !prefix {
+		if err := m.opt.Storage.Delete(url); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+	entries, err := m.opt.Storage.Entries()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Key, url) {
+			continue
+		}
+		if err := m.opt.Storage.Delete(e.Key); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// 注册缓存相关的管理接口
+func (m *CacheMiddleware) RegisterAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/cache", func(w http.ResponseWriter, _ *http.Request) {
+		entries, err := m.opt.Storage.Entries()
+		if err != nil {
+			writeJSONError(w, err, http.StatusInternalServerError)
+			return
+		}
+		var size int64
+		for _, e := range entries {
+			size += e.Size
+		}
+		writeJSON(w, map[string]interface{}{
+			"entries": len(entries),
+			"size":    size,
+			"hits":    m.hits.Load(),
+			"misses":  m.misses.Load(),
+		}, http.StatusOK)
+	})
+	mux.HandleFunc("GET /admin/cache/entries", func(w http.ResponseWriter, _ *http.Request) {
+		entries, err := m.opt.Storage.Entries()
+		if err != nil {
+			writeJSONError(w, err, http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, entries, http.StatusOK)
+	})
+	// ?url=完整的url 或 ?prefix=url前缀 都不指定时清除全部
+	mux.HandleFunc("DELETE /admin/cache", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		url, prefix := query.Get("url"), false
+		if url == "" {
+			url, prefix = query.Get("prefix"), true
+		}
+		n, err := m.Purge(url, prefix)
+		if err != nil {
+			writeJSONError(w, err, http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]int{"purged": n}, http.StatusOK)
+	})
+	mux.HandleFunc("GET /admin/cache/export", func(w http.ResponseWriter, _ *http.Request) {
+		// 导出的文件可能很大 取消写超时
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", "attachment;filename=gproxy-cache.tar.gz")
+		if err := ExportCache(m.opt.Storage, w); err != nil {
+			// 响应已经开始 中断连接使客户端得知导出失败
+			panic(http.ErrAbortHandler)
+		}
+	})
+	mux.HandleFunc("POST /admin/cache/import", func(w http.ResponseWriter, r *http.Request) {
+		http.NewResponseController(w).SetReadDeadline(time.Time{})
+		n, err := ImportCache(m.opt.Storage, r.Body)
+		if err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]int{"imported": n}, http.StatusOK)
+	})
+}
+
+// 由缓存构造响应
+func cachedResponse(req *http.Request, entry *CacheEntry, body io.ReadCloser, now time.Time) *http.Response {
+	resp := &http.Response{
+		StatusCode:    entry.StatusCode,
+		Status:        strconv.Itoa(entry.StatusCode) + " " + http.StatusText(entry.StatusCode),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        entry.Header.Clone(),
+		Body:          body,
+		ContentLength: entry.Size,
+		Request:       req,
+	}
+	resp.Header.Set("Age", strconv.FormatInt(int64(entry.age(now)/time.Second), 10))
+	resp.Header.Set("X-Cache", "HIT")
+	if req.Method == http.MethodHead {
+		body.Close()
+		resp.Body = http.NoBody
+	} else if notModified(req, entry) {
+		body.Close()
+		resp.Body = http.NoBody
+		resp.StatusCode = http.StatusNotModified
+		resp.Status = "304 Not Modified"
+		resp.ContentLength = 0
+		resp.Header.Del("Content-Length")
+	}
+	return resp
+}
+
+// 客户端的条件请求与缓存的响应一致
+func notModified(req *http.Request, entry *CacheEntry) bool {
+	if entry.StatusCode != http.StatusOK {
+		return false
+	}
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(entry.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == "*" || t == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(entry.Header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+func isConditional(req *http.Request) bool {
+	return req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// 响应是否可以存储在共享缓存中
+func storable(req *http.Request, resp *http.Response) bool {
+	if req.Method != http.MethodGet || !cacheableStatus[resp.StatusCode] || !shareable(req, resp) {
+		return false
+	}
+	respCC := parseCacheControl(resp.Header)
+	_, public := respCC["public"]
+	if resp.Header.Get("Set-Cookie") != "" && !public {
+		return false
+	}
+	// 既没有新鲜时长也没有验证器的响应无法复用
+	_, maxAge := respCC["max-age"]
+	_, sMaxAge := respCC["s-maxage"]
+	if !maxAge && !sMaxAge && resp.Header.Get("Expires") == "" &&
+		resp.Header.Get("ETag") == "" && resp.Header.Get("Last-Modified") == "" {
+		return false
+	}
+	return true
+}
+
+// 响应是否允许被其他客户端复用 固定的缓存只延长新鲜时长 同样需要满足
+func shareable(req *http.Request, resp *http.Response) bool {
+	reqCC, respCC := requestCacheControl(req.Header), parseCacheControl(resp.Header)
+	if _, ok := reqCC["no-store"]; ok {
+		return false
+	}
+	if _, ok := respCC["no-store"]; ok {
+		return false
+	}
+	if _, ok := respCC["private"]; ok {
+		return false
+	}
+	_, public := respCC["public"]
+	_, sMaxAge := respCC["s-maxage"]
+	_, mustRevalidate := respCC["must-revalidate"]
+	if req.Header.Get("Authorization") != "" && !public && !sMaxAge && !mustRevalidate {
+		return false
+	}
+	return strings.TrimSpace(resp.Header.Get("Vary")) != "*"
+}
+
+// 解析Cache-Control 指令名转为小写
+func parseCacheControl(header http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, v := range header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(d, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return cc
+}
+
+// 请求中没有Cache-Control时 Pragma: no-cache等同于no-cache
+func requestCacheControl(header http.Header) map[string]string {
+	cc := parseCacheControl(header)
+	if len(header.Values("Cache-Control")) == 0 && strings.Contains(strings.ToLower(header.Get("Pragma")), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+// 以秒为单位的指令值
+func durationDirective(cc map[string]string, name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || sec < 0 {
+		return 0, false
+	}
+	return time.Duration(sec) * time.Second, true
+}
+
+func varyHeader(reqHeader, respHeader http.Header) map[string]string {
+	var vary map[string]string
+	for _, v := range respHeader.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if vary == nil {
+				vary = make(map[string]string)
+			}
+			vary[name] = strings.Join(reqHeader.Values(name), ", ")
+		}
+	}
+	return vary
+}
+
+func (e *CacheEntry) varyMatches(req *http.Request) bool {
+	for name, value := range e.VaryHeader {
+		if strings.Join(req.Header.Values(name), ", ") != value {
+			return false
+		}
+	}
+	return true
+}
+
+// 缓存的响应当前的年龄 RFC 9111 4.2.3
+func (e *CacheEntry) age(now time.Time) time.Duration {
+	date, err := http.ParseTime(e.Header.Get("Date"))
+	if err != nil {
+		date = e.ResponseTime
+	}
+	apparent := max(0, e.ResponseTime.Sub(date))
+	ageValue, _ := strconv.ParseInt(e.Header.Get("Age"), 10, 64)
+	corrected := time.Duration(ageValue)*time.Second + e.ResponseTime.Sub(e.RequestTime)
+	return max(apparent, corrected) + now.Sub(e.ResponseTime)
+}
+
+// 缓存的响应的新鲜时长 RFC 9111 4.2.1
+func (e *CacheEntry) freshnessLifetime() time.Duration {
+	cc := parseCacheControl(e.Header)
+	if d, ok := durationDirective(cc, "s-maxage"); ok {
+		return d
+	}
+	if d, ok := durationDirective(cc, "max-age"); ok {
+		return d
+	}
+	date, err := http.ParseTime(e.Header.Get("Date"))
+	if err != nil {
+		date = e.ResponseTime
+	}
+	if v := e.Header.Get("Expires"); v != "" {
+		// 无效的Expires视为已过期
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0
+		}
+		return max(0, expires.Sub(date))
+	}
+	if lm, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil {
+		return min(max(0, date.Sub(lm)/10), maxHeuristicFreshness)
+	}
+	return 0
+}
+
+// 缓存的响应是否可以不经验证直接使用
+func (e *CacheEntry) servable(reqCC map[string]string, now time.Time) bool {
+	if e.Pinned {
+		return true
+	}
+	respCC := parseCacheControl(e.Header)
+	if _, ok := reqCC["no-cache"]; ok {
+		return false
+	}
+	if _, ok := respCC["no-cache"]; ok {
+		return false
+	}
+	age, lifetime := e.age(now), e.freshnessLifetime()
+	if d, ok := durationDirective(reqCC, "max-age"); ok && age > d {
+		return false
+	}
+	if d, ok := durationDirective(reqCC, "min-fresh"); ok && lifetime-age < d {
+		return false
+	}
+	if age < lifetime {
+		return true
+	}
+	// 已过期 只有客户端允许且响应没有禁止时才使用
+	for _, d := range []string{"must-revalidate", "proxy-revalidate", "s-maxage"} {
+		if _, ok := respCC[d]; ok {
+			return false
+		}
+	}
+	v, ok := reqCC["max-stale"]
+	if !ok {
+		return false
+	}
+	if v == "" {
+		return true
+	}
+	d, ok := durationDirective(reqCC, "max-stale")
+	return ok && age-lifetime <= d
+}
+
+// 读取响应体的同时写入缓存 读取完毕后提交
+type cacheTeeBody struct {
+	io.ReadCloser
+	w     CacheWriter
+	entry *CacheEntry
+	max   int64
+}
+
+func (b *cacheTeeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.w == nil {
+		return n, err
+	}
+	if n > 0 {
+		b.entry.Size += int64(n)
+		if b.entry.Size > b.max {
+			b.abort()
+		} else if _, werr := b.w.Write(p[:n]); werr != nil {
+			b.abort()
+		}
+	}
+	if err == io.EOF && b.w != nil {
+		b.entry.Header.Set("Content-Length", strconv.FormatInt(b.entry.Size, 10))
+		b.w.Commit()
+		b.w = nil
+	}
+	return n, err
+}
+
+func (b *cacheTeeBody) abort() {
+	b.w.Abort()
+	b.w = nil
+}
+
+// 未读取完毕就关闭时放弃缓存
+func (b *cacheTeeBody) Close() error {
+	if b.w != nil {
+		b.abort()
+	}
+	return b.ReadCloser.Close()
+}
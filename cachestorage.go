@@ -0,0 +1,407 @@
+/*************************************************************************
+> File Name: cachestorage.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-19 20:41:33 星期一
+> Content: 缓存的存储 限制总大小的内存LRU及磁盘目录
+*************************************************************************/
+
+package gproxy
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var defaultMemoryCacheSize = int64(256 << 20)
+
+// 内存存储 超过总大小后淘汰最久未使用的缓存
+type MemoryCacheStorage struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	lru     *list.List
+	items   map[string]*list.Element
+}
+
+type memoryCacheItem struct {
+	entry *CacheEntry
+	body  []byte
+}
+
+func (item *memoryCacheItem) cost() int64 {
+	var n int
+	for k, vs := range item.entry.Header {
+		n += len(k)
+		for _, v := range vs {
+			n += len(v)
+		}
+	}
+	return int64(n + len(item.entry.Key) + len(item.body))
+}
+
+// maxSize为缓存的总字节数 不大于0时使用默认值
+func NewMemoryCacheStorage(maxSize int64) *MemoryCacheStorage {
+	if maxSize <= 0 {
+		maxSize = defaultMemoryCacheSize
+	}
+	return &MemoryCacheStorage{maxSize: maxSize, lru: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (s *MemoryCacheStorage) Get(key string) (*CacheEntry, io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return nil, nil, ErrCacheMiss
+	}
+	s.lru.MoveToFront(el)
+	item := el.Value.(*memoryCacheItem)
+	return cloneCacheEntry(item.entry), io.NopCloser(bytes.NewReader(item.body)), nil
+}
+
+func (s *MemoryCacheStorage) Put(entry *CacheEntry) (CacheWriter, error) {
+	return &memoryCacheWriter{s: s, entry: entry}, nil
+}
+
+func (s *MemoryCacheStorage) Update(entry *CacheEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[entry.Key]
+	if !ok {
+		return ErrCacheMiss
+	}
+	item := el.Value.(*memoryCacheItem)
+	s.size -= item.cost()
+	item.entry = cloneCacheEntry(entry)
+	s.size += item.cost()
+	s.evict()
+	return nil
+}
+
+func (s *MemoryCacheStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+	return nil
+}
+
+func (s *MemoryCacheStorage) Entries() ([]*CacheEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]*CacheEntry, 0, len(s.items))
+	for el := s.lru.Front(); el != nil; el = el.Next() {
+		entries = append(entries, cloneCacheEntry(el.Value.(*memoryCacheItem).entry))
+	}
+	return entries, nil
+}
+
+func (s *MemoryCacheStorage) store(item *memoryCacheItem) error {
+	if item.cost() > s.maxSize {
+		return ErrCacheEntryTooLarge
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[item.entry.Key]; ok {
+		s.remove(el)
+	}
+	s.items[item.entry.Key] = s.lru.PushFront(item)
+	s.size += item.cost()
+	s.evict()
+	return nil
+}
+
+// 调用时需持有锁
+func (s *MemoryCacheStorage) remove(el *list.Element) {
+	item := s.lru.Remove(el).(*memoryCacheItem)
+	delete(s.items, item.entry.Key)
+	s.size -= item.cost()
+}
+
+// 调用时需持有锁
+func (s *MemoryCacheStorage) evict() {
+	for s.size > s.maxSize && s.lru.Len() > 0 {
+		s.remove(s.lru.Back())
+	}
+}
+
+type memoryCacheWriter struct {
+	s     *MemoryCacheStorage
+	entry *CacheEntry
+	buf   bytes.Buffer
+}
+
+func (w *memoryCacheWriter) Write(p []byte) (int, error) {
+	if int64(w.buf.Len()+len(p)) > w.s.maxSize {
+		return 0, ErrCacheEntryTooLarge
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memoryCacheWriter) Commit() error {
+	return w.s.store(&memoryCacheItem{entry: cloneCacheEntry(w.entry), body: w.buf.Bytes()})
+}
+
+func (w *memoryCacheWriter) Abort() {
+	w.buf = bytes.Buffer{}
+}
+
+// 磁盘存储 每个缓存对应目录中的<hash>.json及<hash>.body两个文件
+type DiskCacheStorage struct {
+	dir string
+	// 保证元数据与响应体的替换及读取的一致
+	mu sync.RWMutex
+}
+
+func NewDiskCacheStorage(dir string) (*DiskCacheStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DiskCacheStorage{dir: dir}, nil
+}
+
+func (s *DiskCacheStorage) Dir() string {
+	return s.dir
+}
+
+func (s *DiskCacheStorage) path(key string) string {
+	return filepath.Join(s.dir, hashStrings(key))
+}
+
+func (s *DiskCacheStorage) readEntry(metaFile string) (*CacheEntry, error) {
+	data, err := os.ReadFile(metaFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry := &CacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (s *DiskCacheStorage) Get(key string) (*CacheEntry, io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p := s.path(key)
+	entry, err := s.readEntry(p + ".json")
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := os.Open(p + ".body")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry, body, nil
+}
+
+func (s *DiskCacheStorage) Put(entry *CacheEntry) (CacheWriter, error) {
+	f, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &diskCacheWriter{s: s, entry: entry, f: f}, nil
+}
+
+func (s *DiskCacheStorage) Update(entry *CacheEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.path(entry.Key)
+	if _, err := os.Stat(p + ".json"); err != nil {
+		return ErrCacheMiss
+	}
+	return s.writeEntry(p+".json", entry)
+}
+
+// 先写入临时文件再重命名 调用时需持有锁
+func (s *DiskCacheStorage) writeEntry(metaFile string, entry *CacheEntry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := metaFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, metaFile)
+}
+
+func (s *DiskCacheStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.path(key)
+	for _, f := range []string{p + ".json", p + ".body"} {
+		if err := os.Remove(f); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *DiskCacheStorage) Entries() ([]*CacheEntry, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*CacheEntry
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		entry, err := s.readEntry(filepath.Join(s.dir, f.Name()))
+		if errors.Is(err, ErrCacheMiss) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.New(f.Name() + ": " + err.Error())
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+type diskCacheWriter struct {
+	s     *DiskCacheStorage
+	entry *CacheEntry
+	f     *os.File
+}
+
+func (w *diskCacheWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+func (w *diskCacheWriter) Commit() error {
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	p := w.s.path(w.entry.Key)
+	if err := os.Rename(w.f.Name(), p+".body"); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	return w.s.writeEntry(p+".json", w.entry)
+}
+
+func (w *diskCacheWriter) Abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+func cloneCacheEntry(e *CacheEntry) *CacheEntry {
+	cp := *e
+	cp.Header = e.Header.Clone()
+	return &cp
+}
+
+// 将存储中的全部缓存导出为tar.gz 用于预置离线环境的缓存
+func ExportCache(storage CacheStorage, w io.Writer) error {
+	entries, err := storage.Entries()
+	if err != nil {
+		return err
+	}
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		entry, body, err := storage.Get(e.Key)
+		if errors.Is(err, ErrCacheMiss) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = exportCacheEntry(tw, entry, body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// 每个缓存依次写入<hash>.json及<hash>.body
+func exportCacheEntry(tw *tar.Writer, entry *CacheEntry, body io.Reader) error {
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	name := hashStrings(entry.Key)
+	if err := tw.WriteHeader(&tar.Header{Name: name + ".json", Mode: 0644, Size: int64(len(meta)), ModTime: entry.ResponseTime}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(meta); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name + ".body", Mode: 0644, Size: entry.Size, ModTime: entry.ResponseTime}); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, body, entry.Size)
+	return err
+}
+
+// 导入ExportCache导出的缓存 返回导入的数量
+func ImportCache(storage CacheStorage, r io.Reader) (int, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	tr := tar.NewReader(gr)
+	var entry *CacheEntry
+	var n int
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		switch {
+		case strings.HasSuffix(hdr.Name, ".json"):
+			entry = &CacheEntry{}
+			if err := json.NewDecoder(tr).Decode(entry); err != nil {
+				return n, errors.New(hdr.Name + ": " + err.Error())
+			}
+		case strings.HasSuffix(hdr.Name, ".body"):
+			if entry == nil || hdr.Name != hashStrings(entry.Key)+".body" {
+				return n, errors.New(hdr.Name + ": body without metadata")
+			}
+			w, err := storage.Put(entry)
+			if err != nil {
+				return n, err
+			}
+			if _, err := io.Copy(w, tr); err != nil {
+				w.Abort()
+				return n, err
+			}
+			if err := w.Commit(); err != nil {
+				return n, err
+			}
+			entry = nil
+			n++
+		}
+	}
+}
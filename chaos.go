@@ -0,0 +1,342 @@
+/*************************************************************************
+> File Name: chaos.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-19 16:55:48 星期一
+> Content: 故障注入中间件 按概率对匹配的请求注入延迟、错误等故障
+*************************************************************************/
+
+package gproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// 故障类型
+const (
+	// 固定或随机抖动的延迟
+	ChaosLatency = "latency"
+	// 返回错误状态码
+	ChaosStatus = "status"
+	// 重置客户端连接
+	ChaosReset = "reset"
+	// 响应体只返回部分内容后中断
+	ChaosTruncate = "truncate"
+	// 响应体缓慢地分段返回
+	ChaosDrip = "drip"
+	// 模拟域名解析失败
+	ChaosDNS = "dns"
+)
+
+var (
+	defaultChaosDripBytes    = 64
+	defaultChaosDripInterval = 500 * time.Millisecond
+	ErrUnknownChaosType      = errors.New("unknown chaos fault type")
+)
+
+// 故障规则 每条规则按各自的概率独立生效
+type ChaosRule struct {
+	Type string `json:"type"`
+	// 匹配的域名 支持*.example.com 为空时匹配全部
+	Host string `json:"host"`
+	// 匹配的路径前缀
+	PathPrefix string `json:"pathPrefix"`
+	// 生效的概率 0-1
+	Probability float64 `json:"probability"`
+	// latency: 延迟为Latency加上[0, Jitter)内的随机值
+	Latency time.Duration `json:"latency"`
+	Jitter  time.Duration `json:"jitter"`
+	// status: 返回的状态码
+	StatusCode int `json:"statusCode"`
+	// truncate: 返回的字节数
+	TruncateBytes int64 `json:"truncateBytes"`
+	// drip: 每隔DripInterval返回DripBytes个字节
+	DripBytes    int           `json:"dripBytes"`
+	DripInterval time.Duration `json:"dripInterval"`
+}
+
+func (r *ChaosRule) validate() error {
+	switch r.Type {
+	case ChaosLatency, ChaosReset, ChaosTruncate, ChaosDrip, ChaosDNS:
+	case ChaosStatus:
+		if r.StatusCode < 100 || r.StatusCode > 999 {
+			return fmt.Errorf("invalid chaos status code: %d", r.StatusCode)
+		}
+	default:
+		return ErrUnknownChaosType
+	}
+	if r.Probability < 0 || r.Probability > 1 {
+		return fmt.Errorf("chaos probability must be in [0, 1]: %v", r.Probability)
+	}
+	return nil
+}
+
+func (r *ChaosRule) match(req *http.Request) bool {
+	if req.URL == nil {
+		return false
+	}
+	return hostMatches(r.Host, req.URL.Hostname()) && strings.HasPrefix(req.URL.Path, r.PathPrefix)
+}
+
+// 域名匹配 pattern为空时匹配全部 以*.开头时匹配子域名
+func hostMatches(pattern, host string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// 故障注入中间件
+type ChaosMiddleware struct {
+	mu    sync.Mutex
+	rules []ChaosRule
+	seed  int64
+	rng   *rand.Rand
+	// 需要在响应阶段注入的故障
+	pending sync.Map
+}
+
+// 相同的seed在相同的请求序列下产生相同的故障
+func NewChaosMiddleware(seed int64, rules ...ChaosRule) (*ChaosMiddleware, error) {
+	m := &ChaosMiddleware{}
+	m.SetSeed(seed)
+	if err := m.SetRules(rules); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *ChaosMiddleware) SetSeed(seed int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seed = seed
+	m.rng = rand.New(rand.NewSource(seed))
+}
+
+// 替换全部规则
+func (m *ChaosMiddleware) SetRules(rules []ChaosRule) error {
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rules = append([]ChaosRule(nil), rules...)
+	return nil
+}
+
+func (m *ChaosMiddleware) AddRule(rule ChaosRule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rules = append(m.rules, rule)
+	return nil
+}
+
+func (m *ChaosMiddleware) Rules() []ChaosRule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]ChaosRule(nil), m.rules...)
+}
+
+// 按概率选出对请求生效的规则
+func (m *ChaosMiddleware) roll(req *http.Request) []ChaosRule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var faults []ChaosRule
+	for _, r := range m.rules {
+		if r.match(req) && m.rng.Float64() < r.Probability {
+			faults = append(faults, r)
+		}
+	}
+	return faults
+}
+
+func (m *ChaosMiddleware) jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return time.Duration(m.rng.Int63n(int64(d)))
+}
+
+func (m *ChaosMiddleware) RequestCondition(req *http.Request, _ *goproxy.ProxyCtx) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.rules {
+		if m.rules[i].match(req) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ChaosMiddleware) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	var respFaults []ChaosRule
+	for _, f := range m.roll(req) {
+		ctx.Logf("Inject chaos %s into %s", f.Type, req.URL)
+		switch f.Type {
+		case ChaosLatency:
+			d := f.Latency + m.jitter(f.Jitter)
+			extendWriteDeadline(req, d)
+			select {
+			case <-time.After(d):
+			case <-req.Context().Done():
+			}
+		case ChaosStatus:
+			resp := goproxy.NewResponse(req, goproxy.ContentTypeText, f.StatusCode, "Injected by gproxy chaos")
+			resp.Status = strconv.Itoa(f.StatusCode) + " " + http.StatusText(f.StatusCode)
+			return req, resp
+		case ChaosDNS:
+			msg := fmt.Sprintf("dial tcp: lookup %s: no such host", req.URL.Hostname())
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, msg)
+		case ChaosReset:
+			if abortClientConn(req, true) {
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, "")
+			}
+			// 无法接管连接时(如MITM) 在写出响应头后中断响应体
+			resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, "")
+			resp.Body = io.NopCloser(errReader{errors.New("connection reset by gproxy chaos")})
+			return req, resp
+		case ChaosTruncate, ChaosDrip:
+			respFaults = append(respFaults, f)
+		}
+	}
+	if len(respFaults) > 0 {
+		m.pending.Store(ctx, respFaults)
+	}
+	return req, nil
+}
+
+func (m *ChaosMiddleware) ResponseCondition(_ *http.Response, ctx *goproxy.ProxyCtx) bool {
+	_, ok := m.pending.Load(ctx)
+	return ok
+}
+
+func (m *ChaosMiddleware) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	v, _ := m.pending.LoadAndDelete(ctx)
+	if resp == nil || resp.Body == nil {
+		return resp
+	}
+	for _, f := range v.([]ChaosRule) {
+		switch f.Type {
+		case ChaosTruncate:
+			resp.Body = &truncatedBody{ReadCloser: resp.Body, remain: f.TruncateBytes, req: ctx.Req}
+		case ChaosDrip:
+			size, interval := f.DripBytes, f.DripInterval
+			if size <= 0 {
+				size = defaultChaosDripBytes
+			}
+			if interval <= 0 {
+				interval = defaultChaosDripInterval
+			}
+			resp.Body = &dripBody{ReadCloser: resp.Body, size: size, interval: interval, req: ctx.Req}
+		}
+	}
+	return resp
+}
+
+// 注册故障注入相关的管理接口
+func (m *ChaosMiddleware) RegisterAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/chaos", func(w http.ResponseWriter, _ *http.Request) {
+		m.mu.Lock()
+		seed := m.seed
+		m.mu.Unlock()
+		writeJSON(w, map[string]interface{}{"seed": seed, "rules": m.Rules()}, http.StatusOK)
+	})
+	mux.HandleFunc("PUT /admin/chaos/rules", func(w http.ResponseWriter, r *http.Request) {
+		var rules []ChaosRule
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		if err := m.SetRules(rules); err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /admin/chaos/rules", func(w http.ResponseWriter, r *http.Request) {
+		var rule ChaosRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		if err := m.AddRule(rule); err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("PUT /admin/chaos/seed", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		seed, err := strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+		if err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		m.SetSeed(seed)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// 只返回前remain个字节 之后中断客户端连接
+type truncatedBody struct {
+	io.ReadCloser
+	remain int64
+	req    *http.Request
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.remain <= 0 {
+		abortClientConn(b.req, false)
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.remain {
+		p = p[:b.remain]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remain -= int64(n)
+	return n, err
+}
+
+// 每次只返回size个字节 并在两次读取之间等待interval
+type dripBody struct {
+	io.ReadCloser
+	size     int
+	interval time.Duration
+	req      *http.Request
+	started  bool
+}
+
+func (b *dripBody) Read(p []byte) (int, error) {
+	if b.started {
+		extendWriteDeadline(b.req, b.interval)
+		time.Sleep(b.interval)
+	}
+	b.started = true
+	if len(p) > b.size {
+		p = p[:b.size]
+	}
+	return b.ReadCloser.Read(p)
+}
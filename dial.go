@@ -0,0 +1,105 @@
+/*************************************************************************
+> File Name: dial.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-19 17:40:12 星期一
+> Content: 出站连接的建立 CONNECT隧道、websocket及http请求的连接均经过这里
+*************************************************************************/
+
+package gproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// 需要包装CONNECT隧道连接的中间件可实现该接口
+// 返回的连接读方向为下行(上游->客户端) 写方向为上行(客户端->上游)
+type ConnMiddleware interface {
+	WrapConn(conn net.Conn, req *http.Request) net.Conn
+}
+
+// 为CONNECT请求建立到上游的连接 并依次交给ConnMiddleware包装
+func (p *SimpleProxyServer) connectDial(req *http.Request, network, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if p.proxy.ConnectDial != nil {
+		// 环境变量中配置了https_proxy时经由上级代理
+		conn, err = p.proxy.ConnectDial(network, addr)
+	} else {
+		ctx := req.Context()
+		if p.outbound != nil {
+			if src := p.outbound.source(req); src != nil {
+				ctx = context.WithValue(ctx, sourceIPKey{}, src)
+			}
+		}
+		conn, err = p.dial(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range p.middlewares {
+		if cm, ok := m.(ConnMiddleware); ok {
+			conn = cm.WrapConn(conn, req)
+		}
+	}
+	return conn, nil
+}
+
+// 建立出站连接 配置了DNS时使用自定义的解析
+// 按出站的配置选择源地址及IP版本 解析出IPv4及IPv6地址时使用Happy Eyeballs
+func (p *SimpleProxyServer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || p.resolver == nil && p.outbound == nil {
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	var ips []net.IP
+	switch ip := net.ParseIP(host); {
+	case ip != nil:
+		ips = []net.IP{ip}
+	case p.resolver != nil:
+		if ips, err = p.lookup(ctx, host); err != nil {
+			return nil, err
+		}
+	default:
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	src, _ := ctx.Value(sourceIPKey{}).(net.IP)
+	ips = p.outbound.order(ips, network, src)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("dial %s: %w", addr, ErrNoOutboundAddress)
+	}
+	return p.outbound.dialAddrs(ctx, network, ips, port, src)
+}
+
+// 解析域名并记录日志
+func (p *SimpleProxyServer) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	result, err := p.resolver.Lookup(ctx, host)
+	if err != nil {
+		p.Logger.WithFields(LogFields{"host": host, "err": err.Error()}).Warn("DNS Lookup Failed")
+		return nil, fmt.Errorf("lookup %s: %w", host, err)
+	}
+	entry := p.Logger.WithFields(LogFields{
+		"host":     host,
+		"ips":      result.IPs,
+		"source":   result.Source,
+		"server":   result.Server,
+		"ttl":      result.TTL.String(),
+		"duration": result.Duration.String(),
+	})
+	if p.DNS.LogQueries {
+		entry.Info("DNS Lookup")
+	} else {
+		entry.Debug("DNS Lookup")
+	}
+	return result.IPs, nil
+}
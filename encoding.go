@@ -0,0 +1,101 @@
+/*************************************************************************
+> File Name: encoding.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-19 23:20:46 星期一
+> Content: 按Content-Encoding解压及压缩请求体/响应体
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// 是否支持该Content-Encoding
+func supportedEncoding(encoding string) bool {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity", "gzip", "x-gzip", "deflate":
+		return true
+	}
+	return false
+}
+
+// 返回解压后的reader
+func decodeContent(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return io.NopCloser(r), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// 标准的deflate为zlib格式 部分服务端直接发送raw deflate
+		br := bufio.NewReader(r)
+		if header, err := br.Peek(2); err == nil && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding: %q", encoding)
+}
+
+// 返回压缩写入w的writer Close时写入结尾
+func encodeContent(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return nopWriteCloser{w}, nil
+	case "gzip", "x-gzip":
+		return gzip.NewWriter(w), nil
+	case "deflate":
+		return zlib.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding: %q", encoding)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// 解压整个body 解压后超过limit时返回errBodyTooLarge 防止压缩炸弹耗尽内存
+func decodeContentBytes(data []byte, encoding string, limit int64) ([]byte, error) {
+	r, err := decodeContent(bytes.NewReader(data), encoding)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	decoded, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return decoded, nil
+}
+
+// 压缩整个body
+func encodeContentBytes(data []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := encodeContent(&buf, encoding)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
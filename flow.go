@@ -0,0 +1,328 @@
+/*************************************************************************
+> File Name: flow.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-19 10:12:05 星期一
+> Content: 抓包记录 保存经过代理的请求与响应
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+var (
+	defaultMaxFlows        = 1000
+	defaultMaxFlowBodySize = int64(1 << 20)
+	// 每条记录最多保存的websocket消息数 超过后淘汰最早的消息
+	maxFlowMessages = 1000
+)
+
+// 抓包记录的请求
+type FlowRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Proto  string      `json:"proto"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+	// 请求体超过记录上限时被截断
+	Truncated bool `json:"truncated"`
+}
+
+// 抓包记录的响应
+type FlowResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Status     string      `json:"status"`
+	Proto      string      `json:"proto"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	Truncated  bool        `json:"truncated"`
+}
+
+// websocket连接、gRPC调用或SSE响应中的一条消息
+type FlowMessage struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Opcode    int       `json:"opcode"`
+	Payload   []byte    `json:"payload"`
+	// 消息的完整长度
+	Size      int64 `json:"size"`
+	Truncated bool  `json:"truncated"`
+	// 被中间件丢弃
+	Dropped bool `json:"dropped,omitempty"`
+	// 由中间件或管理接口注入
+	Injected bool `json:"injected,omitempty"`
+	// 解码为json的gRPC消息或SSE事件
+	JSON json.RawMessage `json:"json,omitempty"`
+}
+
+// 一次完整的请求/响应记录
+type Flow struct {
+	ID         int64         `json:"id"`
+	Session    int64         `json:"session"`
+	ClientAddr string        `json:"clientAddr"`
+	StartTime  time.Time     `json:"startTime"`
+	Duration   time.Duration `json:"duration"`
+	Request    *FlowRequest  `json:"request"`
+	Response   *FlowResponse `json:"response,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	// 重放产生的记录 指向被重放的记录id
+	ReplayOf int64 `json:"replayOf,omitempty"`
+	// websocket连接、gRPC调用或SSE响应中的消息
+	Messages []*FlowMessage `json:"messages,omitempty"`
+}
+
+// 抓包记录的存储 超过容量后淘汰最早的记录
+type FlowStore struct {
+	mu          sync.RWMutex
+	nextID      int64
+	maxFlows    int
+	maxBodySize int64
+	flows       []*Flow
+	// 等待响应的记录
+	pending map[*goproxy.ProxyCtx]*Flow
+}
+
+func NewFlowStore(maxFlows int, maxBodySize int64) *FlowStore {
+	if maxFlows <= 0 {
+		maxFlows = defaultMaxFlows
+	}
+	if maxBodySize <= 0 {
+		maxBodySize = defaultMaxFlowBodySize
+	}
+	return &FlowStore{
+		maxFlows:    maxFlows,
+		maxBodySize: maxBodySize,
+		pending:     make(map[*goproxy.ProxyCtx]*Flow),
+	}
+}
+
+// 添加一条记录并分配id
+func (s *FlowStore) Add(f *Flow) *Flow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	f.ID = s.nextID
+	s.flows = append(s.flows, f)
+	if len(s.flows) > s.maxFlows {
+		evicted := s.flows[0]
+		s.flows = s.flows[1:]
+		for ctx, pf := range s.pending {
+			if pf == evicted {
+				delete(s.pending, ctx)
+			}
+		}
+	}
+	return f
+}
+
+// 按id获取记录 返回记录的副本
+func (s *FlowStore) Get(id int64) *Flow {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, f := range s.flows {
+		if f.ID == id {
+			cp := *f
+			return &cp
+		}
+	}
+	return nil
+}
+
+// 获取全部记录 按时间先后排序
+func (s *FlowStore) List() []*Flow {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	flows := make([]*Flow, len(s.flows))
+	for i, f := range s.flows {
+		cp := *f
+		flows[i] = &cp
+	}
+	return flows
+}
+
+// 清空记录
+func (s *FlowStore) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flows = nil
+	s.pending = make(map[*goproxy.ProxyCtx]*Flow)
+}
+
+// 记录请求 响应到达后由finish补全
+func (s *FlowStore) start(req *http.Request, ctx *goproxy.ProxyCtx) {
+	f := &Flow{
+		Session:    ctx.Session,
+		ClientAddr: req.RemoteAddr,
+		StartTime:  time.Now(),
+	}
+	if isStreamingBody(req.Header) {
+		f.Request = &FlowRequest{Method: req.Method, URL: req.URL.String(), Proto: req.Proto, Header: req.Header.Clone()}
+		req.Body = s.teeBody(req.Body, func(body []byte, truncated bool) {
+			r := *f.Request
+			r.Body, r.Truncated = body, truncated
+			f.Request = &r
+		})
+	} else {
+		f.Request = s.captureRequest(req)
+	}
+	s.Add(f)
+	s.mu.Lock()
+	s.pending[ctx] = f
+	s.mu.Unlock()
+}
+
+// 补全记录的响应
+func (s *FlowStore) finish(resp *http.Response, ctx *goproxy.ProxyCtx) {
+	var fr *FlowResponse
+	streaming := resp != nil && isStreamingBody(resp.Header)
+	if streaming {
+		fr = &FlowResponse{StatusCode: resp.StatusCode, Status: resp.Status, Proto: resp.Proto, Header: resp.Header.Clone()}
+	} else if resp != nil {
+		fr = s.captureResponse(resp)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.pending[ctx]
+	if !ok {
+		return
+	}
+	delete(s.pending, ctx)
+	f.Duration = time.Since(f.StartTime)
+	f.Response = fr
+	if streaming {
+		resp.Body = s.teeBody(resp.Body, func(body []byte, truncated bool) {
+			r := *f.Response
+			r.Body, r.Truncated = body, truncated
+			f.Response = &r
+			f.Duration = time.Since(f.StartTime)
+		})
+	}
+	if ctx.Error != nil {
+		f.Error = ctx.Error.Error()
+	}
+}
+
+// 等待响应的记录 需要在finish之前获取
+func (s *FlowStore) pendingFlow(ctx *goproxy.ProxyCtx) *Flow {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pending[ctx]
+}
+
+// 向记录中追加websocket消息 payload超过记录上限时截断
+func (s *FlowStore) addMessage(f *Flow, m *FlowMessage) {
+	if int64(len(m.Payload)) > s.maxBodySize {
+		m.Payload, m.Truncated = m.Payload[:s.maxBodySize], true
+	}
+	m.Payload = append([]byte(nil), m.Payload...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f.Messages = append(f.Messages, m)
+	if len(f.Messages) > maxFlowMessages {
+		f.Messages = f.Messages[1:]
+	}
+}
+
+func (s *FlowStore) captureRequest(req *http.Request) *FlowRequest {
+	fr := &FlowRequest{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Proto:  req.Proto,
+		Header: req.Header.Clone(),
+	}
+	fr.Body, fr.Truncated, req.Body = peekBody(req.Body, s.maxBodySize)
+	return fr
+}
+
+func (s *FlowStore) captureResponse(resp *http.Response) *FlowResponse {
+	fr := &FlowResponse{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Proto:      resp.Proto,
+		Header:     resp.Header.Clone(),
+	}
+	fr.Body, fr.Truncated, resp.Body = peekBody(resp.Body, s.maxBodySize)
+	return fr
+}
+
+// 流式的body不能预先读取 在转发的同时记录经过的数据 结束时在锁内调用done
+func (s *FlowStore) teeBody(body io.ReadCloser, done func(body []byte, truncated bool)) io.ReadCloser {
+	if body == nil || body == http.NoBody {
+		return body
+	}
+	return &flowTeeBody{ReadCloser: body, store: s, done: done}
+}
+
+type flowTeeBody struct {
+	io.ReadCloser
+	store     *FlowStore
+	buf       []byte
+	truncated bool
+	once      sync.Once
+	done      func(body []byte, truncated bool)
+}
+
+func (b *flowTeeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if room := int(b.store.maxBodySize) - len(b.buf); n > room {
+		b.buf, b.truncated = append(b.buf, p[:room]...), true
+	} else {
+		b.buf = append(b.buf, p[:n]...)
+	}
+	if err != nil {
+		b.finish(err != io.EOF)
+	}
+	return n, err
+}
+
+func (b *flowTeeBody) Close() error {
+	b.finish(false)
+	return b.ReadCloser.Close()
+}
+
+func (b *flowTeeBody) finish(failed bool) {
+	b.once.Do(func() {
+		b.store.mu.Lock()
+		defer b.store.mu.Unlock()
+		b.done(b.buf, b.truncated || failed)
+	})
+}
+
+// 读取body的前limit个字节 返回读取的内容及可继续完整读取的body
+func peekBody(body io.ReadCloser, limit int64) ([]byte, bool, io.ReadCloser) {
+	if body == nil || body == http.NoBody {
+		return nil, false, body
+	}
+	buf, err := io.ReadAll(io.LimitReader(body, limit+1))
+	rest := io.MultiReader(bytes.NewReader(buf), body)
+	if err != nil {
+		rest = io.MultiReader(bytes.NewReader(buf), errReader{err})
+	}
+	truncated := int64(len(buf)) > limit
+	if truncated {
+		buf = buf[:limit]
+	}
+	return buf, truncated || err != nil, readCloser{rest, body}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
@@ -11,10 +11,15 @@
 package gproxy
 
 import (
+	"bufio"
+	"context"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"runtime"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/elazarl/goproxy"
@@ -27,6 +32,7 @@ type (
 
 var (
 	defaultAddr         = "0.0.0.0:8080"
+	defaultWriteTimeout = 10 * time.Second
 	_, callerFile, _, _ = runtime.Caller(0)
 	curDir              = path.Dir(callerFile)
 	indexHtml           = path.Join(curDir, "./html/index.html")
@@ -42,6 +48,14 @@ type ProxyServer interface {
 	GetLogger() *glogging.LogrusLogger
 	// 代理服务器实例
 	Proxy() *goproxy.ProxyHttpServer
+	// 抓包记录 未开启抓包时为nil
+	Flows() *FlowStore
+	// 解码gRPC消息使用的定义
+	Protos() *ProtoRegistry
+	// 出站连接使用的解析器 未配置DNS时为nil
+	Resolver() *Resolver
+	// 重放抓包记录中的请求 需要在启动后调用
+	Replay(id int64, opt *ReplayOptions) (*ReplayResult, error)
 }
 
 type ProxyOptions struct {
@@ -49,12 +63,67 @@ type ProxyOptions struct {
 	Addr      string
 	Logger    *glogging.LogrusLogger
 	HttpsMitm bool
+	// 开启抓包 记录经过代理的请求与响应
+	Capture bool
+	// 最多保存的抓包记录数
+	MaxFlows int
+	// 每条记录保存的请求体/响应体的最大字节数
+	MaxFlowBodySize int64
+	// MITM的连接与客户端及上游均通过ALPN协商HTTP/2
+	MitmHTTP2 bool
+	// .protoset文件 用于将gRPC消息按定义解码为json
+	ProtoSets []string
+	// 反向代理 非代理请求按路由转发到后端
+	Reverse *ReverseOptions
+	// 透明代理的监听地址 接收iptables REDIRECT/TPROXY重定向的连接
+	TransparentAddr string
+	// 使用TPROXY重定向 连接的本地地址即为原始目标地址 需要CAP_NET_ADMIN
+	TransparentTProxy bool
+	// 获取连接的原始目标地址 为空时linux上使用SO_ORIGINAL_DST
+	OriginalDst func(conn net.Conn) (*net.TCPAddr, error) `json:"-"`
+	// 通过/proxy.pac及/wpad.dat提供的PAC文件的配置 为空时只直连DefaultPACBypass
+	PAC *PACOptions
+	// 以TLS提供代理(https代理) 可要求客户端证书并将证书映射为用户
+	TLS *ProxyTLSOptions
+	// 按主机配置与上游建立TLS连接的策略 为空时与goproxy一致不验证上游的证书
+	UpstreamTLS *UpstreamTLSOptions
+	// 出站连接的域名解析 为空时使用系统解析
+	DNS *DNSOptions
+	// 出站连接的源地址、网卡及IP版本 为空时由系统选择
+	Outbound *OutboundOptions
+	// 管理接口的令牌 通过Authorization: Bearer或?token=传入 为空时管理接口只允许本机访问
+	AdminToken string
+	// 管理接口单独的监听地址 如127.0.0.1:9090 设置后代理地址不再提供管理接口
+	// 开启反向代理时代理地址面向公网 管理接口只能通过该地址访问
+	AdminAddr string
+	// 校验Proxy-Authorization中的用户名及密码 通过后用户名才作为用户用于限流、出站分组等
+	// 校验失败时返回407 为空时只有TLS代理的客户端证书能确定用户
+	Authenticate func(user, password string) bool `json:"-"`
 }
 
+type responseWriterKey struct{}
+
 type SimpleProxyServer struct {
 	ProxyOptions
 	proxy       *goproxy.ProxyHttpServer
 	middlewares []Middleware
+	flows       *FlowStore
+	protos      *ProtoRegistry
+	reverse     *reverseProxy
+	pac         atomic.Pointer[PACOptions]
+	upstreamTLS *upstreamTLS
+	// 上游TLS策略无效时不启动 否则会退回goproxy默认的不验证上游证书
+	upstreamTLSErr error
+	// 反向代理的路由无效时不启动
+	reverseErr error
+	// DNS的配置无效时不启动 否则会退回系统解析
+	resolverErr error
+	// 出站的配置无效时不启动 否则会使用系统选择的源地址
+	outboundErr error
+	resolver    *Resolver
+	outbound    *outbound
+	// 管理接口
+	admin *http.ServeMux
 }
 
 // 下载证书
@@ -86,11 +155,25 @@ func (p *SimpleProxyServer) healthHandler(w http.ResponseWriter, _ *http.Request
 // 直接使用http访问时
 // 如果不是访问下载证书的请求 则直接返回错误
 func (p *SimpleProxyServer) nonProxyHandler(w http.ResponseWriter, r *http.Request) {
+	// PAC文件 用于客户端自动配置代理
+	if pacPaths[r.URL.Path] && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		p.pacHandler(w, r)
+		return
+	}
+	// 反向代理 面向公网时不提供管理接口 /admin/同样按路由转发
+	if p.reverse != nil && p.serveReverse(w, r) {
+		return
+	}
 	p.Logger.WithFields(LogFields{
 		"url":        r.URL.String(),
 		"remoteAddr": r.RemoteAddr,
 		"headers":    r.Header,
 	}).Info("Received non-proxy request")
+	// 管理接口 设置了AdminAddr或开启反向代理时只在AdminAddr上提供
+	if strings.HasPrefix(r.URL.Path, adminPrefix) && p.AdminAddr == "" && p.reverse == nil {
+		p.serveAdmin(w, r)
+		return
+	}
 	if r.Method == http.MethodGet {
 		switch r.URL.Path {
 		case "/":
@@ -131,44 +214,342 @@ func (p *SimpleProxyServer) Proxy() *goproxy.ProxyHttpServer {
 	return p.proxy
 }
 
+func (p *SimpleProxyServer) Flows() *FlowStore {
+	return p.flows
+}
+
+func (p *SimpleProxyServer) Protos() *ProtoRegistry {
+	return p.protos
+}
+
+func (p *SimpleProxyServer) Resolver() *Resolver {
+	return p.resolver
+}
+
 // 添加中间件 对请求进行拦截操作
 func (p *SimpleProxyServer) AddMiddleware(m Middleware) {
 	p.middlewares = append(p.middlewares, m)
+	if am, ok := m.(AdminMiddleware); ok {
+		am.RegisterAdmin(p.admin)
+	}
+}
+
+// 依次执行中间件的响应勾子 抓包及gRPC消息、SSE事件的拆分在所有中间件之后
+func (p *SimpleProxyServer) filterResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	w := proxyWriter(ctx.Req)
+	// 上游出错时goproxy会对同一个响应执行两次
+	if w != nil && resp != nil && w.resp == resp {
+		return resp
+	}
+	if p.reverse != nil {
+		resp = p.reverseResponse(resp, ctx)
+	}
+	if resp == nil && ctx.Error != nil {
+		if errResp := upstreamTLSErrorResponse(ctx.Req, ctx.Error); errResp != nil {
+			resp = errResp
+		}
+	}
+	for _, m := range p.middlewares {
+		ctx.Resp = resp
+		if m.ResponseCondition(resp, ctx) {
+			resp = m.OnResponse(resp, ctx)
+		}
+	}
+	var flow *Flow
+	if p.flows != nil {
+		flow = p.flows.pendingFlow(ctx)
+		p.flows.finish(resp, ctx)
+	}
+	if resp != nil && isGRPC(resp.Header) {
+		p.filterGRPCResponse(resp, flow, ctx)
+	}
+	if resp != nil && isEventStream(resp.Header) {
+		p.filterEventStream(resp, flow, ctx)
+	}
+	if w != nil {
+		w.resp = resp
+	}
+	return resp
+}
+
+// 将ResponseWriter放入请求的context 供中间件调整写超时
+func (p *SimpleProxyServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	r, ok := p.authenticate(r)
+	if !ok {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="gproxy"`)
+		http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+		return
+	}
+	pw := &proxyResponseWriter{ResponseWriter: w}
+	ctx := context.WithValue(r.Context(), responseWriterKey{}, pw)
+	r = r.WithContext(ctx)
+	p.proxy.ServeHTTP(pw, r)
+	if r.Method == http.MethodConnect {
+		p.connectDone(r)
+	}
+	pw.writeTrailers()
+}
+
+// 使用Authenticate校验Proxy-Authorization 通过后将用户名保存到请求的context
+// 已确定用户(客户端证书、MITM的请求)或未携带Proxy-Authorization时不校验
+func (p *SimpleProxyServer) authenticate(r *http.Request) (*http.Request, bool) {
+	if p.Authenticate == nil {
+		return r, true
+	}
+	if _, ok := r.Context().Value(proxyUserKey{}).(string); ok {
+		return r, true
+	}
+	auth := &http.Request{Header: http.Header{"Authorization": r.Header.Values("Proxy-Authorization")}}
+	user, password, ok := auth.BasicAuth()
+	if !ok {
+		return r, true
+	}
+	if !p.Authenticate(user, password) {
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), proxyUserKey{}, user)), true
+}
+
+// 通知中间件CONNECT请求已处理结束
+func (p *SimpleProxyServer) connectDone(req *http.Request) {
+	for _, m := range p.middlewares {
+		if cm, ok := m.(ConnectDoneMiddleware); ok {
+			cm.ConnectDone(req)
+		}
+	}
+}
+
+// 代理请求的ResponseWriter
+// 流式响应(如gRPC、SSE)每次写入后立即flush 连接被websocket接管后丢弃goproxy写出的响应
+type proxyResponseWriter struct {
+	http.ResponseWriter
+	// 最终写给客户端的响应 body写完后将其trailer发给客户端
+	resp   *http.Response
+	stream bool
+	// 长度未知的body 写超时改为从每次写入开始计算
+	unbounded bool
+	hijacked  atomic.Bool
+}
+
+func (w *proxyResponseWriter) WriteHeader(code int) {
+	if w.hijacked.Load() {
+		return
+	}
+	w.stream = isStreamingBody(w.Header())
+	w.unbounded = w.stream || w.Header().Get("Content-Length") == ""
+	if w.unbounded {
+		// 读超时到期时会取消请求的context 使上游的流被中断
+		http.NewResponseController(w.ResponseWriter).SetReadDeadline(time.Time{})
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *proxyResponseWriter) Write(b []byte) (int, error) {
+	if w.hijacked.Load() {
+		return len(b), nil
+	}
+	if w.unbounded {
+		http.NewResponseController(w.ResponseWriter).SetWriteDeadline(time.Now().Add(defaultWriteTimeout))
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if err == nil && w.stream {
+		w.Flush()
+	}
+	return n, err
+}
+
+func (w *proxyResponseWriter) Flush() {
+	if !w.hijacked.Load() {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+func (w *proxyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.hijacked.Store(true)
+	}
+	return conn, rw, err
+}
+
+func (w *proxyResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// goproxy不会转发trailer 在handler返回前以TrailerPrefix写入
+func (w *proxyResponseWriter) writeTrailers() {
+	if w.resp == nil || w.hijacked.Load() {
+		return
+	}
+	for k, vv := range w.resp.Trailer {
+		w.Header()[http.TrailerPrefix+k] = vv
+	}
+}
+
+// 请求对应的ResponseWriter
+func proxyWriter(req *http.Request) *proxyResponseWriter {
+	if req == nil {
+		return nil
+	}
+	w, _ := req.Context().Value(responseWriterKey{}).(*proxyResponseWriter)
+	return w
+}
+
+// 请求所在的客户端连接是否已被接管
+func clientHijacked(req *http.Request) bool {
+	w := proxyWriter(req)
+	return w != nil && w.hijacked.Load()
+}
+
+// 需要边读取边转发的body 如gRPC的流、SSE及ndjson 不应被中间件缓存
+func isStreamingBody(header http.Header) bool {
+	ct := header.Get("Content-Type")
+	return strings.HasPrefix(ct, "application/grpc") || isEventStream(header) ||
+		strings.HasPrefix(ct, "application/x-ndjson")
+}
+
+// 延长请求所在连接的写超时 用于需要长时间挂起的请求
+func extendWriteDeadline(req *http.Request, d time.Duration) {
+	w, ok := req.Context().Value(responseWriterKey{}).(http.ResponseWriter)
+	if !ok {
+		return
+	}
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d + defaultWriteTimeout))
+}
+
+// 中断请求所在的客户端连接 reset为true时发送RST
+// 请求的context中没有ResponseWriter或无法接管连接时返回false
+func abortClientConn(req *http.Request, reset bool) bool {
+	w, ok := req.Context().Value(responseWriterKey{}).(http.ResponseWriter)
+	if !ok {
+		return false
+	}
+	rc := http.NewResponseController(w)
+	if !reset {
+		// 先写出已缓冲的数据
+		rc.Flush()
+	}
+	conn, _, err := rc.Hijack()
+	if err != nil {
+		return false
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok && reset {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+	return true
 }
 
 // 实例化并启动一个代理服务器
 func (p *SimpleProxyServer) ListenAndServe() {
+	if p.upstreamTLSErr != nil {
+		p.Logger.WithField("err", p.upstreamTLSErr.Error()).Error("Start Proxy Failed! Invalid Upstream TLS Policies")
+		return
+	}
+	if p.reverseErr != nil {
+		p.Logger.WithField("err", p.reverseErr.Error()).Error("Start Proxy Failed! Invalid Reverse Proxy Routes")
+		return
+	}
+	if p.resolverErr != nil {
+		p.Logger.WithField("err", p.resolverErr.Error()).Error("Start Proxy Failed! Invalid DNS Options")
+		return
+	}
+	if p.outboundErr != nil {
+		p.Logger.WithField("err", p.outboundErr.Error()).Error("Start Proxy Failed! Invalid Outbound Options")
+		return
+	}
 	proxy := goproxy.NewProxyHttpServer()
 	// 格式化goproxy库中的调试日志
 	proxy.Logger = p.Logger
 	proxy.NonproxyHandler = http.HandlerFunc(p.nonProxyHandler)
+	proxy.ConnectDialWithReq = p.connectDial
+	if p.MitmHTTP2 && proxy.Tr != nil {
+		proxy.Tr.ForceAttemptHTTP2 = true
+	}
+	if (p.resolver != nil || p.outbound != nil) && proxy.Tr != nil {
+		proxy.Tr.DialContext = p.dial
+	}
+	if p.upstreamTLS != nil && proxy.Tr != nil {
+		proxy.Tr.DialTLSContext = p.dialUpstreamTLS
+	}
 	// 调试模式
 	if p.Logger.Level.String() == "debug" {
 		proxy.Verbose = true
 	}
+	// 抓包 请求在所有中间件之前记录 响应在所有中间件之后记录
+	if p.flows != nil {
+		proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			p.flows.start(req, ctx)
+			return req, nil
+		})
+	}
+	// 源IP在中间件之前选择 中间件可在其Transport外包装RoundTripper
+	if p.outbound != nil {
+		proxy.OnRequest().DoFunc(p.selectOutbound)
+	}
 	// 加载中间件
 	for _, m := range p.middlewares {
 		proxy.OnRequest(goproxy.ReqConditionFunc(m.RequestCondition)).DoFunc(m.OnRequest)
-		proxy.OnResponse(goproxy.RespConditionFunc(m.ResponseCondition)).DoFunc(m.OnResponse)
+	}
+	// gRPC消息在所有中间件之后拆分
+	proxy.OnRequest(goproxy.ReqConditionFunc(func(req *http.Request, _ *goproxy.ProxyCtx) bool {
+		return isGRPC(req.Header)
+	})).DoFunc(p.filterGRPCRequest)
+	// websocket在所有中间件之后由gproxy转发
+	proxy.OnRequest(goproxy.ReqConditionFunc(func(req *http.Request, _ *goproxy.ProxyCtx) bool {
+		return isWebSocketUpgrade(req)
+	})).DoFunc(p.serveWebSocket)
+	// websocket接管连接后已自行处理响应
+	proxy.OnResponse(goproxy.RespConditionFunc(func(_ *http.Response, ctx *goproxy.ProxyCtx) bool {
+		return !clientHijacked(ctx.Req)
+	})).DoFunc(p.filterResponse)
+	for _, m := range p.middlewares {
+		if cm, ok := m.(ConnectMiddleware); ok {
+			proxy.OnRequest().HandleConnectFunc(cm.OnConnect)
+		}
 	}
 	// 开启对https的拦截 开启后需下载并安装证书
 	if p.HttpsMitm {
 		// 启用 HTTPS 的 MITM 拦截
-		proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+		proxy.OnRequest().HandleConnectFunc(p.mitmConnect)
 	}
-	server := &http.Server{
-		Addr:         p.Addr,
-		Handler:      proxy,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  30 * time.Second,
+	p.proxy = proxy
+	if p.reverse != nil && p.Reverse.TLSAddr != "" {
+		go p.serveReverseTLS()
+	}
+	if p.TransparentAddr != "" {
+		go p.serveTransparent()
+	}
+	if p.TLS != nil {
+		go p.serveProxyTLS()
 	}
+	if p.AdminAddr != "" {
+		go p.serveAdminAddr()
+	}
+	server := p.newProxyServer(p.Addr, http.HandlerFunc(p.serveHTTP))
 	p.Logger.Infof("Starting Proxy On %s", p.Addr)
 	if err := server.ListenAndServe(); err != nil {
 		p.Logger.WithField("err", err.Error()).Error("Start Proxy Failed!")
 	}
 }
 
+// 代理监听使用的http.Server
+func (p *SimpleProxyServer) newProxyServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: defaultWriteTimeout,
+		IdleTimeout:  30 * time.Second,
+		// CONNECT的连接被接管后清除读写超时 避免MITM中挂起的请求被超时中断
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateHijacked {
+				conn.SetDeadline(time.Time{})
+			}
+		},
+	}
+}
+
 func NewSimpleProxy(opt *ProxyOptions) ProxyServer {
 	if opt.Addr == "" {
 		opt.Addr = defaultAddr
@@ -176,5 +557,48 @@ func NewSimpleProxy(opt *ProxyOptions) ProxyServer {
 	if opt.Logger == nil {
 		opt.Logger = glogging.NewLogrusLogging(glogging.Options{}).GetLogger()
 	}
-	return ProxyServer(&SimpleProxyServer{ProxyOptions: *opt})
+	p := &SimpleProxyServer{ProxyOptions: *opt, protos: NewProtoRegistry(), admin: http.NewServeMux()}
+	if opt.Reverse != nil {
+		reverse, err := newReverseProxy(*opt.Reverse)
+		if err != nil {
+			p.Logger.WithField("err", err.Error()).Error("Invalid Reverse Proxy Routes")
+		}
+		p.reverse, p.reverseErr = reverse, err
+	}
+	if opt.DNS != nil {
+		resolver, err := NewResolver(*opt.DNS)
+		if err != nil {
+			p.Logger.WithField("err", err.Error()).Error("Invalid DNS Options")
+		}
+		p.resolver, p.resolverErr = resolver, err
+	}
+	if opt.UpstreamTLS != nil {
+		upstream, err := newUpstreamTLS(*opt.UpstreamTLS)
+		if err != nil {
+			p.Logger.WithField("err", err.Error()).Error("Invalid Upstream TLS Policies")
+		}
+		p.upstreamTLS, p.upstreamTLSErr = upstream, err
+	}
+	if opt.Outbound != nil {
+		outbound, err := newOutbound(*opt.Outbound)
+		if err != nil {
+			p.Logger.WithField("err", err.Error()).Error("Invalid Outbound Options")
+		}
+		p.outbound, p.outboundErr = outbound, err
+	}
+	if opt.PAC != nil {
+		if err := p.SetPACOptions(opt.PAC); err != nil {
+			p.Logger.WithField("err", err.Error()).Error("Invalid PAC Options")
+		}
+	}
+	for _, path := range opt.ProtoSets {
+		if err := p.protos.LoadFile(path); err != nil {
+			p.Logger.WithField("err", err.Error()).Error("Failed To Load Protoset")
+		}
+	}
+	if opt.Capture {
+		p.flows = NewFlowStore(opt.MaxFlows, opt.MaxFlowBodySize)
+	}
+	p.registerAdmin()
+	return ProxyServer(p)
 }
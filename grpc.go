@@ -0,0 +1,234 @@
+/*************************************************************************
+> File Name: grpc.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 02:31:48 星期二
+> Content: 识别gRPC调用 按长度前缀拆分消息 供中间件修改或丢弃并解码为json记录到抓包及日志中
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// 超过该大小的消息直接转发 不经过中间件
+var maxGRPCMessageSize = int64(16 << 20)
+
+// 需要处理gRPC消息的中间件可实现该接口 message为解压后的protobuf
+// method为请求路径 如/helloworld.Greeter/SayHello direction为WebSocketUpstream(请求)或WebSocketDownstream(响应)
+// 返回修改后的message drop为true时丢弃该消息
+type GRPCMiddleware interface {
+	OnGRPCMessage(method, direction string, message []byte, ctx *goproxy.ProxyCtx) ([]byte, bool)
+}
+
+// 是否为gRPC(包括二进制的gRPC-Web)的请求或响应
+func isGRPC(header http.Header) bool {
+	ct := header.Get("Content-Type")
+	for _, prefix := range []string{"application/grpc", "application/grpc-web"} {
+		if rest, ok := strings.CutPrefix(ct, prefix); ok && (rest == "" || rest[0] == '+' || rest[0] == ';') {
+			return !strings.HasPrefix(rest, "+json")
+		}
+	}
+	return false
+}
+
+// 实现了GRPCMiddleware的中间件
+func (p *SimpleProxyServer) grpcMiddlewares() []GRPCMiddleware {
+	var hooks []GRPCMiddleware
+	for _, m := range p.middlewares {
+		if gm, ok := m.(GRPCMiddleware); ok {
+			hooks = append(hooks, gm)
+		}
+	}
+	return hooks
+}
+
+// 有中间件、抓包或调试日志需要时才拆分消息
+func (p *SimpleProxyServer) interceptGRPC() bool {
+	return len(p.grpcMiddlewares()) > 0 || p.flows != nil || p.Logger.Level.String() == "debug"
+}
+
+// 在所有中间件之后拆分请求中的消息
+func (p *SimpleProxyServer) filterGRPCRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if req.Body == nil || req.Body == http.NoBody || !p.interceptGRPC() {
+		return req, nil
+	}
+	req.Body = p.grpcBody(req.Body, req.URL.Path, WebSocketUpstream, req.Header.Get("Grpc-Encoding"), ctx)
+	// 修改消息后长度会变化
+	req.ContentLength = -1
+	req.Header.Del("Content-Length")
+	return req, nil
+}
+
+// 拆分响应中的消息 flow为finish之前获取的抓包记录
+func (p *SimpleProxyServer) filterGRPCResponse(resp *http.Response, flow *Flow, ctx *goproxy.ProxyCtx) {
+	if resp.Body == nil || resp.Body == http.NoBody || !p.interceptGRPC() {
+		return
+	}
+	body := p.grpcBody(resp.Body, ctx.Req.URL.Path, WebSocketDownstream, resp.Header.Get("Grpc-Encoding"), ctx)
+	body.flow = flow
+	resp.Body = body
+}
+
+func (p *SimpleProxyServer) grpcBody(body io.ReadCloser, method, direction, encoding string, ctx *goproxy.ProxyCtx) *grpcBody {
+	b := &grpcBody{
+		ReadCloser: body,
+		p:          p,
+		ctx:        ctx,
+		hooks:      p.grpcMiddlewares(),
+		method:     method,
+		direction:  direction,
+		encoding:   encoding,
+	}
+	if p.flows != nil {
+		b.flow = p.flows.pendingFlow(ctx)
+	}
+	return b
+}
+
+// 将gRPC消息解码为json 有.protoset中的定义时按定义解码
+func (p *SimpleProxyServer) decodeGRPCMessage(method, direction string, message []byte) (json.RawMessage, error) {
+	if m := p.protos.Method(method); m != nil {
+		typeName := m.Input
+		if direction == WebSocketDownstream {
+			typeName = m.Output
+		}
+		return p.protos.Decode(typeName, message)
+	}
+	return DecodeRawProto(message)
+}
+
+// 逐条读取消息的body 每条消息经过中间件后重新编码
+type grpcBody struct {
+	io.ReadCloser
+	p         *SimpleProxyServer
+	ctx       *goproxy.ProxyCtx
+	hooks     []GRPCMiddleware
+	flow      *Flow
+	method    string
+	direction string
+	// grpc-encoding 消息的压缩标志为1时使用
+	encoding string
+	// 待返回的数据
+	buf []byte
+	err error
+	// 直接转发的剩余字节数
+	raw int64
+}
+
+func (b *grpcBody) Read(p []byte) (int, error) {
+	if b.raw > 0 {
+		if int64(len(p)) > b.raw {
+			p = p[:b.raw]
+		}
+		n, err := b.ReadCloser.Read(p)
+		b.raw -= int64(n)
+		if err == io.EOF && b.raw > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	}
+	for len(b.buf) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		b.buf, b.err = b.next()
+		if b.err == io.ErrUnexpectedEOF {
+			b.err = io.EOF
+		}
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+// 读取下一条消息 返回转发的数据 消息被丢弃时为空
+func (b *grpcBody) next() ([]byte, error) {
+	// 不完整的消息原样转发
+	header := make([]byte, 5)
+	if n, err := io.ReadFull(b.ReadCloser, header); err != nil {
+		return header[:n], err
+	}
+	flag, length := header[0], int64(binary.BigEndian.Uint32(header[1:]))
+	// gRPC-Web的trailer帧及过大的消息直接转发
+	if flag&0x80 != 0 || length > maxGRPCMessageSize {
+		if flag&0x80 == 0 {
+			b.record(&FlowMessage{Size: length, Truncated: true}, nil)
+		}
+		b.raw = length
+		return header, nil
+	}
+	data := make([]byte, length)
+	if n, err := io.ReadFull(b.ReadCloser, data); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return append(header, data[:n]...), err
+	}
+	compressed := flag&1 != 0
+	message := data
+	if compressed {
+		var err error
+		if message, err = decodeContentBytes(data, b.encoding, maxGRPCMessageSize); err != nil {
+			b.ctx.Warnf("Cannot decompress grpc message of %s: %v", b.method, err)
+			return append(header, data...), nil
+		}
+	}
+	original := message
+	for _, hook := range b.hooks {
+		var drop bool
+		if message, drop = hook.OnGRPCMessage(b.method, b.direction, message, b.ctx); drop {
+			b.record(&FlowMessage{Payload: message, Size: int64(len(message)), Dropped: true}, message)
+			return nil, nil
+		}
+	}
+	b.record(&FlowMessage{Payload: message, Size: int64(len(message))}, message)
+	if bytes.Equal(message, original) {
+		return append(header, data...), nil
+	}
+	data = message
+	if compressed {
+		var err error
+		if data, err = encodeContentBytes(message, b.encoding); err != nil {
+			return nil, err
+		}
+	}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+	return append(header, data...), nil
+}
+
+// 记录到抓包中 调试模式下输出到日志
+func (b *grpcBody) record(m *FlowMessage, message []byte) {
+	debug := b.p.Logger.Level.String() == "debug"
+	if b.flow == nil && !debug {
+		return
+	}
+	if message != nil {
+		if decoded, err := b.p.decodeGRPCMessage(b.method, b.direction, message); err == nil {
+			m.JSON = decoded
+		}
+	}
+	if debug {
+		b.p.Logger.WithFields(LogFields{
+			"method":    b.method,
+			"direction": b.direction,
+			"size":      m.Size,
+			"dropped":   m.Dropped,
+			"message":   string(m.JSON),
+		}).Debug("gRPC message")
+	}
+	if b.flow != nil {
+		m.Time = time.Now()
+		m.Direction = b.direction
+		b.p.flows.addMessage(b.flow, m)
+	}
+}
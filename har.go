@@ -0,0 +1,261 @@
+/*************************************************************************
+> File Name: har.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 01:18:05 星期二
+> Content: 将抓包记录导出为HAR 1.2 websocket消息使用Chrome的_webSocketMessages扩展字段
+*************************************************************************/
+
+package gproxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	ResourceType    string      `json:"_resourceType,omitempty"`
+	// websocket连接中的消息
+	WebSocketMessages []HARWebSocketMessage `json:"_webSocketMessages,omitempty"`
+	// gRPC调用中的消息
+	GRPCMessages []HARGRPCMessage `json:"_grpcMessages,omitempty"`
+	// SSE响应中的事件
+	EventSourceMessages []HAREventSourceMessage `json:"_eventSourceMessages,omitempty"`
+	Comment             string                  `json:"comment,omitempty"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	Cookies     []HARNameValue `json:"cookies"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []HARNameValue `json:"headers"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type HARTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type HARWebSocketMessage struct {
+	// send为客户端发出 receive为客户端收到
+	Type   string  `json:"type"`
+	Time   float64 `json:"time"`
+	Opcode int     `json:"opcode"`
+	Data   string  `json:"data"`
+}
+
+type HARGRPCMessage struct {
+	Type string  `json:"type"`
+	Time float64 `json:"time"`
+	// 解码后的json 无法解码时为base64编码的protobuf
+	Data     string `json:"data"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type HAREventSourceMessage struct {
+	Time      float64 `json:"time"`
+	EventName string  `json:"eventName,omitempty"`
+	EventID   string  `json:"eventId,omitempty"`
+	Data      string  `json:"data"`
+}
+
+// 将全部抓包记录导出为HAR
+func (s *FlowStore) HAR() *HAR {
+	flows := s.List()
+	har := &HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "gproxy", Version: "1.0"},
+		Entries: make([]HAREntry, 0, len(flows)),
+	}}
+	for _, f := range flows {
+		har.Log.Entries = append(har.Log.Entries, harEntry(f))
+	}
+	return har
+}
+
+func harEntry(f *Flow) HAREntry {
+	ms := float64(f.Duration) / float64(time.Millisecond)
+	e := HAREntry{
+		StartedDateTime: f.StartTime,
+		Time:            ms,
+		Request: HARRequest{
+			Method:      f.Request.Method,
+			URL:         f.Request.URL,
+			HTTPVersion: f.Request.Proto,
+			Headers:     harHeaders(f.Request.Header),
+			QueryString: []HARNameValue{},
+			Cookies:     []HARNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(f.Request.Body),
+		},
+		Response: HARResponse{
+			Headers:     []HARNameValue{},
+			Cookies:     []HARNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Timings: HARTimings{Send: 0, Wait: ms, Receive: 0},
+		Comment: f.Error,
+	}
+	if u, err := url.Parse(f.Request.URL); err == nil {
+		for name, values := range u.Query() {
+			for _, v := range values {
+				e.Request.QueryString = append(e.Request.QueryString, HARNameValue{Name: name, Value: v})
+			}
+		}
+	}
+	for _, c := range (&http.Request{Header: f.Request.Header}).Cookies() {
+		e.Request.Cookies = append(e.Request.Cookies, HARNameValue{Name: c.Name, Value: c.Value})
+	}
+	if len(f.Request.Body) > 0 {
+		text, encoding := harText(f.Request.Body)
+		e.Request.PostData = &HARPostData{MimeType: f.Request.Header.Get("Content-Type"), Text: text, Encoding: encoding}
+	}
+	if r := f.Response; r != nil {
+		e.Response.Status = r.StatusCode
+		e.Response.StatusText = strings.TrimSpace(strings.TrimPrefix(r.Status, strconv.Itoa(r.StatusCode)))
+		e.Response.HTTPVersion = r.Proto
+		e.Response.Headers = harHeaders(r.Header)
+		for _, c := range (&http.Response{Header: r.Header}).Cookies() {
+			e.Response.Cookies = append(e.Response.Cookies, HARNameValue{Name: c.Name, Value: c.Value})
+		}
+		e.Response.RedirectURL = r.Header.Get("Location")
+		e.Response.BodySize = len(r.Body)
+		mimeType := r.Header.Get("Content-Type")
+		if mimeType == "" {
+			mimeType = "application/octet-stream"
+		}
+		e.Response.Content = HARContent{Size: len(r.Body), MimeType: mimeType}
+		e.Response.Content.Text, e.Response.Content.Encoding = harText(r.Body)
+	}
+	websocket := isWebSocketUpgrade(&http.Request{Header: f.Request.Header})
+	if websocket {
+		e.ResourceType = "websocket"
+	}
+	for _, m := range f.Messages {
+		if m.Dropped {
+			continue
+		}
+		typ := "send"
+		if m.Direction == WebSocketDownstream {
+			typ = "receive"
+		}
+		if f.Response != nil && isEventStream(f.Response.Header) {
+			var event ServerSentEvent
+			json.Unmarshal(m.JSON, &event)
+			e.EventSourceMessages = append(e.EventSourceMessages, HAREventSourceMessage{
+				Time:      float64(m.Time.UnixNano()) / float64(time.Second),
+				EventName: event.Event,
+				EventID:   event.ID,
+				Data:      event.Data,
+			})
+			continue
+		}
+		if !websocket {
+			gm := HARGRPCMessage{Type: typ, Time: float64(m.Time.UnixNano()) / float64(time.Second), Data: string(m.JSON)}
+			if m.JSON == nil {
+				gm.Data, gm.Encoding = base64.StdEncoding.EncodeToString(m.Payload), "base64"
+			}
+			e.GRPCMessages = append(e.GRPCMessages, gm)
+			continue
+		}
+		data := string(m.Payload)
+		if m.Opcode != WebSocketText || !utf8.Valid(m.Payload) {
+			data = base64.StdEncoding.EncodeToString(m.Payload)
+		}
+		e.WebSocketMessages = append(e.WebSocketMessages, HARWebSocketMessage{
+			Type:   typ,
+			Time:   float64(m.Time.UnixNano()) / float64(time.Second),
+			Opcode: m.Opcode,
+			Data:   data,
+		})
+	}
+	return e
+}
+
+func harHeaders(header http.Header) []HARNameValue {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	headers := []HARNameValue{}
+	for _, name := range names {
+		for _, v := range header[name] {
+			headers = append(headers, HARNameValue{Name: name, Value: v})
+		}
+	}
+	return headers
+}
+
+// 文本内容直接保存 其余使用base64
+func harText(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
@@ -0,0 +1,335 @@
+/*************************************************************************
+> File Name: headers.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-19 22:15:52 星期一
+> Content: 按规则修改请求头及响应头 并添加Via、X-Forwarded-For及Forwarded
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// 规则生效的阶段
+const (
+	HeaderPhaseRequest  = "request"
+	HeaderPhaseResponse = "response"
+)
+
+// 对请求头的操作
+const (
+	// 添加一个新的值
+	HeaderAdd = "add"
+	// 替换已有的值
+	HeaderSet = "set"
+	// 删除请求头
+	HeaderRemove = "remove"
+	// 以", "拼接到已有的值之后 不存在时等同于set
+	HeaderAppend = "append"
+)
+
+// 修改请求头的规则
+type HeaderRule struct {
+	Phase  string `json:"phase"`
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	// 值支持text/template模板 可用的变量见headerVars
+	Value string `json:"value"`
+	// 匹配的域名 支持*.example.com 为空时匹配全部
+	Host string `json:"host"`
+	// 匹配url的正则 为空时匹配全部 其中的分组可在模板中通过.Match及.Groups使用
+	URL string `json:"url"`
+
+	re   *regexp.Regexp
+	tmpl *template.Template
+}
+
+func (r *HeaderRule) compile() error {
+	if r.Phase != HeaderPhaseRequest && r.Phase != HeaderPhaseResponse {
+		return fmt.Errorf("unknown header phase: %q", r.Phase)
+	}
+	switch r.Action {
+	case HeaderAdd, HeaderSet, HeaderRemove, HeaderAppend:
+	default:
+		return fmt.Errorf("unknown header action: %q", r.Action)
+	}
+	if r.Name == "" {
+		return fmt.Errorf("header name is required")
+	}
+	var err error
+	r.re = nil
+	if r.URL != "" {
+		if r.re, err = regexp.Compile(r.URL); err != nil {
+			return err
+		}
+	}
+	r.tmpl, err = template.New(r.Name).Parse(r.Value)
+	return err
+}
+
+// 规则匹配时返回url正则的分组
+func (r *HeaderRule) match(req *http.Request) ([]string, bool) {
+	if req.URL == nil || !hostMatches(r.Host, req.URL.Hostname()) {
+		return nil, false
+	}
+	if r.re == nil {
+		return nil, true
+	}
+	m := r.re.FindStringSubmatch(req.URL.String())
+	return m, m != nil
+}
+
+// 模板中可用的变量
+type headerVars struct {
+	ClientIP string
+	// 代理认证的用户名
+	User    string
+	Session int64
+	Time    time.Time
+	// unix时间戳(秒)
+	Timestamp int64
+	Method    string
+	URL       string
+	Host      string
+	Path      string
+	// 请求头
+	Header http.Header
+	// 响应的状态码 只在response阶段可用
+	StatusCode int
+	// url正则匹配的结果 .Match 0为整个url
+	Match []string
+	// url正则中命名分组匹配的结果
+	Groups map[string]string
+}
+
+type HeaderOptions struct {
+	// 在请求及响应中添加Via 值为代理的名称 为空时不添加
+	Via string `json:"via"`
+	// 在请求中追加客户端ip到X-Forwarded-For
+	XForwardedFor bool `json:"xForwardedFor"`
+	// 在请求中追加RFC 7239的Forwarded
+	Forwarded bool         `json:"forwarded"`
+	Rules     []HeaderRule `json:"rules"`
+}
+
+// 从json文件加载配置
+func LoadHeaderOptions(path string) (*HeaderOptions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	opt := &HeaderOptions{}
+	if err := json.Unmarshal(data, opt); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return opt, nil
+}
+
+// 请求头修改中间件
+type HeaderMiddleware struct {
+	mu  sync.RWMutex
+	opt HeaderOptions
+	// 请求阶段的变量 供响应阶段使用
+	vars sync.Map
+}
+
+func NewHeaderMiddleware(opt HeaderOptions) (*HeaderMiddleware, error) {
+	m := &HeaderMiddleware{opt: opt}
+	if err := m.SetRules(opt.Rules); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// 替换全部规则
+func (m *HeaderMiddleware) SetRules(rules []HeaderRule) error {
+	rules = append([]HeaderRule(nil), rules...)
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return fmt.Errorf("header rule %d: %w", i, err)
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.opt.Rules = rules
+	return nil
+}
+
+func (m *HeaderMiddleware) Options() HeaderOptions {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	opt := m.opt
+	opt.Rules = append([]HeaderRule(nil), m.opt.Rules...)
+	return opt
+}
+
+func (m *HeaderMiddleware) RequestCondition(req *http.Request, _ *goproxy.ProxyCtx) bool {
+	return req.URL != nil
+}
+
+func (m *HeaderMiddleware) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	opt := m.Options()
+	now := time.Now()
+	vars := &headerVars{
+		ClientIP:  clientIP(req),
+		User:      requestUser(req),
+		Session:   ctx.Session,
+		Time:      now,
+		Timestamp: now.Unix(),
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Host:      req.URL.Host,
+		Path:      req.URL.Path,
+		Header:    req.Header.Clone(),
+	}
+	m.vars.Store(ctx, vars)
+	if opt.Via != "" {
+		appendHeader(req.Header, "Via", viaValue(req.ProtoMajor, req.ProtoMinor, opt.Via))
+	}
+	if opt.XForwardedFor {
+		appendHeader(req.Header, "X-Forwarded-For", vars.ClientIP)
+	}
+	if opt.Forwarded {
+		appendHeader(req.Header, "Forwarded", forwardedValue(req))
+	}
+	m.apply(opt.Rules, HeaderPhaseRequest, req, req.Header, vars, ctx)
+	return req, nil
+}
+
+func (m *HeaderMiddleware) ResponseCondition(_ *http.Response, ctx *goproxy.ProxyCtx) bool {
+	_, ok := m.vars.Load(ctx)
+	return ok
+}
+
+func (m *HeaderMiddleware) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	v, _ := m.vars.LoadAndDelete(ctx)
+	if resp == nil {
+		return resp
+	}
+	opt := m.Options()
+	vars := *v.(*headerVars)
+	vars.StatusCode = resp.StatusCode
+	if opt.Via != "" {
+		appendHeader(resp.Header, "Via", viaValue(resp.ProtoMajor, resp.ProtoMinor, opt.Via))
+	}
+	m.apply(opt.Rules, HeaderPhaseResponse, ctx.Req, resp.Header, &vars, ctx)
+	return resp
+}
+
+// 依次执行阶段内匹配的规则
+func (m *HeaderMiddleware) apply(rules []HeaderRule, phase string, req *http.Request, header http.Header, vars *headerVars, ctx *goproxy.ProxyCtx) {
+	for i := range rules {
+		r := &rules[i]
+		if r.Phase != phase {
+			continue
+		}
+		match, ok := r.match(req)
+		if !ok {
+			continue
+		}
+		if r.Action == HeaderRemove {
+			header.Del(r.Name)
+			continue
+		}
+		vars.Match, vars.Groups = match, nil
+		if r.re != nil {
+			vars.Groups = make(map[string]string)
+			for j, name := range r.re.SubexpNames() {
+				if name != "" {
+					vars.Groups[name] = match[j]
+				}
+			}
+		}
+		var buf bytes.Buffer
+		if err := r.tmpl.Execute(&buf, vars); err != nil {
+			ctx.Warnf("Cannot render header %s: %v", r.Name, err)
+			continue
+		}
+		switch r.Action {
+		case HeaderAdd:
+			header.Add(r.Name, buf.String())
+		case HeaderSet:
+			header.Set(r.Name, buf.String())
+		case HeaderAppend:
+			appendHeader(header, r.Name, buf.String())
+		}
+	}
+}
+
+// 以", "拼接到已有的值之后
+func appendHeader(header http.Header, name, value string) {
+	if prev := header.Values(name); len(prev) > 0 {
+		value = strings.Join(prev, ", ") + ", " + value
+	}
+	header.Set(name, value)
+}
+
+// Via中的协议版本 HTTP/2之后只有主版本号
+func viaValue(major, minor int, name string) string {
+	switch {
+	case major == 0:
+		return "1.1 " + name
+	case major >= 2:
+		return strconv.Itoa(major) + " " + name
+	}
+	return strconv.Itoa(major) + "." + strconv.Itoa(minor) + " " + name
+}
+
+// RFC 7239 ipv6地址需要加方括号及引号
+func forwardedValue(req *http.Request) string {
+	ip := clientIP(req)
+	node := ip
+	if strings.Contains(ip, ":") && net.ParseIP(ip) != nil {
+		node = `"[` + ip + `]"`
+	}
+	value := "for=" + node
+	if host := req.Host; host != "" {
+		value += ";host=" + forwardedToken(host)
+	}
+	if req.URL != nil && req.URL.Scheme != "" {
+		value += ";proto=" + req.URL.Scheme
+	}
+	return value
+}
+
+// 含有token以外的字符时使用引号
+func forwardedToken(v string) string {
+	if strings.ContainsAny(v, `:[]"; ,=`) {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// 注册请求头修改相关的管理接口
+func (m *HeaderMiddleware) RegisterAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/headers", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, m.Options(), http.StatusOK)
+	})
+	mux.HandleFunc("PUT /admin/headers/rules", func(w http.ResponseWriter, r *http.Request) {
+		var rules []HeaderRule
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		if err := m.SetRules(rules); err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
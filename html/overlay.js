@@ -0,0 +1,15 @@
+(function (session, url) {
+    if (window.top !== window || document.getElementById("gproxy-overlay")) {
+        return;
+    }
+    var el = document.createElement("div");
+    el.id = "gproxy-overlay";
+    el.textContent = "gproxy #" + session;
+    el.title = url + "\n点击隐藏";
+    el.style.cssText = "position:fixed;right:8px;bottom:8px;z-index:2147483647;padding:2px 8px;" +
+        "font:12px/18px monospace;color:#fff;background:rgba(0,0,0,.6);border-radius:4px;cursor:pointer";
+    el.onclick = function () {
+        el.remove();
+    };
+    (document.body || document.documentElement).appendChild(el);
+})
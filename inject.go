@@ -0,0 +1,486 @@
+/*************************************************************************
+> File Name: inject.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-19 23:58:31 星期一
+> Content: 向html响应中注入代码片段 按需调整CSP及SRI 流式处理不缓存整个文档
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
+)
+
+var (
+	overlayJs = path.Join(curDir, "./html/overlay.js")
+	// 注入片段中需要添加nonce的标签
+	injectNonceTagRe = regexp.MustCompile(`(?i)<(script|style)\b`)
+	// 可能带有integrity属性的标签
+	sriTagRe       = regexp.MustCompile(`(?is)<(?:script|link)\b[^>]*>`)
+	sriAttributeRe = regexp.MustCompile(`(?is)\s+integrity\s*=\s*(?:"[^"]*"|'[^']*'|[^\s>]+)`)
+)
+
+const (
+	// 每次从上游读取的大小
+	injectReadSize = 32 << 10
+	// 保留未输出的数据 以匹配跨越两次读取的锚点
+	injectWindow = 4 << 10
+	// 标签超过该长度时不再等待标签结束
+	maxInjectPending = 1 << 20
+)
+
+// 注入的位置
+const (
+	// </head>之前
+	InjectHead = "head"
+	// </body>之前
+	InjectBody = "body"
+	// Anchor正则第一次匹配的位置
+	InjectRegex = "regex"
+)
+
+// 对CSP的处理
+const (
+	// 在script-src及style-src中添加nonce 并为注入的<script>及<style>添加该nonce
+	InjectCSPNonce = "nonce"
+	// 保持不变 注入的内联脚本可能被浏览器拒绝
+	InjectCSPKeep = "keep"
+	// 删除CSP
+	InjectCSPStrip = "strip"
+)
+
+// 注入规则
+type InjectRule struct {
+	// 匹配url的正则 为空时匹配全部
+	URL string `json:"url"`
+	// 匹配的域名 支持*.example.com 为空时匹配全部
+	Host     string `json:"host"`
+	Position string `json:"position"`
+	// Position为regex时的锚点正则
+	Anchor string `json:"anchor"`
+	// 注入到锚点之后 默认注入到锚点之前
+	After   bool   `json:"after"`
+	Snippet string `json:"snippet"`
+
+	urlRe    *regexp.Regexp
+	anchorRe *regexp.Regexp
+}
+
+func (r *InjectRule) compile() error {
+	var err error
+	switch r.Position {
+	case InjectHead:
+		r.anchorRe = regexp.MustCompile(`(?i)</head\b`)
+	case InjectBody:
+		r.anchorRe = regexp.MustCompile(`(?i)</body\b`)
+	case InjectRegex:
+		if r.Anchor == "" {
+			return fmt.Errorf("inject anchor is required")
+		}
+		if r.anchorRe, err = regexp.Compile(r.Anchor); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown inject position: %q", r.Position)
+	}
+	r.urlRe = nil
+	if r.URL != "" {
+		if r.urlRe, err = regexp.Compile(r.URL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *InjectRule) match(req *http.Request) bool {
+	if req == nil || req.URL == nil || !hostMatches(r.Host, req.URL.Hostname()) {
+		return false
+	}
+	return r.urlRe == nil || r.urlRe.MatchString(req.URL.String())
+}
+
+type InjectOptions struct {
+	Rules []InjectRule `json:"rules"`
+	// 为空时使用InjectCSPNonce
+	CSP string `json:"csp"`
+	// 删除<script>及<link>的integrity属性 使被改写的子资源可以加载
+	StripSRI bool `json:"stripSRI"`
+	// 在页面右下角显示gproxy的会话编号
+	Overlay bool `json:"overlay"`
+}
+
+// html注入中间件 https请求需要开启HttpsMitm
+type InjectMiddleware struct {
+	mu      sync.RWMutex
+	opt     InjectOptions
+	overlay string
+}
+
+func NewInjectMiddleware(opt InjectOptions) (*InjectMiddleware, error) {
+	switch opt.CSP {
+	case "":
+		opt.CSP = InjectCSPNonce
+	case InjectCSPNonce, InjectCSPKeep, InjectCSPStrip:
+	default:
+		return nil, fmt.Errorf("unknown inject csp mode: %q", opt.CSP)
+	}
+	m := &InjectMiddleware{opt: opt}
+	if opt.Overlay {
+		js, err := os.ReadFile(overlayJs)
+		if err != nil {
+			return nil, err
+		}
+		m.overlay = string(js)
+	}
+	if err := m.SetRules(opt.Rules); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// 替换全部规则
+func (m *InjectMiddleware) SetRules(rules []InjectRule) error {
+	rules = append([]InjectRule(nil), rules...)
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return fmt.Errorf("inject rule %d: %w", i, err)
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.opt.Rules = rules
+	return nil
+}
+
+func (m *InjectMiddleware) Options() InjectOptions {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	opt := m.opt
+	opt.Rules = append([]InjectRule(nil), m.opt.Rules...)
+	return opt
+}
+
+func (m *InjectMiddleware) RequestCondition(_ *http.Request, _ *goproxy.ProxyCtx) bool {
+	return false
+}
+
+func (m *InjectMiddleware) OnRequest(req *http.Request, _ *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	return req, nil
+}
+
+func (m *InjectMiddleware) ResponseCondition(resp *http.Response, ctx *goproxy.ProxyCtx) bool {
+	if resp == nil || resp.Body == nil || ctx.Req == nil || ctx.Req.Method == http.MethodHead {
+		return false
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusPartialContent {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return false
+	}
+	return supportedEncoding(resp.Header.Get("Content-Encoding"))
+}
+
+func (m *InjectMiddleware) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	opt := m.Options()
+	var points []*injectPoint
+	for i := range opt.Rules {
+		r := &opt.Rules[i]
+		if r.match(ctx.Req) {
+			points = append(points, &injectPoint{
+				re:       r.anchorRe,
+				after:    r.After,
+				fallback: r.Position != InjectRegex,
+				snippet:  []byte(r.Snippet),
+			})
+		}
+	}
+	if opt.Overlay {
+		// json编码会转义<及> 避免url中的</script>提前结束脚本
+		url, _ := json.Marshal(ctx.Req.URL.String())
+		snippet := "<script>" + m.overlay + "(" + strconv.FormatInt(ctx.Session, 10) + ", " + string(url) + ");</script>"
+		points = append(points, &injectPoint{re: regexp.MustCompile(`(?i)</body\b`), fallback: true, snippet: []byte(snippet)})
+	}
+	if len(points) == 0 && !opt.StripSRI {
+		return resp
+	}
+	dec, err := decodeContent(resp.Body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		ctx.Warnf("Cannot inject into %s: %v", ctx.Req.URL, err)
+		return resp
+	}
+	if len(points) > 0 {
+		switch opt.CSP {
+		case InjectCSPNonce:
+			nonce := injectNonce()
+			for _, name := range []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"} {
+				values := resp.Header.Values(name)
+				for i, v := range values {
+					values[i] = cspAllowNonce(v, nonce)
+				}
+			}
+			for _, p := range points {
+				p.snippet = injectNonceTagRe.ReplaceAll(p.snippet, []byte(`<$1 nonce="`+nonce+`"`))
+			}
+		case InjectCSPStrip:
+			resp.Header.Del("Content-Security-Policy")
+			resp.Header.Del("Content-Security-Policy-Report-Only")
+		}
+	}
+	br := bufio.NewReaderSize(dec, 4096)
+	src, transcoded := utf8HTMLReader(br, resp.Header, ctx.Charset())
+	if transcoded {
+		mediaType, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		params["charset"] = "utf-8"
+		resp.Header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	}
+	resp.Body = &injectReader{
+		src:      src,
+		closers:  []io.Closer{dec, resp.Body},
+		points:   points,
+		stripSRI: opt.StripSRI,
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = false
+	return resp
+}
+
+// 把body转为utf-8 返回是否进行了转换 无法确定编码时按ascii兼容处理不做转换
+func utf8HTMLReader(r *bufio.Reader, header http.Header, label string) (io.Reader, bool) {
+	var enc encoding.Encoding
+	var name string
+	if label != "" {
+		enc, name = charset.Lookup(label)
+	}
+	if enc == nil {
+		peek, _ := r.Peek(1024)
+		var certain bool
+		enc, name, certain = charset.DetermineEncoding(peek, header.Get("Content-Type"))
+		if !certain && name == "windows-1252" {
+			return r, false
+		}
+	}
+	if name == "utf-8" {
+		return r, false
+	}
+	return transform.NewReader(r, enc.NewDecoder()), true
+}
+
+// 每个响应使用不同的nonce
+func injectNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// 在CSP的脚本及样式指令中允许该nonce 一个头中的多个策略以","分隔
+func cspAllowNonce(policy, nonce string) string {
+	policies := strings.Split(policy, ",")
+	for i, p := range policies {
+		directives := strings.Split(p, ";")
+		index := make(map[string]int, len(directives))
+		for j, d := range directives {
+			if fields := strings.Fields(d); len(fields) > 0 {
+				if _, ok := index[strings.ToLower(fields[0])]; !ok {
+					index[strings.ToLower(fields[0])] = j
+				}
+			}
+		}
+		// 没有对应的指令时回退到default-src 都没有时不受限制
+		targets := make(map[int]bool)
+		for _, kind := range []string{"script", "style"} {
+			found := false
+			for _, name := range []string{kind + "-src", kind + "-src-elem"} {
+				if j, ok := index[name]; ok {
+					targets[j], found = true, true
+				}
+			}
+			if j, ok := index["default-src"]; ok && !found {
+				targets[j] = true
+			}
+		}
+		for j := range targets {
+			directives[j] = cspDirectiveAllowNonce(directives[j], nonce)
+		}
+		policies[i] = strings.Join(directives, ";")
+	}
+	return strings.Join(policies, ",")
+}
+
+func cspDirectiveAllowNonce(directive, nonce string) string {
+	fields := strings.Fields(directive)
+	source := "'nonce-" + nonce + "'"
+	indent := directive[:len(directive)-len(strings.TrimLeft(directive, " \t"))]
+	if len(fields) == 2 && strings.EqualFold(fields[1], "'none'") {
+		return indent + fields[0] + " " + source
+	}
+	unsafeInline, restricted := false, false
+	for _, f := range fields[1:] {
+		f = strings.ToLower(f)
+		switch {
+		case f == "'unsafe-inline'":
+			unsafeInline = true
+		case f == "'strict-dynamic'" || strings.HasPrefix(f, "'nonce-") || strings.HasPrefix(f, "'sha"):
+			restricted = true
+		}
+	}
+	// 出现nonce后'unsafe-inline'会失效 已允许全部内联脚本时不做修改
+	if unsafeInline && !restricted {
+		return directive
+	}
+	return indent + strings.Join(fields, " ") + " " + source
+}
+
+type injectPoint struct {
+	re    *regexp.Regexp
+	after bool
+	// 未找到锚点时插入到文档末尾
+	fallback bool
+	snippet  []byte
+}
+
+// 边读取边注入的body 只保留可能包含锚点的少量数据
+type injectReader struct {
+	src      io.Reader
+	closers  []io.Closer
+	points   []*injectPoint
+	stripSRI bool
+	buf      []byte
+	out      bytes.Buffer
+	err      error
+	done     bool
+}
+
+func (r *injectReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		if r.done {
+			return 0, r.err
+		}
+		if r.err == nil {
+			n := len(r.buf)
+			if cap(r.buf)-n < injectReadSize {
+				r.buf = append(make([]byte, 0, n+injectReadSize+injectWindow), r.buf...)
+			}
+			var m int
+			m, r.err = r.src.Read(r.buf[n : n+injectReadSize])
+			r.buf = r.buf[:n+m]
+		}
+		r.process(r.err != nil)
+	}
+	return r.out.Read(p)
+}
+
+// 输出已确定不会再匹配锚点的数据 final时输出全部数据
+func (r *injectReader) process(final bool) {
+	safe := len(r.buf)
+	if !final {
+		if safe -= injectWindow; safe <= 0 {
+			return
+		}
+		// 不在标签中间截断 避免锚点及integrity属性被分开
+		if i := bytes.LastIndexByte(r.buf[:safe], '<'); i >= 0 && bytes.IndexByte(r.buf[i:safe], '>') < 0 && len(r.buf) < maxInjectPending {
+			safe = i
+		}
+	}
+	pos := 0
+	for {
+		idx, at := r.next(pos)
+		if idx < 0 || at[0] >= safe {
+			break
+		}
+		p := r.points[idx]
+		end := at[0]
+		if p.after {
+			end = at[1]
+		}
+		r.emit(r.buf[pos:end])
+		r.out.Write(p.snippet)
+		r.points = append(r.points[:idx], r.points[idx+1:]...)
+		pos = end
+		safe = max(safe, end)
+	}
+	r.emit(r.buf[pos:safe])
+	r.buf = append(r.buf[:0], r.buf[safe:]...)
+	if final {
+		if r.err == io.EOF {
+			for _, p := range r.points {
+				if p.fallback {
+					r.out.Write(p.snippet)
+				}
+			}
+		}
+		r.points, r.done = nil, true
+	}
+}
+
+// 返回最先匹配的注入点及匹配的位置
+func (r *injectReader) next(pos int) (int, []int) {
+	idx, loc := -1, []int(nil)
+	for i, p := range r.points {
+		if at := p.re.FindIndex(r.buf[pos:]); at != nil && (loc == nil || at[0]+pos < loc[0]) {
+			idx, loc = i, []int{at[0] + pos, at[1] + pos}
+		}
+	}
+	return idx, loc
+}
+
+func (r *injectReader) emit(b []byte) {
+	if r.stripSRI {
+		b = sriTagRe.ReplaceAllFunc(b, func(tag []byte) []byte {
+			return sriAttributeRe.ReplaceAll(tag, nil)
+		})
+	}
+	r.out.Write(b)
+}
+
+func (r *injectReader) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// 注册html注入相关的管理接口
+func (m *InjectMiddleware) RegisterAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/inject", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, m.Options(), http.StatusOK)
+	})
+	mux.HandleFunc("PUT /admin/inject/rules", func(w http.ResponseWriter, r *http.Request) {
+		var rules []InjectRule
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		if err := m.SetRules(rules); err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,533 @@
+/*************************************************************************
+> File Name: jsonpatch.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-19 22:58:31 星期一
+> Content: JSON Patch(RFC 6902)及JSONPath的set/delete操作
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrJSONPatchTestFailed = errors.New("json patch test failed")
+
+// JSON Patch的操作 Op为add/remove/replace/move/copy/test
+type JSONPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// JSONPath的操作 Op为set/delete
+// Path支持$.a.b、$['a']、$.list[0]、$.list[-1]、$.list[*]、$..name
+type JSONPathOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// 解码json 数字保留为json.Number
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("invalid json: trailing data")
+	}
+	return v, nil
+}
+
+// 编码json 不转义html字符
+func encodeJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// 依次执行JSON Patch 任一操作失败时返回错误
+func applyJSONPatch(doc interface{}, ops []JSONPatchOperation) (interface{}, error) {
+	var err error
+	for i, op := range ops {
+		if doc, err = applyJSONPatchOperation(doc, op); err != nil {
+			return nil, fmt.Errorf("json patch %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+func applyJSONPatchOperation(doc interface{}, op JSONPatchOperation) (interface{}, error) {
+	path, err := parseJSONPointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case "add", "replace":
+		value, err := decodeJSON(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "add" {
+			return jsonPointerAdd(doc, path, value)
+		}
+		if _, err := jsonPointerGet(doc, path); err != nil {
+			return nil, err
+		}
+		return jsonPointerSet(doc, path, value)
+	case "remove":
+		return jsonPointerRemove(doc, path)
+	case "move", "copy":
+		from, err := parseJSONPointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := jsonPointerGet(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			return jsonPointerAdd(doc, path, deepCopyJSON(value))
+		}
+		if strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+			return nil, errors.New("cannot move a value into one of its children")
+		}
+		if doc, err = jsonPointerRemove(doc, from); err != nil {
+			return nil, err
+		}
+		return jsonPointerAdd(doc, path, value)
+	case "test":
+		value, err := decodeJSON(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		cur, err := jsonPointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(cur, value) {
+			return nil, ErrJSONPatchTestFailed
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown json patch op: %q", op.Op)
+}
+
+// 解析JSON Pointer(RFC 6901) 空字符串表示整个文档
+func parseJSONPointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if p[0] != '/' {
+		return nil, fmt.Errorf("invalid json pointer: %q", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// 数组下标 allowEnd为true时允许等于数组长度(用于插入)
+func jsonArrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') || strings.TrimLeft(token, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid array index: %q", token)
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i > length || (i == length && !allowEnd) {
+		return 0, fmt.Errorf("array index out of range: %q", token)
+	}
+	return i, nil
+}
+
+func jsonPointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch n := doc.(type) {
+		case map[string]interface{}:
+			v, ok := n[token]
+			if !ok {
+				return nil, fmt.Errorf("path not found: %q", token)
+			}
+			doc = v
+		case []interface{}:
+			i, err := jsonArrayIndex(token, len(n), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = n[i]
+		default:
+			return nil, fmt.Errorf("path not found: %q", token)
+		}
+	}
+	return doc, nil
+}
+
+// 找到path的父节点并执行f 返回新的文档
+func jsonPointerUpdate(doc interface{}, path []string, f func(parent interface{}, key string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return f(doc, path[0])
+	}
+	switch n := doc.(type) {
+	case map[string]interface{}:
+		child, ok := n[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("path not found: %q", path[0])
+		}
+		child, err := jsonPointerUpdate(child, path[1:], f)
+		if err != nil {
+			return nil, err
+		}
+		n[path[0]] = child
+		return n, nil
+	case []interface{}:
+		i, err := jsonArrayIndex(path[0], len(n), false)
+		if err != nil {
+			return nil, err
+		}
+		child, err := jsonPointerUpdate(n[i], path[1:], f)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = child
+		return n, nil
+	}
+	return nil, fmt.Errorf("path not found: %q", path[0])
+}
+
+func jsonPointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return jsonPointerUpdate(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		switch n := parent.(type) {
+		case map[string]interface{}:
+			n[key] = value
+			return n, nil
+		case []interface{}:
+			if key == "-" {
+				return append(n, value), nil
+			}
+			i, err := jsonArrayIndex(key, len(n), true)
+			if err != nil {
+				return nil, err
+			}
+			n = append(n, nil)
+			copy(n[i+1:], n[i:])
+			n[i] = value
+			return n, nil
+		}
+		return nil, fmt.Errorf("cannot add %q to a non-container value", key)
+	})
+}
+
+func jsonPointerSet(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return jsonPointerUpdate(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		switch n := parent.(type) {
+		case map[string]interface{}:
+			n[key] = value
+			return n, nil
+		case []interface{}:
+			i, err := jsonArrayIndex(key, len(n), false)
+			if err != nil {
+				return nil, err
+			}
+			n[i] = value
+			return n, nil
+		}
+		return nil, fmt.Errorf("path not found: %q", key)
+	})
+}
+
+func jsonPointerRemove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, errors.New("cannot remove the whole document")
+	}
+	return jsonPointerUpdate(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		switch n := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := n[key]; !ok {
+				return nil, fmt.Errorf("path not found: %q", key)
+			}
+			delete(n, key)
+			return n, nil
+		case []interface{}:
+			i, err := jsonArrayIndex(key, len(n), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(n[:i], n[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("path not found: %q", key)
+	})
+}
+
+func deepCopyJSON(v interface{}) interface{} {
+	switch n := v.(type) {
+	case map[string]interface{}:
+		cp := make(map[string]interface{}, len(n))
+		for k, c := range n {
+			cp[k] = deepCopyJSON(c)
+		}
+		return cp
+	case []interface{}:
+		cp := make([]interface{}, len(n))
+		for i, c := range n {
+			cp[i] = deepCopyJSON(c)
+		}
+		return cp
+	}
+	return v
+}
+
+// 比较两个json值 数字按数值比较
+func jsonEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			if w, ok := y[k]; !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if x == y {
+			return true
+		}
+		fx, err1 := x.Float64()
+		fy, err2 := y.Float64()
+		return err1 == nil && err2 == nil && fx == fy
+	}
+	return a == b
+}
+
+// JSONPath的一段
+type jsonPathSegment struct {
+	// 成员名 下标 通配符 或递归下降
+	kind  int
+	name  string
+	index int
+	// 位于递归下降之后 set只修改已存在的成员 不在每个对象中添加
+	descendant bool
+}
+
+const (
+	jsonPathMember = iota
+	jsonPathIndex
+	jsonPathWildcard
+	jsonPathRecursive
+)
+
+func parseJSONPath(p string) ([]jsonPathSegment, error) {
+	if !strings.HasPrefix(p, "$") {
+		return nil, fmt.Errorf("json path must start with $: %q", p)
+	}
+	var segs []jsonPathSegment
+	rest := p[1:]
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			segs = append(segs, jsonPathSegment{kind: jsonPathRecursive})
+			rest = rest[2:]
+			if strings.HasPrefix(rest, "[") {
+				continue
+			}
+			rest = "." + rest
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			name := rest[1 : end+1]
+			if name == "" {
+				return nil, fmt.Errorf("invalid json path: %q", p)
+			}
+			if name == "*" {
+				segs = append(segs, jsonPathSegment{kind: jsonPathWildcard})
+			} else {
+				segs = append(segs, jsonPathSegment{kind: jsonPathMember, name: name, descendant: afterRecursive(segs)})
+			}
+			rest = rest[end+1:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid json path: %q", p)
+			}
+			inner := strings.TrimSpace(rest[1:end])
+			switch {
+			case inner == "*":
+				segs = append(segs, jsonPathSegment{kind: jsonPathWildcard})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				segs = append(segs, jsonPathSegment{kind: jsonPathMember, name: inner[1 : len(inner)-1], descendant: afterRecursive(segs)})
+			default:
+				i, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("invalid json path: %q", p)
+				}
+				segs = append(segs, jsonPathSegment{kind: jsonPathIndex, index: i})
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid json path: %q", p)
+		}
+	}
+	if len(segs) > 0 && segs[len(segs)-1].kind == jsonPathRecursive {
+		return nil, fmt.Errorf("invalid json path: %q", p)
+	}
+	return segs, nil
+}
+
+func afterRecursive(segs []jsonPathSegment) bool {
+	return len(segs) > 0 && segs[len(segs)-1].kind == jsonPathRecursive
+}
+
+// 依次执行JSONPath操作
+func applyJSONPath(doc interface{}, ops []JSONPathOperation) (interface{}, error) {
+	for i, op := range ops {
+		segs, err := parseJSONPath(op.Path)
+		if err != nil {
+			return nil, err
+		}
+		var value func() interface{}
+		switch op.Op {
+		case "set":
+			v, err := decodeJSON(op.Value)
+			if err != nil {
+				return nil, fmt.Errorf("json path %d (%s %s): %w", i, op.Op, op.Path, err)
+			}
+			// 每个位置使用独立的副本
+			value = func() interface{} { return deepCopyJSON(v) }
+		case "delete":
+		default:
+			return nil, fmt.Errorf("unknown json path op: %q", op.Op)
+		}
+		if len(segs) == 0 {
+			if value == nil {
+				return nil, errors.New("cannot delete the whole document")
+			}
+			doc = value()
+			continue
+		}
+		doc = jsonPathUpdate(doc, segs, value)
+	}
+	return doc, nil
+}
+
+// 对匹配的节点执行set(value不为nil)或delete 返回新的节点
+func jsonPathUpdate(node interface{}, segs []jsonPathSegment, value func() interface{}) interface{} {
+	seg, last := segs[0], len(segs) == 1
+	switch seg.kind {
+	case jsonPathRecursive:
+		// 先处理后代节点 再在当前节点执行剩余的路径
+		switch n := node.(type) {
+		case map[string]interface{}:
+			for k, c := range n {
+				n[k] = jsonPathUpdate(c, segs, value)
+			}
+		case []interface{}:
+			for i, c := range n {
+				n[i] = jsonPathUpdate(c, segs, value)
+			}
+		}
+		return jsonPathUpdate(node, segs[1:], value)
+	case jsonPathMember:
+		n, ok := node.(map[string]interface{})
+		if !ok {
+			return node
+		}
+		child, exists := n[seg.name]
+		switch {
+		case last && value == nil:
+			delete(n, seg.name)
+		case last && (exists || !seg.descendant):
+			n[seg.name] = value()
+		case exists:
+			n[seg.name] = jsonPathUpdate(child, segs[1:], value)
+		}
+		return n
+	case jsonPathIndex:
+		n, ok := node.([]interface{})
+		if !ok {
+			return node
+		}
+		i := seg.index
+		if i < 0 {
+			i += len(n)
+		}
+		if i < 0 || i >= len(n) {
+			return node
+		}
+		switch {
+		case last && value == nil:
+			return append(n[:i], n[i+1:]...)
+		case last:
+			n[i] = value()
+		default:
+			n[i] = jsonPathUpdate(n[i], segs[1:], value)
+		}
+		return n
+	case jsonPathWildcard:
+		switch n := node.(type) {
+		case map[string]interface{}:
+			for k, c := range n {
+				switch {
+				case last && value == nil:
+					delete(n, k)
+				case last:
+					n[k] = value()
+				default:
+					n[k] = jsonPathUpdate(c, segs[1:], value)
+				}
+			}
+			return n
+		case []interface{}:
+			if last && value == nil {
+				return n[:0]
+			}
+			for i, c := range n {
+				if last {
+					n[i] = value()
+				} else {
+					n[i] = jsonPathUpdate(c, segs[1:], value)
+				}
+			}
+			return n
+		}
+	}
+	return node
+}
@@ -0,0 +1,169 @@
+/*************************************************************************
+> File Name: jsonpatch_test.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 21:32:40 星期二
+> Content: 测试JSON Patch及JSONPath的set/delete操作
+*************************************************************************/
+
+package gproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func mustDecodeJSON(t *testing.T, s string) interface{} {
+	t.Helper()
+	v, err := decodeJSON([]byte(s))
+	if err != nil {
+		t.Fatalf("decode %s: %v", s, err)
+	}
+	return v
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	cases := []struct {
+		name string
+		doc  string
+		ops  string
+		want string
+	}{
+		{"add member", `{"a":1}`, `[{"op":"add","path":"/b","value":{"c":2}}]`, `{"a":1,"b":{"c":2}}`},
+		{"add array index", `{"l":[1,3]}`, `[{"op":"add","path":"/l/1","value":2}]`, `{"l":[1,2,3]}`},
+		{"add array end", `{"l":[1]}`, `[{"op":"add","path":"/l/-","value":2}]`, `{"l":[1,2]}`},
+		{"remove", `{"a":1,"b":2}`, `[{"op":"remove","path":"/a"}]`, `{"b":2}`},
+		{"remove array", `[1,2,3]`, `[{"op":"remove","path":"/0"}]`, `[2,3]`},
+		{"replace", `{"a":{"b":1}}`, `[{"op":"replace","path":"/a/b","value":"x"}]`, `{"a":{"b":"x"}}`},
+		{"replace root", `{"a":1}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`},
+		{"move", `{"a":{"b":1},"c":{}}`, `[{"op":"move","from":"/a/b","path":"/c/d"}]`, `{"a":{},"c":{"d":1}}`},
+		{"copy", `{"a":{"b":[1]}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"add","path":"/c/b/-","value":2}]`, `{"a":{"b":[1]},"c":{"b":[1,2]}}`},
+		{"escaped pointer", `{"a/b":{"m~n":1}}`, `[{"op":"replace","path":"/a~1b/m~0n","value":2}]`, `{"a/b":{"m~n":2}}`},
+		{"test", `{"n":1.0,"o":{"x":[1,{"y":null}]}}`, `[{"op":"test","path":"/n","value":1},{"op":"test","path":"/o","value":{"x":[1,{"y":null}]}}]`, `{"n":1.0,"o":{"x":[1,{"y":null}]}}`},
+	}
+	for _, c := range cases {
+		var ops []JSONPatchOperation
+		if err := json.Unmarshal([]byte(c.ops), &ops); err != nil {
+			t.Fatal(err)
+		}
+		got, err := applyJSONPatch(mustDecodeJSON(t, c.doc), ops)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if want := mustDecodeJSON(t, c.want); !jsonEqual(got, want) {
+			b, _ := encodeJSON(got)
+			t.Errorf("%s: got %s, want %s", c.name, b, c.want)
+		}
+	}
+}
+
+func TestApplyJSONPatchErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		doc  string
+		ops  string
+	}{
+		{"replace missing", `{"a":1}`, `[{"op":"replace","path":"/b","value":1}]`},
+		{"remove missing", `{"a":1}`, `[{"op":"remove","path":"/b"}]`},
+		{"add missing parent", `{}`, `[{"op":"add","path":"/a/b","value":1}]`},
+		{"index out of range", `[1]`, `[{"op":"add","path":"/5","value":1}]`},
+		{"move into child", `{"a":{"b":1}}`, `[{"op":"move","from":"/a","path":"/a/b/c"}]`},
+		{"invalid pointer", `{}`, `[{"op":"add","path":"a","value":1}]`},
+		{"unknown op", `{}`, `[{"op":"merge","path":"/a"}]`},
+	}
+	for _, c := range cases {
+		var ops []JSONPatchOperation
+		if err := json.Unmarshal([]byte(c.ops), &ops); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := applyJSONPatch(mustDecodeJSON(t, c.doc), ops); err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+	ops := []JSONPatchOperation{{Op: "test", Path: "/a", Value: json.RawMessage(`2`)}}
+	if _, err := applyJSONPatch(mustDecodeJSON(t, `{"a":1}`), ops); !errors.Is(err, ErrJSONPatchTestFailed) {
+		t.Errorf("test: got %v, want %v", err, ErrJSONPatchTestFailed)
+	}
+}
+
+func TestApplyJSONPath(t *testing.T) {
+	cases := []struct {
+		name string
+		doc  string
+		ops  string
+		want string
+	}{
+		{"set member", `{"a":{"b":1}}`, `[{"op":"set","path":"$.a.b","value":2}]`, `{"a":{"b":2}}`},
+		{"set adds member", `{"a":{}}`, `[{"op":"set","path":"$.a.c","value":true}]`, `{"a":{"c":true}}`},
+		{"bracket member", `{"a b":1}`, `[{"op":"set","path":"$['a b']","value":2}]`, `{"a b":2}`},
+		{"negative index", `{"l":[1,2,3]}`, `[{"op":"set","path":"$.l[-1]","value":0}]`, `{"l":[1,2,0]}`},
+		{"index out of range", `{"l":[1]}`, `[{"op":"set","path":"$.l[3]","value":0}]`, `{"l":[1]}`},
+		{"wildcard", `{"l":[{"x":1},{"x":2}]}`, `[{"op":"set","path":"$.l[*].x","value":0}]`, `{"l":[{"x":0},{"x":0}]}`},
+		{"delete member", `{"a":1,"b":2}`, `[{"op":"delete","path":"$.a"}]`, `{"b":2}`},
+		{"delete index", `{"l":[1,2,3]}`, `[{"op":"delete","path":"$.l[1]"}]`, `{"l":[1,3]}`},
+		{"delete wildcard", `{"l":[1,2]}`, `[{"op":"delete","path":"$.l[*]"}]`, `{"l":[]}`},
+		{"set root", `{"a":1}`, `[{"op":"set","path":"$","value":{"b":2}}]`, `{"b":2}`},
+		// 递归下降只修改已存在的成员 不在每个对象中添加
+		{
+			"recursive set",
+			`{"price":1,"items":[{"price":2,"name":"a"},{"name":"b"}],"meta":{"x":{"price":3}}}`,
+			`[{"op":"set","path":"$..price","value":0}]`,
+			`{"price":0,"items":[{"price":0,"name":"a"},{"name":"b"}],"meta":{"x":{"price":0}}}`,
+		},
+		{
+			"recursive delete",
+			`{"token":"t","a":[{"token":"u","b":1}],"c":{"d":{"token":"v"}}}`,
+			`[{"op":"delete","path":"$..token"}]`,
+			`{"a":[{"b":1}],"c":{"d":{}}}`,
+		},
+		{
+			"recursive nested path",
+			`{"a":{"user":{"id":1}},"b":[{"user":{"name":"x"}}]}`,
+			`[{"op":"set","path":"$..user.id","value":0}]`,
+			`{"a":{"user":{"id":0}},"b":[{"user":{"name":"x","id":0}}]}`,
+		},
+	}
+	for _, c := range cases {
+		var ops []JSONPathOperation
+		if err := json.Unmarshal([]byte(c.ops), &ops); err != nil {
+			t.Fatal(err)
+		}
+		got, err := applyJSONPath(mustDecodeJSON(t, c.doc), ops)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if want := mustDecodeJSON(t, c.want); !jsonEqual(got, want) {
+			b, _ := encodeJSON(got)
+			t.Errorf("%s: got %s, want %s", c.name, b, c.want)
+		}
+	}
+}
+
+// set的值在每个位置使用独立的副本
+func TestApplyJSONPathCopiesValue(t *testing.T) {
+	ops := []JSONPathOperation{{Op: "set", Path: "$.l[*]", Value: json.RawMessage(`{"n":1}`)}}
+	got, err := applyJSONPath(mustDecodeJSON(t, `{"l":[0,0]}`), ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := got.(map[string]interface{})["l"].([]interface{})
+	l[0].(map[string]interface{})["n"] = 2
+	if n := l[1].(map[string]interface{})["n"]; n != json.Number("1") {
+		t.Errorf("shared value: got %v", n)
+	}
+}
+
+func TestParseJSONPathErrors(t *testing.T) {
+	for _, p := range []string{"a.b", "$.", "$..", "$.a[", "$.a[x]", "$a"} {
+		if _, err := parseJSONPath(p); err == nil {
+			t.Errorf("%q: expected an error", p)
+		}
+	}
+	ops := []JSONPathOperation{{Op: "delete", Path: "$"}}
+	if _, err := applyJSONPath(mustDecodeJSON(t, `{}`), ops); err == nil {
+		t.Error("delete $: expected an error")
+	}
+}
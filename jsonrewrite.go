@@ -0,0 +1,256 @@
+/*************************************************************************
+> File Name: jsonrewrite.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-19 23:34:09 星期一
+> Content: 按规则使用JSON Patch或JSONPath改写json请求体/响应体
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+)
+
+var (
+	// 超过该大小的body不改写
+	maxJSONRewriteBodySize = int64(16 << 20)
+	errBodyTooLarge        = errors.New("body too large")
+)
+
+// json改写规则 先执行Patch再执行JSONPath
+type JSONRewriteRule struct {
+	// 匹配url的正则 为空时匹配全部
+	URL string `json:"url"`
+	// 为空时匹配全部方法
+	Method string `json:"method"`
+	// 匹配的Content-Type 为空时匹配application/json及*+json
+	ContentType string `json:"contentType"`
+	// 改写请求体
+	Request bool `json:"request"`
+	// 改写响应体
+	Response bool                 `json:"response"`
+	Patch    []JSONPatchOperation `json:"patch"`
+	JSONPath []JSONPathOperation  `json:"jsonPath"`
+	re       *regexp.Regexp
+}
+
+func (r *JSONRewriteRule) compile() error {
+	if !r.Request && !r.Response {
+		return errors.New("json rewrite rule must apply to request or response")
+	}
+	if len(r.Patch) == 0 && len(r.JSONPath) == 0 {
+		return errors.New("json rewrite rule has no operation")
+	}
+	for _, op := range r.JSONPath {
+		if _, err := parseJSONPath(op.Path); err != nil {
+			return err
+		}
+	}
+	for _, op := range r.Patch {
+		if _, err := parseJSONPointer(op.Path); err != nil {
+			return err
+		}
+	}
+	r.re = nil
+	if r.URL != "" {
+		re, err := regexp.Compile(r.URL)
+		if err != nil {
+			return err
+		}
+		r.re = re
+	}
+	return nil
+}
+
+func (r *JSONRewriteRule) match(req *http.Request, header http.Header) bool {
+	if req == nil || req.URL == nil {
+		return false
+	}
+	if r.Method != "" && r.Method != req.Method {
+		return false
+	}
+	if r.re != nil && !r.re.MatchString(req.URL.String()) {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	if r.ContentType != "" {
+		return strings.EqualFold(mediaType, r.ContentType)
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// 改写解码后的json
+func (r *JSONRewriteRule) apply(doc interface{}) (interface{}, error) {
+	doc, err := applyJSONPatch(doc, r.Patch)
+	if err != nil {
+		return nil, err
+	}
+	return applyJSONPath(doc, r.JSONPath)
+}
+
+// json改写中间件 https请求需要开启HttpsMitm
+type JSONRewriteMiddleware struct {
+	mu    sync.RWMutex
+	rules []JSONRewriteRule
+}
+
+func NewJSONRewriteMiddleware(rules ...JSONRewriteRule) (*JSONRewriteMiddleware, error) {
+	m := &JSONRewriteMiddleware{}
+	if err := m.SetRules(rules); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// 替换全部规则
+func (m *JSONRewriteMiddleware) SetRules(rules []JSONRewriteRule) error {
+	rules = append([]JSONRewriteRule(nil), rules...)
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return fmt.Errorf("json rewrite rule %d: %w", i, err)
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rules = rules
+	return nil
+}
+
+func (m *JSONRewriteMiddleware) Rules() []JSONRewriteRule {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]JSONRewriteRule(nil), m.rules...)
+}
+
+// 匹配的规则
+func (m *JSONRewriteMiddleware) matched(req *http.Request, header http.Header, response bool) []*JSONRewriteRule {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var rules []*JSONRewriteRule
+	for i := range m.rules {
+		r := &m.rules[i]
+		if (response && r.Response || !response && r.Request) && r.match(req, header) {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+func (m *JSONRewriteMiddleware) RequestCondition(req *http.Request, _ *goproxy.ProxyCtx) bool {
+	return req.Body != nil && req.Body != http.NoBody && len(m.matched(req, req.Header, false)) > 0
+}
+
+func (m *JSONRewriteMiddleware) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	data, encoding, err := readEncodedBody(&req.Body, req.Header, req.ContentLength)
+	if err != nil {
+		ctx.Warnf("Cannot rewrite json request of %s: %v", req.URL, err)
+		return req, nil
+	}
+	body, err := rewriteJSON(data, m.matched(req, req.Header, false))
+	if err == nil {
+		body, err = encodeContentBytes(body, encoding)
+	}
+	if err != nil {
+		ctx.Warnf("Cannot rewrite json request of %s: %v", req.URL, err)
+		return req, nil
+	}
+	setRequestBody(req, body)
+	return req, nil
+}
+
+func (m *JSONRewriteMiddleware) ResponseCondition(resp *http.Response, ctx *goproxy.ProxyCtx) bool {
+	return resp != nil && resp.Body != nil && !isStreamingBody(resp.Header) && len(m.matched(ctx.Req, resp.Header, true)) > 0
+}
+
+func (m *JSONRewriteMiddleware) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	data, encoding, err := readEncodedBody(&resp.Body, resp.Header, resp.ContentLength)
+	if err != nil {
+		ctx.Warnf("Cannot rewrite json response of %s: %v", ctx.Req.URL, err)
+		return resp
+	}
+	body, err := rewriteJSON(data, m.matched(ctx.Req, resp.Header, true))
+	if err == nil {
+		body, err = encodeContentBytes(body, encoding)
+	}
+	if err != nil {
+		ctx.Warnf("Cannot rewrite json response of %s: %v", ctx.Req.URL, err)
+		return resp
+	}
+	setResponseBody(resp, body)
+	return resp
+}
+
+// 读取并解压body 出错时body保持可读
+func readEncodedBody(body *io.ReadCloser, header http.Header, length int64) ([]byte, string, error) {
+	encoding := header.Get("Content-Encoding")
+	if !supportedEncoding(encoding) {
+		return nil, "", fmt.Errorf("unsupported content encoding: %q", encoding)
+	}
+	if length > maxJSONRewriteBodySize {
+		return nil, "", errBodyTooLarge
+	}
+	raw, err := io.ReadAll(io.LimitReader(*body, maxJSONRewriteBodySize+1))
+	if err != nil {
+		*body = readCloser{Reader: io.MultiReader(bytes.NewReader(raw), errReader{err}), Closer: *body}
+		return nil, "", err
+	}
+	if int64(len(raw)) > maxJSONRewriteBodySize {
+		*body = readCloser{Reader: io.MultiReader(bytes.NewReader(raw), *body), Closer: *body}
+		return nil, "", errBodyTooLarge
+	}
+	(*body).Close()
+	*body = io.NopCloser(bytes.NewReader(raw))
+	data, err := decodeContentBytes(raw, encoding, maxJSONRewriteBodySize)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, encoding, nil
+}
+
+// 依次执行匹配的规则 任一规则失败时不做任何修改
+func rewriteJSON(data []byte, rules []*JSONRewriteRule) ([]byte, error) {
+	doc, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		if doc, err = r.apply(doc); err != nil {
+			return nil, err
+		}
+	}
+	return encodeJSON(doc)
+}
+
+// 注册json改写相关的管理接口
+func (m *JSONRewriteMiddleware) RegisterAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/jsonrewrite", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, m.Rules(), http.StatusOK)
+	})
+	mux.HandleFunc("PUT /admin/jsonrewrite", func(w http.ResponseWriter, r *http.Request) {
+		var rules []JSONRewriteRule
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		if err := m.SetRules(rules); err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
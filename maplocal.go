@@ -0,0 +1,230 @@
+/*************************************************************************
+> File Name: maplocal.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-19 14:26:40 星期一
+> Content: Map Local 使用本地文件或目录响应匹配的请求
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/elazarl/goproxy"
+)
+
+var defaultSidecarSuffix = ".meta.json"
+
+// 映射规则
+type MapLocalRule struct {
+	// 匹配的url(不含query) 以"/"结尾时按目录映射 url的剩余路径拼接到Path之后
+	URL string `json:"url"`
+	// 本地文件或目录
+	Path string `json:"path"`
+	// 本地文件不存在时继续请求上游 否则返回404
+	Fallthrough bool `json:"fallthrough"`
+}
+
+func (r *MapLocalRule) isDir() bool {
+	return strings.HasSuffix(r.URL, "/")
+}
+
+// 本地文件对应的描述文件 可设置响应的状态码与响应头 值支持text/template模板
+//
+//	{"status": "{{if .Query.Get \"fail\"}}500{{else}}200{{end}}", "headers": {"X-Path": "{{.Path}}"}}
+type mapLocalSidecar struct {
+	Status  string            `json:"status"`
+	Headers map[string]string `json:"headers"`
+}
+
+// 模板中可用的变量
+type mapLocalVars struct {
+	Method string
+	URL    string
+	Host   string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	File   string
+}
+
+// Map Local中间件
+type MapLocalMiddleware struct {
+	BaseMiddleware
+	// 描述文件的后缀 为空时使用.meta.json
+	SidecarSuffix string
+	mu            sync.RWMutex
+	rules         []MapLocalRule
+}
+
+func NewMapLocalMiddleware(rules ...MapLocalRule) *MapLocalMiddleware {
+	return &MapLocalMiddleware{SidecarSuffix: defaultSidecarSuffix, rules: rules}
+}
+
+func (m *MapLocalMiddleware) AddRule(rule MapLocalRule) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rules = append(m.rules, rule)
+}
+
+func (m *MapLocalMiddleware) Rules() []MapLocalRule {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]MapLocalRule(nil), m.rules...)
+}
+
+// 找到匹配请求的规则及对应的本地文件
+// MITM的请求url带有CONNECT的端口(如example.com:443) 按scheme、主机、端口(缺省时为scheme的默认端口)及路径分别比较
+func (m *MapLocalMiddleware) resolve(req *http.Request) (*MapLocalRule, string) {
+	reqPath := req.URL.Path
+	if reqPath == "" {
+		reqPath = "/"
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i := range m.rules {
+		rule := &m.rules[i]
+		ru, err := url.Parse(rule.URL)
+		if err != nil || !strings.EqualFold(ru.Scheme, req.URL.Scheme) ||
+			!strings.EqualFold(ru.Hostname(), req.URL.Hostname()) || urlPort(ru) != urlPort(req.URL) {
+			continue
+		}
+		rulePath := ru.Path
+		if rulePath == "" {
+			rulePath = "/"
+		}
+		if !rule.isDir() {
+			if reqPath == rulePath {
+				return rule, rule.Path
+			}
+			continue
+		}
+		if !strings.HasPrefix(reqPath, rulePath) {
+			continue
+		}
+		// 使用解码后的路径 清理剩余路径 防止通过../访问映射目录之外的文件
+		rest := filepath.FromSlash(path.Clean("/" + strings.TrimPrefix(reqPath, rulePath)))
+		file := filepath.Join(rule.Path, rest)
+		if info, err := os.Stat(file); err == nil && info.IsDir() {
+			file = filepath.Join(file, "index.html")
+		}
+		return rule, file
+	}
+	return nil, ""
+}
+
+func (m *MapLocalMiddleware) RequestCondition(req *http.Request, _ *goproxy.ProxyCtx) bool {
+	rule, file := m.resolve(req)
+	if rule == nil {
+		return false
+	}
+	if rule.Fallthrough {
+		info, err := os.Stat(file)
+		return err == nil && !info.IsDir()
+	}
+	return true
+}
+
+func (m *MapLocalMiddleware) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	_, file := m.resolve(req)
+	f, err := os.Open(file)
+	if err != nil {
+		ctx.Warnf("Map local %s failed: %v", req.URL, err)
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusNotFound, "Map local file not found: "+file)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusNotFound, "Map local file not found: "+file)
+	}
+	// 由ServeContent处理Content-Type、Range及条件请求
+	rec := httptest.NewRecorder()
+	status, err := m.applySidecar(rec.Header(), req, file)
+	if err != nil {
+		ctx.Warnf("Map local sidecar of %s failed: %v", file, err)
+	}
+	if status != 0 && status != http.StatusOK {
+		http.ServeContent(&statusWriter{rec, status}, req, info.Name(), info.ModTime(), f)
+	} else {
+		http.ServeContent(rec, req, info.Name(), info.ModTime(), f)
+	}
+	resp := rec.Result()
+	resp.Request = req
+	return req, resp
+}
+
+// 读取描述文件 设置响应头并返回自定义的状态码
+func (m *MapLocalMiddleware) applySidecar(header http.Header, req *http.Request, file string) (int, error) {
+	suffix := m.SidecarSuffix
+	if suffix == "" {
+		suffix = defaultSidecarSuffix
+	}
+	data, err := os.ReadFile(file + suffix)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var sidecar mapLocalSidecar
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		return 0, err
+	}
+	vars := &mapLocalVars{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Host:   req.URL.Host,
+		Path:   req.URL.Path,
+		Query:  req.URL.Query(),
+		Header: req.Header,
+		File:   file,
+	}
+	for k, v := range sidecar.Headers {
+		value, err := renderTemplate(v, vars)
+		if err != nil {
+			return 0, err
+		}
+		header.Set(k, value)
+	}
+	if sidecar.Status == "" {
+		return 0, nil
+	}
+	value, err := renderTemplate(sidecar.Status, vars)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(value))
+}
+
+func renderTemplate(text string, data interface{}) (string, error) {
+	tmpl, err := template.New("").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// 使用描述文件中的状态码替换ServeContent设置的状态码
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(int) {
+	w.ResponseWriter.WriteHeader(w.status)
+}
@@ -0,0 +1,191 @@
+/*************************************************************************
+> File Name: mapremote.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-19 15:10:23 星期一
+> Content: Map Remote 将匹配的请求转发到其它的地址
+*************************************************************************/
+
+package gproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+)
+
+var cookieDomainRegexp = regexp.MustCompile(`(?i)(;\s*domain=)[^;]*`)
+
+// 转发规则
+type MapRemoteRule struct {
+	// 匹配的源地址 如https://api.prod.example.com/v1 scheme为空时匹配http与https 未指定端口时匹配任意端口
+	From string `json:"from"`
+	// 目标地址 如http://localhost:9000 为空的部分沿用原请求
+	To string `json:"to"`
+	// 将Host请求头改为目标地址 否则保留原Host
+	RewriteHost bool `json:"rewriteHost"`
+	// 将响应中Set-Cookie的Domain改回原域名
+	RewriteCookieDomain bool `json:"rewriteCookieDomain"`
+	from, to            *url.URL
+}
+
+func (r *MapRemoteRule) compile() error {
+	from := r.From
+	if !strings.Contains(from, "://") {
+		from = "//" + from
+	}
+	var err error
+	if r.from, err = url.Parse(from); err != nil {
+		return err
+	}
+	to := r.To
+	if !strings.Contains(to, "://") {
+		to = "//" + to
+	}
+	if r.to, err = url.Parse(to); err != nil {
+		return err
+	}
+	if r.from.Host == "" {
+		return fmt.Errorf("map remote rule has no source host: %s", r.From)
+	}
+	return nil
+}
+
+func (r *MapRemoteRule) match(u *url.URL) bool {
+	if r.from.Scheme != "" && !strings.EqualFold(r.from.Scheme, u.Scheme) {
+		return false
+	}
+	if !strings.EqualFold(r.from.Hostname(), u.Hostname()) {
+		return false
+	}
+	if r.from.Port() != "" && r.from.Port() != urlPort(u) {
+		return false
+	}
+	// 按路径段匹配 /v1不匹配/v10
+	return pathHasPrefix(u.Path, r.from.Path)
+}
+
+// 按规则改写url 保留剩余的路径及query
+func (r *MapRemoteRule) rewrite(u *url.URL) *url.URL {
+	target := *u
+	if r.to.Scheme != "" {
+		target.Scheme = r.to.Scheme
+	}
+	if r.to.Host != "" {
+		target.Host = r.to.Host
+	}
+	if r.to.Path != "" || r.from.Path != "" {
+		target.Path = strings.TrimSuffix(r.to.Path, "/") + "/" + strings.TrimPrefix(strings.TrimPrefix(u.Path, r.from.Path), "/")
+		target.RawPath = ""
+	}
+	return &target
+}
+
+// url中的端口 未指定时使用scheme的默认端口
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if strings.EqualFold(u.Scheme, "https") || strings.EqualFold(u.Scheme, "wss") {
+		return "443"
+	}
+	return "80"
+}
+
+type mapRemoteState struct {
+	rule   *MapRemoteRule
+	origin *url.URL
+}
+
+// Map Remote中间件
+type MapRemoteMiddleware struct {
+	mu    sync.RWMutex
+	rules []*MapRemoteRule
+	// 被改写的请求 用于在响应中还原cookie的域名
+	states sync.Map
+}
+
+func NewMapRemoteMiddleware(rules ...MapRemoteRule) (*MapRemoteMiddleware, error) {
+	m := &MapRemoteMiddleware{}
+	for _, rule := range rules {
+		if err := m.AddRule(rule); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *MapRemoteMiddleware) AddRule(rule MapRemoteRule) error {
+	if err := rule.compile(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rules = append(m.rules, &rule)
+	return nil
+}
+
+func (m *MapRemoteMiddleware) Rules() []MapRemoteRule {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rules := make([]MapRemoteRule, 0, len(m.rules))
+	for _, r := range m.rules {
+		rules = append(rules, *r)
+	}
+	return rules
+}
+
+func (m *MapRemoteMiddleware) find(req *http.Request) *MapRemoteRule {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, r := range m.rules {
+		if r.match(req.URL) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (m *MapRemoteMiddleware) RequestCondition(req *http.Request, _ *goproxy.ProxyCtx) bool {
+	return req.URL != nil && m.find(req) != nil
+}
+
+// 直接修改传入的请求 goproxy会将最初的请求传给之后的每个中间件 返回新的请求会被后续中间件忽略
+func (m *MapRemoteMiddleware) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	rule := m.find(req)
+	origin := *req.URL
+	target := rule.rewrite(req.URL)
+	ctx.Logf("Map remote %s -> %s", origin.String(), target.String())
+	req.URL = target
+	if rule.RewriteHost {
+		req.Host = target.Host
+	} else if req.Host == "" {
+		req.Host = origin.Host
+	}
+	m.states.Store(ctx, &mapRemoteState{rule: rule, origin: &origin})
+	return req, nil
+}
+
+func (m *MapRemoteMiddleware) ResponseCondition(_ *http.Response, ctx *goproxy.ProxyCtx) bool {
+	_, ok := m.states.Load(ctx)
+	return ok
+}
+
+func (m *MapRemoteMiddleware) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	v, _ := m.states.LoadAndDelete(ctx)
+	state := v.(*mapRemoteState)
+	if resp == nil || !state.rule.RewriteCookieDomain {
+		return resp
+	}
+	domain := state.origin.Hostname()
+	cookies := resp.Header["Set-Cookie"]
+	for i, c := range cookies {
+		cookies[i] = cookieDomainRegexp.ReplaceAllString(c, "${1}"+domain)
+	}
+	return resp
+}
@@ -24,6 +24,18 @@ type Middleware interface {
 	ResponseCondition(*http.Response, *goproxy.ProxyCtx) bool
 }
 
+// 需要处理CONNECT请求的中间件可实现该接口 在开启MITM之前执行
+// 返回nil时交给后续的处理
+type ConnectMiddleware interface {
+	OnConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string)
+}
+
+// CONNECT请求处理结束(隧道已建立、被拒绝、连接失败或转为MITM)时需要清理状态的中间件可实现该接口
+// req与OnConnect中ctx.Req为同一个请求
+type ConnectDoneMiddleware interface {
+	ConnectDone(req *http.Request)
+}
+
 // 基础的中间件结构体 未对请求作任何处理
 type BaseMiddleware struct{}
 
@@ -0,0 +1,140 @@
+/*************************************************************************
+> File Name: mitm.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 00:31:14 星期二
+> Content: 解密CONNECT隧道 解密后的请求与普通的代理请求经过相同的处理流程
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// 代替goproxy.AlwaysMitm 在接管的连接上运行http.Server 请求交给serveHTTP
+// 这样MITM的请求同样支持websocket消息的拦截、写超时的调整及连接复用
+// 开启MitmHTTP2时由http.Server内置的HTTP/2实现处理 每个stream作为一个请求经过中间件
+func (p *SimpleProxyServer) mitmConnect(host string, _ *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	return &goproxy.ConnectAction{
+		Action: goproxy.ConnectHijack,
+		Hijack: func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+			p.serveMitm(host, req, client, ctx)
+		},
+	}, host
+}
+
+func (p *SimpleProxyServer) serveMitm(host string, connect *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+	// 解密后的请求各自经过中间件 CONNECT本身不再占用状态(如并发数)
+	p.connectDone(connect)
+	if _, err := client.Write([]byte("HTTP/1.0 200 OK\r\n\r\n")); err != nil {
+		client.Close()
+		return
+	}
+	// 隧道中不是TLS时(如经由CONNECT的ws://)按明文http处理
+	br := bufio.NewReader(client)
+	first, err := br.Peek(1)
+	if err != nil {
+		client.Close()
+		return
+	}
+	var conn net.Conn = &bufferedConn{Conn: client, r: br}
+	scheme := "http"
+	if first[0] == 0x16 {
+		tlsConfig, err := goproxy.TLSConfigFromCA(&goproxy.GoproxyCa)(host, ctx)
+		if err != nil {
+			ctx.Warnf("Cannot sign certificate for %s: %v", host, err)
+			client.Close()
+			return
+		}
+		tlsConfig.NextProtos = []string{"http/1.1"}
+		if p.MitmHTTP2 {
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+		conn, scheme = tls.Server(conn, tlsConfig), "https"
+	}
+	p.serveConn(proxyUserContext(connect), conn, func(r *http.Request) {
+		r.URL.Scheme = scheme
+		r.URL.Host = connect.Host
+		// 与goproxy一致 使用客户端连接代理时的地址
+		r.RemoteAddr = connect.RemoteAddr
+	})
+}
+
+// 在单个连接上运行http.Server route将请求改写为代理请求后交给serveHTTP ctx为请求context的父context
+func (p *SimpleProxyServer) serveConn(ctx context.Context, conn net.Conn, route func(r *http.Request)) {
+	l := newConnListener(conn)
+	server := &http.Server{
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route(r)
+			p.serveHTTP(w, r)
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       30 * time.Second,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateHijacked:
+				conn.SetDeadline(time.Time{})
+				l.Close()
+			case http.StateClosed:
+				l.Close()
+			}
+		},
+	}
+	server.Serve(l)
+}
+
+// 预读过数据的连接
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// 只返回一个连接的listener 连接关闭或被接管后Accept返回错误 使Serve退出
+type connListener struct {
+	mu   sync.Mutex
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, done: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
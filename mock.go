@@ -0,0 +1,332 @@
+/*************************************************************************
+> File Name: mock.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-19 16:02:37 星期一
+> Content: 录制上游响应为fixture 回放时不访问网络直接使用fixture响应
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	// 录制 请求正常发往上游 响应保存为fixture
+	MockModeRecord = "record"
+	// 回放 只使用fixture响应 不访问网络
+	MockModeReplay = "replay"
+)
+
+var (
+	maxUnmatchedRequests = 1000
+	ErrUnknownMockMode   = errors.New("unknown mock mode")
+)
+
+// 请求指纹的计算方式 method与url总是参与计算
+type FingerprintOptions struct {
+	// 参与计算的请求头
+	Headers []string `json:"headers"`
+	// 忽略url中的query
+	IgnoreQuery bool `json:"ignoreQuery"`
+	// 忽略请求体
+	IgnoreBody bool `json:"ignoreBody"`
+}
+
+type MockOptions struct {
+	Mode string
+	// 保存fixture的目录
+	Dir         string
+	Fingerprint FingerprintOptions
+	// 严格匹配时只按完整的指纹匹配
+	// 否则找不到时退化为按method及不含query的url匹配
+	Strict bool
+}
+
+// 录制的响应
+type Fixture struct {
+	Fingerprint string `json:"fingerprint"`
+	// 宽松匹配使用的指纹
+	LooseFingerprint string      `json:"looseFingerprint"`
+	Method           string      `json:"method"`
+	URL              string      `json:"url"`
+	StatusCode       int         `json:"statusCode"`
+	Header           http.Header `json:"header"`
+	Body             []byte      `json:"body"`
+	RecordedAt       time.Time   `json:"recordedAt"`
+}
+
+// 回放时未匹配到fixture的请求
+type UnmatchedRequest struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	URL         string    `json:"url"`
+	Fingerprint string    `json:"fingerprint"`
+}
+
+// 录制/回放中间件 https请求需要开启HttpsMitm
+type MockMiddleware struct {
+	opt       MockOptions
+	mu        sync.RWMutex
+	fixtures  map[string]*Fixture
+	loose     map[string]*Fixture
+	unmatched []UnmatchedRequest
+	// 录制中的请求指纹
+	recording sync.Map
+}
+
+func NewMockMiddleware(opt MockOptions) (*MockMiddleware, error) {
+	if opt.Mode != MockModeRecord && opt.Mode != MockModeReplay {
+		return nil, ErrUnknownMockMode
+	}
+	if err := os.MkdirAll(opt.Dir, 0755); err != nil {
+		return nil, err
+	}
+	m := &MockMiddleware{opt: opt}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// 重新加载目录中的fixture
+func (m *MockMiddleware) Reload() error {
+	entries, err := os.ReadDir(m.opt.Dir)
+	if err != nil {
+		return err
+	}
+	fixtures := make(map[string]*Fixture)
+	loose := make(map[string]*Fixture)
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(m.opt.Dir, e.Name()))
+		if err != nil {
+			return err
+		}
+		f := &Fixture{}
+		if err := json.Unmarshal(data, f); err != nil {
+			return errors.New(e.Name() + ": " + err.Error())
+		}
+		fixtures[f.Fingerprint] = f
+		loose[f.LooseFingerprint] = f
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fixtures, m.loose = fixtures, loose
+	return nil
+}
+
+func (m *MockMiddleware) Mode() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.opt.Mode
+}
+
+// 运行时切换录制/回放
+func (m *MockMiddleware) SetMode(mode string) error {
+	if mode != MockModeRecord && mode != MockModeReplay {
+		return ErrUnknownMockMode
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.opt.Mode = mode
+	return nil
+}
+
+// 回放时未匹配到的请求
+func (m *MockMiddleware) Unmatched() []UnmatchedRequest {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]UnmatchedRequest(nil), m.unmatched...)
+}
+
+func (m *MockMiddleware) ClearUnmatched() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unmatched = nil
+}
+
+// 计算请求的完整指纹与宽松指纹 会读取并恢复请求体
+// gRPC、SSE及ndjson等流式的请求体不参与指纹 读取会缓冲整个流并阻塞客户端的流式发送
+func (m *MockMiddleware) fingerprint(req *http.Request) (string, string) {
+	base := looseURL(req.URL)
+	loose := hashStrings(req.Method, base)
+
+	parts := []string{req.Method, base}
+	if !m.opt.Fingerprint.IgnoreQuery {
+		// Encode按key排序 参数顺序不影响指纹
+		parts = append(parts, req.URL.Query().Encode())
+	}
+	headers := append([]string(nil), m.opt.Fingerprint.Headers...)
+	sort.Strings(headers)
+	for _, h := range headers {
+		parts = append(parts, http.CanonicalHeaderKey(h)+": "+strings.Join(req.Header.Values(h), ","))
+	}
+	if !m.opt.Fingerprint.IgnoreBody && req.Body != nil && !isStreamingBody(req.Header) {
+		body, _ := io.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		parts = append(parts, hex.EncodeToString(sum[:]))
+	}
+	return hashStrings(parts...), loose
+}
+
+func hashStrings(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *MockMiddleware) RequestCondition(_ *http.Request, _ *goproxy.ProxyCtx) bool {
+	return true
+}
+
+func (m *MockMiddleware) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	full, loose := m.fingerprint(req)
+	if m.Mode() == MockModeRecord {
+		m.recording.Store(ctx, [2]string{full, loose})
+		return req, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.fixtures[full]
+	if !ok && !m.opt.Strict {
+		f, ok = m.loose[loose]
+	}
+	if !ok {
+		ctx.Warnf("No fixture matched %s %s", req.Method, req.URL)
+		m.unmatched = append(m.unmatched, UnmatchedRequest{
+			Time:        time.Now(),
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			Fingerprint: full,
+		})
+		if len(m.unmatched) > maxUnmatchedRequests {
+			m.unmatched = m.unmatched[1:]
+		}
+		resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusNotFound, "No fixture matched "+req.Method+" "+req.URL.String()+"\nfingerprint: "+full)
+		resp.Header.Set("X-Gproxy-Mock", "unmatched")
+		return req, resp
+	}
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, f.StatusCode, "")
+	resp.Status = strconv.Itoa(f.StatusCode) + " " + http.StatusText(f.StatusCode)
+	resp.Header = f.Header.Clone()
+	resp.Header.Set("X-Gproxy-Mock", "replay")
+	setResponseBody(resp, f.Body)
+	return req, resp
+}
+
+func (m *MockMiddleware) ResponseCondition(_ *http.Response, ctx *goproxy.ProxyCtx) bool {
+	_, ok := m.recording.Load(ctx)
+	return ok
+}
+
+// 保存上游的响应
+func (m *MockMiddleware) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	v, _ := m.recording.LoadAndDelete(ctx)
+	// 流式的响应不录制
+	if resp == nil || isStreamingBody(resp.Header) {
+		return resp
+	}
+	fp := v.([2]string)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	setResponseBody(resp, body)
+	if err != nil {
+		ctx.Warnf("Cannot record response of %s: %v", ctx.Req.URL, err)
+		return resp
+	}
+	f := &Fixture{
+		Fingerprint:      fp[0],
+		LooseFingerprint: fp[1],
+		Method:           ctx.Req.Method,
+		URL:              ctx.Req.URL.String(),
+		StatusCode:       resp.StatusCode,
+		Header:           resp.Header.Clone(),
+		Body:             body,
+		RecordedAt:       time.Now(),
+	}
+	if err := m.save(f); err != nil {
+		ctx.Warnf("Cannot save fixture of %s: %v", ctx.Req.URL, err)
+	}
+	return resp
+}
+
+func (m *MockMiddleware) save(f *Fixture) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(m.opt.Dir, f.Fingerprint+".json"), data, 0644); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fixtures[f.Fingerprint] = f
+	m.loose[f.LooseFingerprint] = f
+	return nil
+}
+
+// 注册录制/回放相关的管理接口
+func (m *MockMiddleware) RegisterAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/mock", func(w http.ResponseWriter, _ *http.Request) {
+		m.mu.RLock()
+		status := map[string]interface{}{
+			"mode":      m.opt.Mode,
+			"dir":       m.opt.Dir,
+			"strict":    m.opt.Strict,
+			"fixtures":  len(m.fixtures),
+			"unmatched": len(m.unmatched),
+		}
+		m.mu.RUnlock()
+		writeJSON(w, status, http.StatusOK)
+	})
+	mux.HandleFunc("PUT /admin/mock/mode", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := m.SetMode(strings.TrimSpace(string(body))); err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /admin/mock/reload", func(w http.ResponseWriter, _ *http.Request) {
+		if err := m.Reload(); err != nil {
+			writeJSONError(w, err, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /admin/mock/unmatched", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, m.Unmatched(), http.StatusOK)
+	})
+	mux.HandleFunc("DELETE /admin/mock/unmatched", func(w http.ResponseWriter, _ *http.Request) {
+		m.ClearUnmatched()
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// 宽松匹配时使用的url 不含query
+func looseURL(u *url.URL) string {
+	cp := *u
+	cp.RawQuery, cp.Fragment = "", ""
+	return cp.String()
+}
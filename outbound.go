@@ -0,0 +1,404 @@
+/*************************************************************************
+> File Name: outbound.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 07:18:33 星期二
+> Content: 出站连接的源地址及网卡 源IP池按请求轮换或按客户端、用户固定 IPv4/IPv6偏好及Happy Eyeballs
+*************************************************************************/
+
+package gproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+var (
+	ErrUnknownOutboundStrategy = errors.New("unknown outbound strategy")
+	ErrUnknownIPFamily         = errors.New("unknown ip family")
+	ErrNoOutboundAddress       = errors.New("no address matches the outbound ip family")
+	// 与Go的net.Dialer一致 首选地址族连接未完成时 延迟该时间后同时尝试另一地址族
+	defaultFallbackDelay = 300 * time.Millisecond
+)
+
+// 源IP池的选择方式
+const (
+	// 每个请求轮换 默认
+	OutboundRoundRobin = "round_robin"
+	// 随机
+	OutboundRandom = "random"
+	// 按客户端ip固定
+	OutboundByClient = "client"
+	// 按用户固定 没有用户时按客户端ip
+	OutboundByUser = "user"
+)
+
+// 目标地址的IP版本
+const (
+	IPPreferV4 = "prefer_ipv4"
+	IPPreferV6 = "prefer_ipv6"
+	IPOnlyV4   = "ipv4_only"
+	IPOnlyV6   = "ipv6_only"
+)
+
+// 为匹配的客户端或用户指定源IP
+type OutboundGroup struct {
+	// 客户端的IP或CIDR
+	Clients []string `json:"clients"`
+	// 已验证的用户 取自TLS代理的客户端证书或经Authenticate校验的Proxy-Authorization
+	Users     []string `json:"users"`
+	SourceIPs []string `json:"sourceIPs"`
+}
+
+type OutboundOptions struct {
+	// 源IP池 只有一个时为固定的源IP
+	SourceIPs []string `json:"sourceIPs"`
+	// 源IP池的选择方式 round_robin(默认)、random、client或user
+	Strategy string `json:"strategy"`
+	// 按顺序匹配 匹配的客户端或用户使用该组的源IP池
+	Groups []OutboundGroup `json:"groups"`
+	// 出站的网卡 linux上绑定到该网卡(需要CAP_NET_RAW) 未指定源IP时使用该网卡的地址
+	Interface string `json:"interface"`
+	// prefer_ipv4、prefer_ipv6、ipv4_only或ipv6_only 为空时按解析结果的顺序
+	IPFamily string `json:"ipFamily"`
+	// Happy Eyeballs中尝试另一地址族前的等待时间 默认300ms 小于0时依次尝试
+	FallbackDelay time.Duration `json:"fallbackDelay"`
+	// 连接每个地址的超时 为0时不限制
+	DialTimeout time.Duration `json:"dialTimeout"`
+}
+
+// 从json文件加载出站连接的配置
+func LoadOutboundOptions(path string) (*OutboundOptions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	opt := &OutboundOptions{}
+	if err := json.Unmarshal(data, opt); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return opt, nil
+}
+
+type outbound struct {
+	opt    OutboundOptions
+	pool   *sourcePool
+	groups []outboundGroup
+
+	mu sync.Mutex
+	// 每个源IP使用单独的Transport 避免连接池中的连接被其他源IP的请求复用
+	transports map[string]*http.Transport
+}
+
+type outboundGroup struct {
+	clients []*net.IPNet
+	users   map[string]bool
+	pool    *sourcePool
+}
+
+type sourcePool struct {
+	ips  []net.IP
+	next atomic.Uint64
+}
+
+// 保存在context中的源IP
+type sourceIPKey struct{}
+
+func newOutbound(opt OutboundOptions) (*outbound, error) {
+	switch opt.Strategy {
+	case "", OutboundRoundRobin, OutboundRandom, OutboundByClient, OutboundByUser:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownOutboundStrategy, opt.Strategy)
+	}
+	switch opt.IPFamily {
+	case "", IPPreferV4, IPPreferV6, IPOnlyV4, IPOnlyV6:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownIPFamily, opt.IPFamily)
+	}
+	if opt.Interface != "" {
+		if _, err := net.InterfaceByName(opt.Interface); err != nil {
+			return nil, fmt.Errorf("interface %s: %w", opt.Interface, err)
+		}
+	}
+	o := &outbound{opt: opt, transports: make(map[string]*http.Transport)}
+	var err error
+	if o.pool, err = newSourcePool(opt.SourceIPs); err != nil {
+		return nil, err
+	}
+	for _, g := range opt.Groups {
+		group := outboundGroup{users: make(map[string]bool)}
+		for _, c := range g.Clients {
+			n, err := parseIPNet(c)
+			if err != nil {
+				return nil, err
+			}
+			group.clients = append(group.clients, n)
+		}
+		for _, u := range g.Users {
+			group.users[u] = true
+		}
+		if group.pool, err = newSourcePool(g.SourceIPs); err != nil {
+			return nil, err
+		}
+		o.groups = append(o.groups, group)
+	}
+	return o, nil
+}
+
+func newSourcePool(addrs []string) (*sourcePool, error) {
+	pool := &sourcePool{}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source ip %q", addr)
+		}
+		pool.ips = append(pool.ips, ip)
+	}
+	return pool, nil
+}
+
+// IP或CIDR
+func parseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client ip %q", s)
+	}
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// 请求使用的源IP 没有配置源IP时返回nil
+func (o *outbound) source(req *http.Request) net.IP {
+	pool := o.pool
+	client, user := clientIP(req), requestUser(req)
+	ip := net.ParseIP(client)
+	for _, g := range o.groups {
+		if g.match(ip, user) {
+			pool = g.pool
+			break
+		}
+	}
+	if len(pool.ips) == 0 {
+		return nil
+	}
+	var key string
+	switch o.opt.Strategy {
+	case OutboundRandom:
+		return pool.ips[rand.IntN(len(pool.ips))]
+	case OutboundByClient:
+		key = client
+	case OutboundByUser:
+		key = user
+		if key == "" {
+			key = client
+		}
+	default:
+		return pool.ips[(pool.next.Add(1)-1)%uint64(len(pool.ips))]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return pool.ips[h.Sum32()%uint32(len(pool.ips))]
+}
+
+// user为已验证的用户 未经校验的Proxy-Authorization可被伪造 不参与匹配
+func (g *outboundGroup) match(ip net.IP, user string) bool {
+	if user != "" && g.users[user] {
+		return true
+	}
+	for _, n := range g.clients {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 源IP对应的Transport 由代理的Transport复制而来
+func (p *SimpleProxyServer) outboundTransport(src net.IP) *http.Transport {
+	o := p.outbound
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if tr, ok := o.transports[src.String()]; ok {
+		return tr
+	}
+	tr := p.proxy.Tr.Clone()
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return p.dial(context.WithValue(ctx, sourceIPKey{}, src), network, addr)
+	}
+	if dialTLS := p.proxy.Tr.DialTLSContext; dialTLS != nil {
+		tr.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialTLS(context.WithValue(ctx, sourceIPKey{}, src), network, addr)
+		}
+	}
+	o.transports[src.String()] = tr
+	return tr
+}
+
+// 为请求选择源IP 使用该源IP的Transport发送请求
+func (p *SimpleProxyServer) selectOutbound(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if src := p.outbound.source(req); src != nil {
+		tr := p.outboundTransport(src)
+		ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, _ *goproxy.ProxyCtx) (*http.Response, error) {
+			return tr.RoundTrip(req)
+		})
+	}
+	return req, nil
+}
+
+// 按IP版本的配置及源IP的地址族过滤并排序
+func (o *outbound) order(ips []net.IP, network string, src net.IP) []net.IP {
+	family := ""
+	if o != nil {
+		family = o.opt.IPFamily
+	}
+	var result []net.IP
+	for _, ip := range ips {
+		v4 := ip.To4() != nil
+		switch {
+		case (network == "tcp4" || family == IPOnlyV4) && !v4,
+			(network == "tcp6" || family == IPOnlyV6) && v4,
+			src != nil && (src.To4() != nil) != v4:
+			continue
+		}
+		result = append(result, ip)
+	}
+	if family == IPPreferV4 || family == IPPreferV6 {
+		sort.SliceStable(result, func(i, j int) bool {
+			return (result[i].To4() != nil) == (family == IPPreferV4) && (result[j].To4() != nil) != (family == IPPreferV4)
+		})
+	}
+	return result
+}
+
+// Happy Eyeballs 先依次连接首个地址所在地址族的地址 FallbackDelay后同时依次连接另一地址族 使用先成功的连接
+func (o *outbound) dialAddrs(ctx context.Context, network string, ips []net.IP, port string, src net.IP) (net.Conn, error) {
+	delay := defaultFallbackDelay
+	if o != nil && o.opt.FallbackDelay != 0 {
+		delay = o.opt.FallbackDelay
+	}
+	var primaries, fallbacks []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (ips[0].To4() != nil) {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+	if delay < 0 || len(fallbacks) == 0 {
+		return o.dialSerial(ctx, network, append(primaries, fallbacks...), port, src)
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, 2)
+	start := func(ips []net.IP) {
+		go func() {
+			conn, err := o.dialSerial(ctx, network, ips, port, src)
+			results <- result{conn, err}
+		}()
+	}
+	start(primaries)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	pending, fallbackStarted := 1, false
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				start(fallbacks)
+				pending, fallbackStarted = pending+1, true
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// 关闭之后成功的连接
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if !fallbackStarted {
+				start(fallbacks)
+				pending, fallbackStarted = pending+1, true
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+func (o *outbound) dialSerial(ctx context.Context, network string, ips []net.IP, port string, src net.IP) (net.Conn, error) {
+	var lastErr error
+	for _, ip := range ips {
+		d := net.Dialer{LocalAddr: o.localAddr(ip, src)}
+		if o != nil {
+			d.Timeout = o.opt.DialTimeout
+			if o.opt.Interface != "" {
+				d.Control = bindToDevice(o.opt.Interface)
+			}
+		}
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// 连接dst使用的本地地址 没有源IP时使用网卡上相同地址族的地址
+func (o *outbound) localAddr(dst, src net.IP) net.Addr {
+	if src != nil {
+		return &net.TCPAddr{IP: src}
+	}
+	if o == nil || o.opt.Interface == "" {
+		return nil
+	}
+	iface, err := net.InterfaceByName(o.opt.Interface)
+	if err != nil {
+		return nil
+	}
+	addrs, _ := iface.Addrs()
+	for _, addr := range addrs {
+		n, ok := addr.(*net.IPNet)
+		if ok && (n.IP.To4() != nil) == (dst.To4() != nil) && !n.IP.IsLinkLocalUnicast() {
+			return &net.TCPAddr{IP: n.IP}
+		}
+	}
+	return nil
+}
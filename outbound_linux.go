@@ -0,0 +1,28 @@
+//go:build linux
+
+/*************************************************************************
+> File Name: outbound_linux.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 07:36:50 星期二
+> Content: linux上通过SO_BINDTODEVICE将出站连接绑定到网卡
+*************************************************************************/
+
+package gproxy
+
+import (
+	"syscall"
+)
+
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = syscall.BindToDevice(int(fd), iface)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+/*************************************************************************
+> File Name: outbound_other.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 07:37:25 星期二
+> Content: 非linux平台不绑定网卡 只使用网卡的地址作为源地址
+*************************************************************************/
+
+package gproxy
+
+import (
+	"syscall"
+)
+
+func bindToDevice(string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
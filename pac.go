@@ -0,0 +1,231 @@
+/*************************************************************************
+> File Name: pac.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 05:06:52 星期二
+> Content: 按路由规则生成PAC文件 通过/proxy.pac及/wpad.dat提供给客户端自动配置代理
+*************************************************************************/
+
+package gproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrInvalidPACHost  = errors.New("invalid pac host pattern")
+	ErrInvalidPACProxy = errors.New("invalid pac proxy")
+	// 未配置Bypass时直连的主机
+	DefaultPACBypass = []string{"<local>", "localhost", "127.0.0.0/8", "::1", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}
+	// 提供PAC文件的路径 wpad.dat用于WPAD自动发现
+	pacPaths       = map[string]bool{"/proxy.pac": true, "/wpad.dat": true}
+	pacHostPattern = regexp.MustCompile(`^[a-z0-9._*?:-]+$`)
+	// PAC中可用的代理类型
+	pacDirectives = map[string]bool{"PROXY": true, "HTTP": true, "HTTPS": true, "SOCKS": true, "SOCKS4": true, "SOCKS5": true}
+)
+
+// 代理链中表示本代理的名称
+const PACSelf = "SELF"
+
+// 匹配Hosts的请求依次尝试Proxies中的代理
+type PACRule struct {
+	// 支持example.com(含子域名)、*.example.com、shell通配符、IP、IPv4的CIDR及<local>(不含点的主机名)
+	Hosts []string `json:"hosts"`
+	// DIRECT、PROXY host:port、HTTPS host:port、SOCKS5 host:port或SELF 只写host:port时为PROXY 为空时使用默认的代理链
+	Proxies []string `json:"proxies"`
+}
+
+type PACOptions struct {
+	// 直连的主机 格式同PACRule.Hosts 为nil时使用DefaultPACBypass
+	Bypass []string `json:"bypass"`
+	// 客户端访问本代理的地址 为空时使用请求PAC文件时的Host及代理的端口
+	ProxyAddr string `json:"proxyAddr"`
+	// 按顺序匹配 先于默认的代理链
+	Rules []PACRule `json:"rules"`
+	// 本代理不可用时依次尝试的代理 格式同PACRule.Proxies
+	Fallback []string `json:"fallback"`
+	// 所有代理均不可用时直连
+	FallbackDirect bool `json:"fallbackDirect"`
+}
+
+// 从json文件加载PAC的配置
+func LoadPACOptions(path string) (*PACOptions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	opt := &PACOptions{}
+	if err := json.Unmarshal(data, opt); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return opt, nil
+}
+
+// 生成PAC脚本 self为本代理的地址
+func (o *PACOptions) Script(self string) (string, error) {
+	var b strings.Builder
+	b.WriteString("function isIPv4(host) {\n    return /^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host);\n}\n\n")
+	b.WriteString("function FindProxyForURL(url, host) {\n    host = host.toLowerCase();\n")
+	bypass := o.Bypass
+	if bypass == nil {
+		bypass = DefaultPACBypass
+	}
+	if err := writePACRule(&b, bypass, `"DIRECT"`); err != nil {
+		return "", err
+	}
+	chain := append([]string{PACSelf}, o.Fallback...)
+	if o.FallbackDirect {
+		chain = append(chain, "DIRECT")
+	}
+	defaultProxies, err := pacProxies(chain, self)
+	if err != nil {
+		return "", err
+	}
+	for _, rule := range o.Rules {
+		proxies := defaultProxies
+		if len(rule.Proxies) > 0 {
+			if proxies, err = pacProxies(rule.Proxies, self); err != nil {
+				return "", err
+			}
+		}
+		if err := writePACRule(&b, rule.Hosts, proxies); err != nil {
+			return "", err
+		}
+	}
+	fmt.Fprintf(&b, "    return %s;\n}\n", defaultProxies)
+	return b.String(), nil
+}
+
+func writePACRule(b *strings.Builder, hosts []string, proxies string) error {
+	var conds []string
+	for _, h := range hosts {
+		cond, err := pacCondition(h)
+		if err != nil {
+			return err
+		}
+		conds = append(conds, cond)
+	}
+	switch len(conds) {
+	case 0:
+		return nil
+	case 1:
+		conds[0] = strings.TrimSuffix(strings.TrimPrefix(conds[0], "("), ")")
+	}
+	fmt.Fprintf(b, "    if (%s)\n        return %s;\n", strings.Join(conds, " ||\n        "), proxies)
+	return nil
+}
+
+// 主机的匹配条件 IPv4的CIDR只匹配IP形式的host 避免在客户端上解析域名
+func pacCondition(pattern string) (string, error) {
+	h := strings.ToLower(strings.TrimSpace(pattern))
+	switch {
+	case h == "<local>":
+		return "isPlainHostName(host)", nil
+	case strings.Contains(h, "/"):
+		_, n, err := net.ParseCIDR(h)
+		if err != nil || n.IP.To4() == nil {
+			return "", fmt.Errorf("%w: %s", ErrInvalidPACHost, pattern)
+		}
+		return fmt.Sprintf("(isIPv4(host) && isInNet(host, %q, %q))", n.IP.String(), net.IP(n.Mask).String()), nil
+	case !pacHostPattern.MatchString(h):
+		return "", fmt.Errorf("%w: %s", ErrInvalidPACHost, pattern)
+	case net.ParseIP(h) != nil:
+		return fmt.Sprintf("host == %q", h), nil
+	}
+	domain, wildcard := strings.CutPrefix(h, "*.")
+	if !wildcard {
+		domain, wildcard = strings.CutPrefix(h, ".")
+	}
+	switch {
+	case strings.ContainsAny(domain, "*?"):
+		return fmt.Sprintf("shExpMatch(host, %q)", h), nil
+	case wildcard:
+		return fmt.Sprintf("dnsDomainIs(host, %q)", "."+domain), nil
+	}
+	return fmt.Sprintf("(host == %q || dnsDomainIs(host, %q))", h, "."+h), nil
+}
+
+// 代理链 返回PAC中带引号的字符串
+func pacProxies(proxies []string, self string) (string, error) {
+	var items []string
+	for _, proxy := range proxies {
+		fields := strings.Fields(proxy)
+		switch {
+		case len(fields) == 1 && strings.EqualFold(fields[0], PACSelf):
+			fields = []string{"PROXY", self}
+		case len(fields) == 1 && strings.EqualFold(fields[0], "DIRECT"):
+			items = append(items, "DIRECT")
+			continue
+		case len(fields) == 1:
+			fields = []string{"PROXY", fields[0]}
+		}
+		if len(fields) != 2 || !pacDirectives[strings.ToUpper(fields[0])] {
+			return "", fmt.Errorf("%w: %s", ErrInvalidPACProxy, proxy)
+		}
+		if _, _, err := net.SplitHostPort(fields[1]); err != nil || strings.ContainsAny(fields[1], `"\;`) {
+			return "", fmt.Errorf("%w: %s", ErrInvalidPACProxy, proxy)
+		}
+		items = append(items, strings.ToUpper(fields[0])+" "+fields[1])
+	}
+	if len(items) == 0 {
+		return "", fmt.Errorf("%w: empty", ErrInvalidPACProxy)
+	}
+	return fmt.Sprintf("%q", strings.Join(items, "; ")), nil
+}
+
+// 当前的PAC配置
+func (p *SimpleProxyServer) pacOptions() *PACOptions {
+	if opt := p.pac.Load(); opt != nil {
+		return opt
+	}
+	return &PACOptions{}
+}
+
+// 替换PAC配置 配置无效时返回错误
+func (p *SimpleProxyServer) SetPACOptions(opt *PACOptions) error {
+	self := opt.ProxyAddr
+	if self == "" {
+		self = "127.0.0.1:8080"
+	}
+	if _, err := opt.Script(self); err != nil {
+		return err
+	}
+	p.pac.Store(opt)
+	return nil
+}
+
+// 本代理的地址 未配置时使用客户端请求PAC文件的Host
+func (p *SimpleProxyServer) pacSelf(r *http.Request, opt *PACOptions) string {
+	if opt.ProxyAddr != "" {
+		return opt.ProxyAddr
+	}
+	if _, _, err := net.SplitHostPort(r.Host); err == nil {
+		return r.Host
+	}
+	// 通过80端口(如WPAD)获取时使用代理监听的端口
+	_, port, _ := net.SplitHostPort(p.Addr)
+	return net.JoinHostPort(r.Host, port)
+}
+
+func (p *SimpleProxyServer) pacHandler(w http.ResponseWriter, r *http.Request) {
+	opt := p.pacOptions()
+	script, err := opt.Script(p.pacSelf(r, opt))
+	if err != nil {
+		p.Logger.WithField("err", err.Error()).Error("Failed To Generate PAC")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write([]byte(script))
+	}
+}
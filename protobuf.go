@@ -0,0 +1,801 @@
+/*************************************************************************
+> File Name: protobuf.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 02:06:31 星期二
+> Content: 解析protobuf的wire格式及.protoset描述文件 将消息解码为json
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	errProtoWire = errors.New("invalid protobuf wire format")
+	// 与protobuf的默认限制一致 嵌套更深的消息及group不再解码 防止耗尽栈空间
+	maxProtoDepth = 100
+)
+
+// wire type
+const (
+	protoVarint     = 0
+	protoFixed64    = 1
+	protoBytes      = 2
+	protoStartGroup = 3
+	protoEndGroup   = 4
+	protoFixed32    = 5
+)
+
+// FieldDescriptorProto中的类型与label
+const (
+	protoTypeDouble   = 1
+	protoTypeFloat    = 2
+	protoTypeInt64    = 3
+	protoTypeUint64   = 4
+	protoTypeInt32    = 5
+	protoTypeFixed64  = 6
+	protoTypeFixed32  = 7
+	protoTypeBool     = 8
+	protoTypeString   = 9
+	protoTypeGroup    = 10
+	protoTypeMessage  = 11
+	protoTypeBytes    = 12
+	protoTypeUint32   = 13
+	protoTypeEnum     = 14
+	protoTypeSfixed32 = 15
+	protoTypeSfixed64 = 16
+	protoTypeSint32   = 17
+	protoTypeSint64   = 18
+
+	protoLabelRepeated = 3
+)
+
+// 消息中的一个字段 varint及fixed类型的值在num中 其余在data中
+type protoWireField struct {
+	number int
+	wire   int
+	num    uint64
+	data   []byte
+	// group中的字段 解析时一并解析 避免每层重复解析
+	group []protoWireField
+}
+
+func consumeVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * i)
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, -1
+}
+
+// 按顺序解析消息中的全部字段
+func parseProtoWire(b []byte) ([]protoWireField, error) {
+	return parseProtoWireAt(b, 0)
+}
+
+// 解析嵌套深度为depth的消息
+func parseProtoWireAt(b []byte, depth int) ([]protoWireField, error) {
+	var fields []protoWireField
+	for len(b) > 0 {
+		f, n := consumeProtoField(b, depth)
+		if n < 0 || f.wire == protoEndGroup {
+			return nil, errProtoWire
+		}
+		fields = append(fields, f)
+		b = b[n:]
+	}
+	return fields, nil
+}
+
+// 解析一个字段 返回消耗的字节数 出错时为-1
+// group的data为其中的内容 不含结束标记 嵌套超过maxProtoDepth的group视为出错
+func consumeProtoField(b []byte, depth int) (protoWireField, int) {
+	tag, n := consumeVarint(b)
+	if n < 0 || tag>>3 == 0 || tag>>3 >= 1<<29 {
+		return protoWireField{}, -1
+	}
+	f := protoWireField{number: int(tag >> 3), wire: int(tag & 7)}
+	b = b[n:]
+	m := 0
+	switch f.wire {
+	case protoVarint:
+		f.num, m = consumeVarint(b)
+	case protoFixed64:
+		if m = 8; len(b) < m {
+			return f, -1
+		}
+		f.num = binary.LittleEndian.Uint64(b)
+	case protoFixed32:
+		if m = 4; len(b) < m {
+			return f, -1
+		}
+		f.num = uint64(binary.LittleEndian.Uint32(b))
+	case protoBytes:
+		length, l := consumeVarint(b)
+		if l < 0 || length > uint64(len(b)-l) {
+			return f, -1
+		}
+		f.data, m = b[l:l+int(length)], l+int(length)
+	case protoStartGroup:
+		if depth >= maxProtoDepth {
+			return f, -1
+		}
+		for {
+			g, k := consumeProtoField(b[m:], depth+1)
+			if k < 0 {
+				return f, -1
+			}
+			if g.wire == protoEndGroup {
+				if g.number != f.number {
+					return f, -1
+				}
+				f.data, m = b[:m], m+k
+				break
+			}
+			f.group = append(f.group, g)
+			m += k
+		}
+	case protoEndGroup:
+	default:
+		return f, -1
+	}
+	if m < 0 {
+		return f, -1
+	}
+	return f, n + m
+}
+
+// .protoset中定义的gRPC方法
+type ProtoMethod struct {
+	// 请求的路径 如/helloworld.Greeter/SayHello
+	Path            string `json:"path"`
+	Input           string `json:"input"`
+	Output          string `json:"output"`
+	ClientStreaming bool   `json:"clientStreaming"`
+	ServerStreaming bool   `json:"serverStreaming"`
+}
+
+type protoMessage struct {
+	fields   map[int]*protoField
+	mapEntry bool
+}
+
+type protoField struct {
+	jsonName string
+	repeated bool
+	typ      int
+	typeName string
+}
+
+// 从.protoset(protoc --descriptor_set_out --include_imports)加载的消息及服务定义
+type ProtoRegistry struct {
+	mu       sync.RWMutex
+	messages map[string]*protoMessage
+	enums    map[string]map[int32]string
+	methods  map[string]*ProtoMethod
+}
+
+func NewProtoRegistry() *ProtoRegistry {
+	return &ProtoRegistry{
+		messages: make(map[string]*protoMessage),
+		enums:    make(map[string]map[int32]string),
+		methods:  make(map[string]*ProtoMethod),
+	}
+}
+
+// 加载.protoset文件
+func (r *ProtoRegistry) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := r.Load(data); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// 加载序列化的FileDescriptorSet 同名的定义覆盖之前加载的
+func (r *ProtoRegistry) Load(data []byte) error {
+	set, err := parseProtoWire(data)
+	if err != nil {
+		return err
+	}
+	loaded := NewProtoRegistry()
+	for _, f := range set {
+		if f.number != 1 || f.wire != protoBytes {
+			continue
+		}
+		if err := loaded.loadFile(f.data); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, m := range loaded.messages {
+		r.messages[name] = m
+	}
+	for name, e := range loaded.enums {
+		r.enums[name] = e
+	}
+	for path, m := range loaded.methods {
+		r.methods[path] = m
+	}
+	return nil
+}
+
+// 按路径排序的全部方法
+func (r *ProtoRegistry) Methods() []*ProtoMethod {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	methods := make([]*ProtoMethod, 0, len(r.methods))
+	for _, m := range r.methods {
+		methods = append(methods, m)
+	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i].Path < methods[j].Path })
+	return methods
+}
+
+// 按请求路径查找方法 未定义时返回nil
+func (r *ProtoRegistry) Method(path string) *ProtoMethod {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.methods[path]
+}
+
+// 将typeName类型的消息解码为json 类型未定义时按wire格式解码 字段名为字段编号
+func (r *ProtoRegistry) Decode(typeName string, b []byte) (json.RawMessage, error) {
+	fields, err := parseProtoWire(b)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return json.Marshal(r.decodeMessage(strings.TrimPrefix(typeName, "."), fields, 0))
+}
+
+// 没有消息定义时按wire格式解码为json
+func DecodeRawProto(b []byte) (json.RawMessage, error) {
+	fields, err := parseProtoWire(b)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(decodeRawFields(fields, 0))
+}
+
+// 字段的字符串值
+func protoString(fields []protoWireField, number int) string {
+	var s string
+	for _, f := range fields {
+		if f.number == number && f.wire == protoBytes {
+			s = string(f.data)
+		}
+	}
+	return s
+}
+
+func protoQualify(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// FileDescriptorProto
+func (r *ProtoRegistry) loadFile(data []byte) error {
+	fields, err := parseProtoWire(data)
+	if err != nil {
+		return err
+	}
+	pkg := protoString(fields, 2)
+	for _, f := range fields {
+		if f.wire != protoBytes {
+			continue
+		}
+		switch f.number {
+		case 4:
+			err = r.loadMessage(pkg, f.data)
+		case 5:
+			err = r.loadEnum(pkg, f.data)
+		case 6:
+			err = r.loadService(pkg, f.data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DescriptorProto 嵌套的类型同样加载
+func (r *ProtoRegistry) loadMessage(prefix string, data []byte) error {
+	fields, err := parseProtoWire(data)
+	if err != nil {
+		return err
+	}
+	name := protoQualify(prefix, protoString(fields, 1))
+	m := &protoMessage{fields: make(map[int]*protoField)}
+	for _, f := range fields {
+		if f.wire != protoBytes {
+			continue
+		}
+		switch f.number {
+		case 2:
+			err = m.loadField(f.data)
+		case 3:
+			err = r.loadMessage(name, f.data)
+		case 4:
+			err = r.loadEnum(name, f.data)
+		case 7:
+			var options []protoWireField
+			options, err = parseProtoWire(f.data)
+			for _, o := range options {
+				if o.number == 7 && o.wire == protoVarint {
+					m.mapEntry = o.num != 0
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	r.messages[name] = m
+	return nil
+}
+
+// FieldDescriptorProto
+func (m *protoMessage) loadField(data []byte) error {
+	fields, err := parseProtoWire(data)
+	if err != nil {
+		return err
+	}
+	var (
+		name   string
+		number int
+		field  = &protoField{}
+	)
+	for _, f := range fields {
+		switch {
+		case f.number == 1 && f.wire == protoBytes:
+			name = string(f.data)
+		case f.number == 3 && f.wire == protoVarint:
+			number = int(f.num)
+		case f.number == 4 && f.wire == protoVarint:
+			field.repeated = f.num == protoLabelRepeated
+		case f.number == 5 && f.wire == protoVarint:
+			field.typ = int(f.num)
+		case f.number == 6 && f.wire == protoBytes:
+			field.typeName = strings.TrimPrefix(string(f.data), ".")
+		case f.number == 10 && f.wire == protoBytes:
+			field.jsonName = string(f.data)
+		}
+	}
+	if field.jsonName == "" {
+		field.jsonName = protoJSONName(name)
+	}
+	m.fields[number] = field
+	return nil
+}
+
+// EnumDescriptorProto
+func (r *ProtoRegistry) loadEnum(prefix string, data []byte) error {
+	fields, err := parseProtoWire(data)
+	if err != nil {
+		return err
+	}
+	values := make(map[int32]string)
+	for _, f := range fields {
+		if f.number != 2 || f.wire != protoBytes {
+			continue
+		}
+		value, err := parseProtoWire(f.data)
+		if err != nil {
+			return err
+		}
+		for _, v := range value {
+			if v.number == 2 && v.wire == protoVarint {
+				values[int32(v.num)] = protoString(value, 1)
+			}
+		}
+	}
+	r.enums[protoQualify(prefix, protoString(fields, 1))] = values
+	return nil
+}
+
+// ServiceDescriptorProto
+func (r *ProtoRegistry) loadService(prefix string, data []byte) error {
+	fields, err := parseProtoWire(data)
+	if err != nil {
+		return err
+	}
+	service := protoQualify(prefix, protoString(fields, 1))
+	for _, f := range fields {
+		if f.number != 2 || f.wire != protoBytes {
+			continue
+		}
+		method, err := parseProtoWire(f.data)
+		if err != nil {
+			return err
+		}
+		m := &ProtoMethod{
+			Path:   "/" + service + "/" + protoString(method, 1),
+			Input:  strings.TrimPrefix(protoString(method, 2), "."),
+			Output: strings.TrimPrefix(protoString(method, 3), "."),
+		}
+		for _, v := range method {
+			if v.wire == protoVarint && v.number == 5 {
+				m.ClientStreaming = v.num != 0
+			} else if v.wire == protoVarint && v.number == 6 {
+				m.ServerStreaming = v.num != 0
+			}
+		}
+		r.methods[m.Path] = m
+	}
+	return nil
+}
+
+// 与protoc生成json_name的规则一致 去掉下划线并将其后的字母大写
+func protoJSONName(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, c := range name {
+		if c == '_' {
+			upper = true
+			continue
+		}
+		if upper && 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		upper = false
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// 保持字段顺序的json对象
+type protoJSONObject struct {
+	keys   []string
+	values map[string]any
+}
+
+func newProtoJSONObject() *protoJSONObject {
+	return &protoJSONObject{values: make(map[string]any)}
+}
+
+func (o *protoJSONObject) set(key string, v any) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = v
+}
+
+// repeated字段
+func (o *protoJSONObject) push(key string, v any) {
+	list, _ := o.values[key].([]any)
+	o.set(key, append(list, v))
+}
+
+// 没有定义的字段 重复出现时转为数组
+func (o *protoJSONObject) add(key string, v any) {
+	switch old := o.values[key].(type) {
+	case nil:
+		o.set(key, v)
+	case []any:
+		o.set(key, append(old, v))
+	default:
+		o.set(key, []any{old, v})
+	}
+}
+
+func (o *protoJSONObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// 按消息定义解码 常用的well-known类型使用proto3 json的表示
+func (r *ProtoRegistry) decodeMessage(typeName string, fields []protoWireField, depth int) any {
+	m := r.messages[typeName]
+	if m == nil {
+		return decodeRawFields(fields, depth)
+	}
+	switch typeName {
+	case "google.protobuf.Timestamp", "google.protobuf.Duration":
+		var seconds, nanos int64
+		for _, f := range fields {
+			if f.number == 1 && f.wire == protoVarint {
+				seconds = int64(f.num)
+			} else if f.number == 2 && f.wire == protoVarint {
+				nanos = int64(int32(f.num))
+			}
+		}
+		if typeName == "google.protobuf.Timestamp" {
+			return time.Unix(seconds, nanos).UTC().Format(time.RFC3339Nano)
+		}
+		return protoDuration(seconds, nanos)
+	}
+	obj := newProtoJSONObject()
+	for _, f := range fields {
+		field := m.fields[f.number]
+		if field == nil {
+			obj.add(strconv.Itoa(f.number), decodeRawValue(f, depth))
+			continue
+		}
+		if entry := r.messages[field.typeName]; entry != nil && entry.mapEntry && f.wire == protoBytes {
+			r.decodeMapEntry(obj, field, entry, f.data, depth)
+			continue
+		}
+		// packed编码的repeated数值
+		if field.repeated && f.wire == protoBytes && protoWireType(field.typ) != protoBytes {
+			values, ok := r.decodePacked(field, f.data, depth)
+			if !ok {
+				obj.add(strconv.Itoa(f.number), decodeRawValue(f, depth))
+				continue
+			}
+			for _, v := range values {
+				obj.push(field.jsonName, v)
+			}
+			continue
+		}
+		if protoWireType(field.typ) != f.wire {
+			obj.add(strconv.Itoa(f.number), decodeRawValue(f, depth))
+			continue
+		}
+		v := r.decodeValue(field, f, depth)
+		if field.repeated {
+			obj.push(field.jsonName, v)
+		} else {
+			obj.set(field.jsonName, v)
+		}
+	}
+	if strings.HasPrefix(typeName, "google.protobuf.") && strings.HasSuffix(typeName, "Value") && typeName != "google.protobuf.Value" {
+		// wrapper类型直接使用其value
+		if field := m.fields[1]; field != nil && len(m.fields) == 1 {
+			if v, ok := obj.values[field.jsonName]; ok {
+				return v
+			}
+			return protoZero(field.typ)
+		}
+	}
+	return obj
+}
+
+// map字段的一个条目
+func (r *ProtoRegistry) decodeMapEntry(obj *protoJSONObject, field *protoField, entry *protoMessage, data []byte, depth int) {
+	err := errProtoWire
+	var fields []protoWireField
+	if depth < maxProtoDepth {
+		fields, err = parseProtoWireAt(data, depth+1)
+	}
+	if err != nil {
+		obj.add(field.jsonName, base64.StdEncoding.EncodeToString(data))
+		return
+	}
+	m, _ := obj.values[field.jsonName].(*protoJSONObject)
+	if m == nil {
+		m = newProtoJSONObject()
+		obj.set(field.jsonName, m)
+	}
+	var key, value any
+	if kf := entry.fields[1]; kf != nil {
+		key = protoZero(kf.typ)
+	}
+	if vf := entry.fields[2]; vf != nil {
+		value = protoZero(vf.typ)
+	}
+	for _, f := range fields {
+		if ef := entry.fields[f.number]; ef != nil && protoWireType(ef.typ) == f.wire {
+			if f.number == 1 {
+				key = r.decodeValue(ef, f, depth+1)
+			} else if f.number == 2 {
+				value = r.decodeValue(ef, f, depth+1)
+			}
+		}
+	}
+	m.set(fmt.Sprint(key), value)
+}
+
+// packed编码的数值
+func (r *ProtoRegistry) decodePacked(field *protoField, data []byte, depth int) ([]any, bool) {
+	var values []any
+	wire := protoWireType(field.typ)
+	for len(data) > 0 {
+		f := protoWireField{wire: wire}
+		n := 0
+		switch wire {
+		case protoVarint:
+			f.num, n = consumeVarint(data)
+		case protoFixed64:
+			if n = 8; len(data) >= n {
+				f.num = binary.LittleEndian.Uint64(data)
+			}
+		case protoFixed32:
+			if n = 4; len(data) >= n {
+				f.num = uint64(binary.LittleEndian.Uint32(data))
+			}
+		}
+		if n <= 0 || n > len(data) {
+			return nil, false
+		}
+		values = append(values, r.decodeValue(field, f, depth))
+		data = data[n:]
+	}
+	return values, true
+}
+
+// 按字段类型解码单个值 int64等64位整数与proto3 json一致使用字符串
+func (r *ProtoRegistry) decodeValue(field *protoField, f protoWireField, depth int) any {
+	switch field.typ {
+	case protoTypeDouble:
+		return protoFloat(math.Float64frombits(f.num), 64)
+	case protoTypeFloat:
+		return protoFloat(float64(math.Float32frombits(uint32(f.num))), 32)
+	case protoTypeInt64, protoTypeSfixed64:
+		return strconv.FormatInt(int64(f.num), 10)
+	case protoTypeUint64, protoTypeFixed64:
+		return strconv.FormatUint(f.num, 10)
+	case protoTypeSint64:
+		return strconv.FormatInt(int64(f.num>>1)^-int64(f.num&1), 10)
+	case protoTypeInt32, protoTypeSfixed32:
+		return json.Number(strconv.FormatInt(int64(int32(f.num)), 10))
+	case protoTypeUint32, protoTypeFixed32:
+		return json.Number(strconv.FormatUint(uint64(uint32(f.num)), 10))
+	case protoTypeSint32:
+		return json.Number(strconv.FormatInt(int64(int32(uint32(f.num>>1)^-uint32(f.num&1))), 10))
+	case protoTypeBool:
+		return f.num != 0
+	case protoTypeEnum:
+		if name, ok := r.enums[field.typeName][int32(f.num)]; ok {
+			return name
+		}
+		return json.Number(strconv.FormatInt(int64(int32(f.num)), 10))
+	case protoTypeString:
+		return string(f.data)
+	case protoTypeBytes:
+		return base64.StdEncoding.EncodeToString(f.data)
+	case protoTypeMessage, protoTypeGroup:
+		if f.wire == protoStartGroup {
+			return r.decodeMessage(field.typeName, f.group, depth+1)
+		}
+		if depth >= maxProtoDepth {
+			return base64.StdEncoding.EncodeToString(f.data)
+		}
+		fields, err := parseProtoWireAt(f.data, depth+1)
+		if err != nil {
+			return base64.StdEncoding.EncodeToString(f.data)
+		}
+		return r.decodeMessage(field.typeName, fields, depth+1)
+	}
+	return decodeRawValue(f, depth)
+}
+
+// 字段类型对应的wire type
+func protoWireType(typ int) int {
+	switch typ {
+	case protoTypeDouble, protoTypeFixed64, protoTypeSfixed64:
+		return protoFixed64
+	case protoTypeFloat, protoTypeFixed32, protoTypeSfixed32:
+		return protoFixed32
+	case protoTypeString, protoTypeBytes, protoTypeMessage:
+		return protoBytes
+	case protoTypeGroup:
+		return protoStartGroup
+	}
+	return protoVarint
+}
+
+// 未出现的字段的默认值
+func protoZero(typ int) any {
+	switch typ {
+	case protoTypeInt64, protoTypeUint64, protoTypeSint64, protoTypeFixed64, protoTypeSfixed64:
+		return "0"
+	case protoTypeBool:
+		return false
+	case protoTypeString, protoTypeBytes:
+		return ""
+	case protoTypeMessage, protoTypeGroup:
+		return nil
+	}
+	return json.Number("0")
+}
+
+func protoFloat(v float64, bits int) any {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "Infinity"
+	case math.IsInf(v, -1):
+		return "-Infinity"
+	}
+	return json.Number(strconv.FormatFloat(v, 'g', -1, bits))
+}
+
+// proto3 json中的Duration 如1.5s
+func protoDuration(seconds, nanos int64) string {
+	sign := ""
+	if seconds < 0 || nanos < 0 {
+		sign, seconds, nanos = "-", -seconds, -nanos
+	}
+	s := sign + strconv.FormatInt(seconds, 10)
+	if nanos != 0 {
+		s += strings.TrimRight(fmt.Sprintf(".%09d", nanos), "0")
+	}
+	return s + "s"
+}
+
+func decodeRawFields(fields []protoWireField, depth int) *protoJSONObject {
+	obj := newProtoJSONObject()
+	for _, f := range fields {
+		obj.add(strconv.Itoa(f.number), decodeRawValue(f, depth))
+	}
+	return obj
+}
+
+// 没有定义的字段 length-delimited的值依次尝试作为文本、嵌套消息解码 均失败时使用base64
+// 嵌套超过maxProtoDepth时不再尝试作为消息解码
+func decodeRawValue(f protoWireField, depth int) any {
+	switch f.wire {
+	case protoVarint, protoFixed64, protoFixed32:
+		return json.Number(strconv.FormatUint(f.num, 10))
+	case protoStartGroup:
+		return decodeRawFields(f.group, depth+1)
+	}
+	if isProtoText(f.data) {
+		return string(f.data)
+	}
+	if depth < maxProtoDepth {
+		if fields, err := parseProtoWireAt(f.data, depth+1); err == nil {
+			return decodeRawFields(fields, depth+1)
+		}
+	}
+	if utf8.Valid(f.data) {
+		return string(f.data)
+	}
+	return base64.StdEncoding.EncodeToString(f.data)
+}
+
+// 不含控制字符的文本
+func isProtoText(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, c := range string(b) {
+		if c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
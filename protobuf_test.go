@@ -0,0 +1,196 @@
+/*************************************************************************
+> File Name: protobuf_test.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 21:58:16 星期二
+> Content: 测试protobuf按wire格式及消息定义解码 以及嵌套深度的限制
+*************************************************************************/
+
+package gproxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func appendProtoTag(b []byte, number, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(number)<<3|uint64(wire))
+}
+
+func appendProtoVarint(b []byte, number int, v uint64) []byte {
+	return binary.AppendUvarint(appendProtoTag(b, number, protoVarint), v)
+}
+
+func appendProtoBytes(b []byte, number int, data []byte) []byte {
+	b = binary.AppendUvarint(appendProtoTag(b, number, protoBytes), uint64(len(data)))
+	return append(b, data...)
+}
+
+// depth层嵌套的group 最内层为空
+func nestedProtoGroups(depth int) []byte {
+	var b []byte
+	for i := 0; i < depth; i++ {
+		b = appendProtoTag(b, 1, protoStartGroup)
+	}
+	for i := 0; i < depth; i++ {
+		b = appendProtoTag(b, 1, protoEndGroup)
+	}
+	return b
+}
+
+// depth层嵌套在字段1中的消息 最内层为{1: 1}
+func nestedProtoMessages(depth int) []byte {
+	b := appendProtoVarint(nil, 1, 1)
+	for i := 0; i < depth; i++ {
+		b = appendProtoBytes(nil, 1, b)
+	}
+	return b
+}
+
+func TestDecodeRawProto(t *testing.T) {
+	var b []byte
+	b = appendProtoVarint(b, 1, 150)
+	b = appendProtoBytes(b, 2, []byte("hello"))
+	b = appendProtoBytes(b, 3, appendProtoBytes(appendProtoVarint(nil, 1, 1), 2, []byte("x")))
+	b = appendProtoVarint(b, 1, 7)
+	b = binary.LittleEndian.AppendUint32(appendProtoTag(b, 4, protoFixed32), 42)
+	b = binary.LittleEndian.AppendUint64(appendProtoTag(b, 5, protoFixed64), 1<<40)
+	// 既不是文本也不是消息的字节使用base64
+	b = appendProtoBytes(b, 6, []byte{0xff, 0xfe})
+	b = appendProtoTag(b, 7, protoStartGroup)
+	b = appendProtoVarint(b, 1, 5)
+	b = appendProtoTag(b, 7, protoEndGroup)
+	got, err := DecodeRawProto(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"1":[150,7],"2":"hello","3":{"1":1,"2":"x"},"4":42,"5":1099511627776,"6":"//4=","7":{"1":5}}`
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestDecodeRawProtoInvalid(t *testing.T) {
+	cases := map[string][]byte{
+		"truncated bytes":     {0x0a, 0x05, 'a'},
+		"truncated varint":    {0x08, 0x80},
+		"truncated fixed32":   {0x0d, 0x01, 0x02},
+		"field number zero":   {0x00, 0x01},
+		"end group only":      appendProtoTag(nil, 1, protoEndGroup),
+		"unterminated group":  appendProtoVarint(appendProtoTag(nil, 1, protoStartGroup), 2, 1),
+		"mismatched group":    appendProtoTag(appendProtoTag(nil, 1, protoStartGroup), 2, protoEndGroup),
+		"unknown wire type":   {0x0e},
+		"too deep groups":     nestedProtoGroups(maxProtoDepth + 1),
+		"unterminated groups": nestedProtoGroups(1 << 20)[:1<<20],
+	}
+	for name, b := range cases {
+		if got, err := DecodeRawProto(b); err == nil {
+			t.Errorf("%s: got %s, expected an error", name, got)
+		}
+	}
+}
+
+func TestDecodeRawProtoGroupDepth(t *testing.T) {
+	got, err := DecodeRawProto(nestedProtoGroups(maxProtoDepth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(got), "{"); n != maxProtoDepth+1 {
+		t.Errorf("got %d objects, want %d", n, maxProtoDepth+1)
+	}
+	// 大量嵌套的group在达到上限时即停止解析 不耗尽栈空间
+	start := time.Now()
+	if _, err := DecodeRawProto(nestedProtoGroups(1 << 20)); err == nil {
+		t.Error("expected an error")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("deep groups took %s", d)
+	}
+}
+
+// 嵌套超过上限的length-delimited字段不再作为消息解码
+func TestDecodeRawProtoMessageDepth(t *testing.T) {
+	got, err := DecodeRawProto(nestedProtoMessages(maxProtoDepth * 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(got), "{"); n != maxProtoDepth+1 {
+		t.Errorf("got %d objects, want %d", n, maxProtoDepth+1)
+	}
+	if !json.Valid(got) {
+		t.Errorf("invalid json: %s", got)
+	}
+}
+
+// package test;
+// message Node { string name = 1; Node child = 2; int64 id = 3; repeated int32 nums = 4; }
+func testProtoRegistry(t *testing.T) *ProtoRegistry {
+	t.Helper()
+	field := func(name string, number, label, typ int, typeName string) []byte {
+		var b []byte
+		b = appendProtoBytes(b, 1, []byte(name))
+		b = appendProtoVarint(b, 3, uint64(number))
+		b = appendProtoVarint(b, 4, uint64(label))
+		b = appendProtoVarint(b, 5, uint64(typ))
+		if typeName != "" {
+			b = appendProtoBytes(b, 6, []byte(typeName))
+		}
+		return b
+	}
+	msg := appendProtoBytes(nil, 1, []byte("Node"))
+	msg = appendProtoBytes(msg, 2, field("name", 1, 1, protoTypeString, ""))
+	msg = appendProtoBytes(msg, 2, field("child", 2, 1, protoTypeMessage, ".test.Node"))
+	msg = appendProtoBytes(msg, 2, field("id", 3, 1, protoTypeInt64, ""))
+	msg = appendProtoBytes(msg, 2, field("nums", 4, protoLabelRepeated, protoTypeInt32, ""))
+	file := appendProtoBytes(nil, 1, []byte("test.proto"))
+	file = appendProtoBytes(file, 2, []byte("test"))
+	file = appendProtoBytes(file, 4, msg)
+	r := NewProtoRegistry()
+	if err := r.Load(appendProtoBytes(nil, 1, file)); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestProtoRegistryDecode(t *testing.T) {
+	r := testProtoRegistry(t)
+	child := appendProtoBytes(nil, 1, []byte("leaf"))
+	var b []byte
+	b = appendProtoBytes(b, 1, []byte("root"))
+	b = appendProtoBytes(b, 2, child)
+	b = appendProtoVarint(b, 3, 1<<40)
+	// packed及非packed的repeated字段
+	b = appendProtoBytes(b, 4, binary.AppendUvarint(binary.AppendUvarint(nil, 1), 2))
+	b = appendProtoVarint(b, 4, 3)
+	b = appendProtoVarint(b, 9, 1)
+	got, err := r.Decode(".test.Node", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"name":"root","child":{"name":"leaf"},"id":"1099511627776","nums":[1,2,3],"9":1}`
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// 按定义解码时嵌套超过上限的消息使用base64
+func TestProtoRegistryDecodeDepth(t *testing.T) {
+	r := testProtoRegistry(t)
+	b := appendProtoBytes(nil, 1, []byte("leaf"))
+	for i := 0; i < maxProtoDepth*2; i++ {
+		b = appendProtoBytes(nil, 2, b)
+	}
+	got, err := r.Decode("test.Node", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(got), "{"); n != maxProtoDepth+1 {
+		t.Errorf("got %d objects, want %d", n, maxProtoDepth+1)
+	}
+	if strings.Contains(string(got), `"leaf"`) {
+		t.Error("decoded beyond the depth limit")
+	}
+}
@@ -0,0 +1,179 @@
+/*************************************************************************
+> File Name: proxytls.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 05:38:14 星期二
+> Content: 以TLS提供代理(https代理) 保护Proxy-Authorization及CONNECT的目标 支持客户端证书(mTLS)并映射为用户
+*************************************************************************/
+
+package gproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+)
+
+var (
+	ErrUnknownUserField  = errors.New("unknown client certificate user field")
+	ErrClientCARequired  = errors.New("client ca is required to verify client certificates")
+	ErrInvalidClientCA   = errors.New("no certificate found in client ca file")
+	ErrNoProxyTLSAddress = errors.New("proxy tls address is empty")
+)
+
+// 证书中作为用户名的字段
+const (
+	UserFieldCN      = "cn"
+	UserFieldSubject = "subject"
+	UserFieldEmail   = "email"
+	UserFieldURI     = "uri"
+	UserFieldDNS     = "dns"
+)
+
+type ProxyTLSOptions struct {
+	// 监听地址 如:8443
+	Addr string `json:"addr"`
+	// 服务端证书 为空时使用代理的CA按SNI(没有SNI时为本地IP)签发 客户端需信任该CA
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// 验证客户端证书的CA(PEM) 设置后启用mTLS
+	ClientCAFile string `json:"clientCAFile"`
+	// 要求客户端提供证书 否则只验证提供了的证书
+	RequireClientCert bool `json:"requireClientCert"`
+	// 用户名取自证书的cn(默认)、subject、email、uri或dns
+	UserField string `json:"userField"`
+	// 将证书中取出的值映射为用户名 没有映射时直接使用取出的值
+	Users map[string]string `json:"users"`
+}
+
+// context中保存的已验证的用户名 优先于Proxy-Authorization
+type proxyUserKey struct{}
+
+// 客户端证书对应的用户名
+func (o *ProxyTLSOptions) certUser(cert *x509.Certificate) string {
+	var value string
+	switch o.UserField {
+	case "", UserFieldCN:
+		value = cert.Subject.CommonName
+	case UserFieldSubject:
+		value = cert.Subject.String()
+	case UserFieldEmail:
+		if len(cert.EmailAddresses) > 0 {
+			value = cert.EmailAddresses[0]
+		}
+	case UserFieldURI:
+		if len(cert.URIs) > 0 {
+			value = cert.URIs[0].String()
+		}
+	case UserFieldDNS:
+		if len(cert.DNSNames) > 0 {
+			value = cert.DNSNames[0]
+		}
+	}
+	if user, ok := o.Users[value]; ok {
+		return user
+	}
+	return value
+}
+
+// 生成代理监听的tls配置
+func (o *ProxyTLSOptions) tlsConfig(p *SimpleProxyServer) (*tls.Config, error) {
+	if o.Addr == "" {
+		return nil, ErrNoProxyTLSAddress
+	}
+	switch o.UserField {
+	case "", UserFieldCN, UserFieldSubject, UserFieldEmail, UserFieldURI, UserFieldDNS:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownUserField, o.UserField)
+	}
+	// 代理的CONNECT需要接管连接 不支持HTTP/2
+	config := &tls.Config{NextProtos: []string{"http/1.1"}}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	} else {
+		config.GetCertificate = p.proxyCertificate()
+	}
+	switch {
+	case o.ClientCAFile != "":
+		data, err := os.ReadFile(o.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidClientCA, o.ClientCAFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if o.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	case o.RequireClientCert:
+		return nil, ErrClientCARequired
+	}
+	return config, nil
+}
+
+// 使用代理的CA按SNI签发证书 签发过的证书缓存在内存中
+func (p *SimpleProxyServer) proxyCertificate() func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	var certs sync.Map
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		host := hello.ServerName
+		if host == "" {
+			host, _, _ = net.SplitHostPort(hello.Conn.LocalAddr().String())
+		}
+		if cert, ok := certs.Load(host); ok {
+			return cert.(*tls.Certificate), nil
+		}
+		config, err := goproxy.TLSConfigFromCA(&goproxy.GoproxyCa)(host, &goproxy.ProxyCtx{Proxy: p.proxy})
+		if err != nil {
+			return nil, err
+		}
+		cert, _ := certs.LoadOrStore(host, &config.Certificates[0])
+		return cert.(*tls.Certificate), nil
+	}
+}
+
+// 以TLS监听代理 客户端证书对应的用户保存在请求的context中
+func (p *SimpleProxyServer) serveProxyTLS() {
+	config, err := p.TLS.tlsConfig(p)
+	if err != nil {
+		p.Logger.WithField("err", err.Error()).Error("Invalid Proxy TLS Options")
+		return
+	}
+	server := p.newProxyServer(p.TLS.Addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			if user := p.TLS.certUser(r.TLS.PeerCertificates[0]); user != "" {
+				r = r.WithContext(context.WithValue(r.Context(), proxyUserKey{}, user))
+			}
+		}
+		p.serveHTTP(w, r)
+	}))
+	server.TLSConfig = config
+	// 非nil的空map禁用HTTP/2
+	server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	p.Logger.Infof("Starting TLS Proxy On %s", p.TLS.Addr)
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		p.Logger.WithField("err", err.Error()).Error("Start TLS Proxy Failed!")
+	}
+}
+
+// MITM的请求沿用CONNECT请求的用户
+func proxyUserContext(connect *http.Request) context.Context {
+	ctx := context.Background()
+	if user := requestUser(connect); user != "" {
+		ctx = context.WithValue(ctx, proxyUserKey{}, user)
+	}
+	return ctx
+}
@@ -0,0 +1,399 @@
+/*************************************************************************
+> File Name: ratelimit.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-19 19:12:50 星期一
+> Content: 按客户端、用户或目标域名限制请求速率及并发数
+*************************************************************************/
+
+package gproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// 限流的维度
+const (
+	RateLimitByClient = "client"
+	RateLimitByUser   = "user"
+	RateLimitByHost   = "host"
+)
+
+var (
+	// 排队时检查并发数的间隔
+	rateLimitPollInterval = 50 * time.Millisecond
+	// 内存存储中超过该数量的令牌桶时清理已回满的桶
+	maxMemoryLimiterBuckets = 10000
+	ErrUnknownRateLimitKey  = errors.New("unknown rate limit key")
+)
+
+// 限流状态的存储 可替换为redis等共享存储以便多个代理实例共享限额
+type LimiterStore interface {
+	// 从令牌桶中取出一个令牌 失败时返回需要等待的时间
+	Take(key string, rate float64, burst int) (bool, time.Duration)
+	// 并发数加一 已达到max时不增加并返回false
+	Acquire(key string, max int) bool
+	// 并发数减一
+	Release(key string)
+	// 当前的并发数
+	Count(key string) int
+}
+
+// 基于内存的限流存储
+type MemoryLimiterStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	counts  map[string]int
+}
+
+func NewMemoryLimiterStore() *MemoryLimiterStore {
+	return &MemoryLimiterStore{buckets: make(map[string]*tokenBucket), counts: make(map[string]int)}
+}
+
+func (s *MemoryLimiterStore) Take(key string, rate float64, burst int) (bool, time.Duration) {
+	s.mu.Lock()
+	b, ok := s.buckets[key]
+	if !ok {
+		if len(s.buckets) >= maxMemoryLimiterBuckets {
+			s.cleanup()
+		}
+		b = newTokenBucket(rate, float64(max(burst, 1)))
+		s.buckets[key] = b
+	}
+	s.mu.Unlock()
+	if b.allow(1) {
+		return true, 0
+	}
+	b.mu.Lock()
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	return false, wait
+}
+
+// 清理已回满的令牌桶 调用时需持有锁
+func (s *MemoryLimiterStore) cleanup() {
+	now := time.Now()
+	for key, b := range s.buckets {
+		b.mu.Lock()
+		b.refill(now)
+		full := b.tokens >= b.burst
+		b.mu.Unlock()
+		if full {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func (s *MemoryLimiterStore) Acquire(key string, max int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if max > 0 && s.counts[key] >= max {
+		return false
+	}
+	s.counts[key]++
+	return true
+}
+
+func (s *MemoryLimiterStore) Release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts[key] <= 1 {
+		delete(s.counts, key)
+		return
+	}
+	s.counts[key]--
+}
+
+func (s *MemoryLimiterStore) Count(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts[key]
+}
+
+// 限流规则
+type RateLimitRule struct {
+	// 限流的维度 client/user/host
+	Key string `json:"key"`
+	// 每秒允许的请求数 0为不限制
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+	// 最大并发数 0为不限制 CONNECT隧道在关闭前占用一个并发数
+	MaxConcurrent int `json:"maxConcurrent"`
+	// 超限时排队等待的最长时间 为0时直接返回429
+	MaxWait time.Duration `json:"maxWait"`
+}
+
+// 限流中间件
+type RateLimitMiddleware struct {
+	store LimiterStore
+	rules []RateLimitRule
+	// 请求占用的并发数 响应结束后释放
+	acquired sync.Map
+	// CONNECT请求占用的并发数 隧道建立后交给WrapConn 否则在ConnectDone中释放
+	tunnels sync.Map
+}
+
+// store为nil时使用内存存储
+func NewRateLimitMiddleware(store LimiterStore, rules ...RateLimitRule) (*RateLimitMiddleware, error) {
+	for _, r := range rules {
+		if r.Key != RateLimitByClient && r.Key != RateLimitByUser && r.Key != RateLimitByHost {
+			return nil, ErrUnknownRateLimitKey
+		}
+	}
+	if store == nil {
+		store = NewMemoryLimiterStore()
+	}
+	return &RateLimitMiddleware{store: store, rules: rules}, nil
+}
+
+// 请求在规则维度上的值 为空时不限流
+func (m *RateLimitMiddleware) value(rule *RateLimitRule, req *http.Request) string {
+	switch rule.Key {
+	case RateLimitByClient:
+		return clientIP(req)
+	case RateLimitByUser:
+		return requestUser(req)
+	case RateLimitByHost:
+		if req.URL != nil && req.URL.Hostname() != "" {
+			return req.URL.Hostname()
+		}
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			return req.Host
+		}
+		return host
+	}
+	return ""
+}
+
+func (m *RateLimitMiddleware) storeKey(i int, rule *RateLimitRule, value string) string {
+	return "gproxy:ratelimit:" + strconv.Itoa(i) + ":" + rule.Key + ":" + value
+}
+
+// 检查全部规则 通过时返回占用的并发数的key
+func (m *RateLimitMiddleware) admit(req *http.Request) ([]string, error) {
+	var keys []string
+	for i := range m.rules {
+		rule := &m.rules[i]
+		value := m.value(rule, req)
+		if value == "" {
+			continue
+		}
+		key := m.storeKey(i, rule, value)
+		deadline := time.Now().Add(rule.MaxWait)
+		if rule.Rate > 0 {
+			for {
+				ok, wait := m.store.Take(key, rule.Rate, rule.Burst)
+				if ok {
+					break
+				}
+				if time.Now().Add(wait).After(deadline) {
+					m.releaseAll(keys)
+					return nil, &rateLimitError{rule: rule, value: value, retryAfter: wait}
+				}
+				time.Sleep(wait)
+			}
+		}
+		if rule.MaxConcurrent <= 0 {
+			continue
+		}
+		ckey := key + ":concurrent"
+		for {
+			if m.store.Acquire(ckey, rule.MaxConcurrent) {
+				keys = append(keys, ckey)
+				break
+			}
+			if !time.Now().Add(rateLimitPollInterval).Before(deadline) {
+				m.releaseAll(keys)
+				return nil, &rateLimitError{rule: rule, value: value, retryAfter: time.Second, concurrent: true}
+			}
+			time.Sleep(rateLimitPollInterval)
+		}
+	}
+	return keys, nil
+}
+
+func (m *RateLimitMiddleware) releaseAll(keys []string) {
+	for _, k := range keys {
+		m.store.Release(k)
+	}
+}
+
+func (m *RateLimitMiddleware) RequestCondition(_ *http.Request, _ *goproxy.ProxyCtx) bool {
+	return len(m.rules) > 0
+}
+
+func (m *RateLimitMiddleware) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	keys, err := m.admit(req)
+	if err != nil {
+		ctx.Warnf("%v", err)
+		return req, tooManyRequests(req, err)
+	}
+	if len(keys) > 0 {
+		m.acquired.Store(ctx, keys)
+	}
+	return req, nil
+}
+
+func (m *RateLimitMiddleware) ResponseCondition(_ *http.Response, ctx *goproxy.ProxyCtx) bool {
+	_, ok := m.acquired.Load(ctx)
+	return ok
+}
+
+// 响应体读取完毕后释放并发数
+func (m *RateLimitMiddleware) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	v, _ := m.acquired.LoadAndDelete(ctx)
+	keys := v.([]string)
+	if resp == nil || resp.Body == nil {
+		m.releaseAll(keys)
+		return resp
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: func() { m.releaseAll(keys) }}
+	return resp
+}
+
+// CONNECT请求同样计入速率 超过并发数时拒绝 通过时即占用并发数
+func (m *RateLimitMiddleware) OnConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	keys, err := m.admit(ctx.Req)
+	if err != nil {
+		ctx.Warnf("%v", err)
+		ctx.Resp = tooManyRequests(ctx.Req, err)
+		return goproxy.RejectConnect, host
+	}
+	if len(keys) > 0 {
+		m.tunnels.Store(ctx.Req, keys)
+	}
+	return nil, host
+}
+
+// 未建立隧道(被拒绝、连接失败或转为MITM)时释放OnConnect占用的并发数
+func (m *RateLimitMiddleware) ConnectDone(req *http.Request) {
+	if v, ok := m.tunnels.LoadAndDelete(req); ok {
+		m.releaseAll(v.([]string))
+	}
+}
+
+// 未MITM的隧道在关闭前占用并发数
+func (m *RateLimitMiddleware) WrapConn(conn net.Conn, req *http.Request) net.Conn {
+	var keys []string
+	if v, ok := m.tunnels.LoadAndDelete(req); ok {
+		// 沿用OnConnect中占用的并发数
+		keys = v.([]string)
+	} else {
+		// websocket等未经过OnConnect的连接 请求已在OnRequest中检查过 这里不再拒绝
+		for i := range m.rules {
+			rule := &m.rules[i]
+			value := m.value(rule, req)
+			if rule.MaxConcurrent <= 0 || value == "" {
+				continue
+			}
+			key := m.storeKey(i, rule, value) + ":concurrent"
+			m.store.Acquire(key, 0)
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return conn
+	}
+	return &releaseOnCloseConn{Conn: conn, release: func() { m.releaseAll(keys) }}
+}
+
+type rateLimitError struct {
+	rule       *RateLimitRule
+	value      string
+	retryAfter time.Duration
+	concurrent bool
+}
+
+func (e *rateLimitError) Error() string {
+	if e.concurrent {
+		return fmt.Sprintf("too many concurrent requests for %s %s", e.rule.Key, e.value)
+	}
+	return fmt.Sprintf("rate limit exceeded for %s %s", e.rule.Key, e.value)
+}
+
+func tooManyRequests(req *http.Request, err error) *http.Response {
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusTooManyRequests, err.Error())
+	resp.Status = "429 Too Many Requests"
+	retryAfter := time.Second
+	var rle *rateLimitError
+	if errors.As(err, &rle) && rle.retryAfter > 0 {
+		retryAfter = rle.retryAfter
+	}
+	resp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return resp
+}
+
+// 请求对应的已验证的用户 来自TLS代理的客户端证书或经Authenticate校验的Proxy-Authorization
+// 未经校验的Proxy-Authorization可被客户端任意伪造 不作为用户
+func requestUser(req *http.Request) string {
+	user, _ := req.Context().Value(proxyUserKey{}).(string)
+	return user
+}
+
+// 关闭时执行一次release
+type releaseOnClose struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseOnClose) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
+
+// 完全关闭或读写两个方向都关闭后执行一次release
+type releaseOnCloseConn struct {
+	net.Conn
+	mu          sync.Mutex
+	once        sync.Once
+	readClosed  bool
+	writeClosed bool
+	release     func()
+}
+
+func (c *releaseOnCloseConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+func (c *releaseOnCloseConn) halfClosed(read bool) {
+	c.mu.Lock()
+	if read {
+		c.readClosed = true
+	} else {
+		c.writeClosed = true
+	}
+	done := c.readClosed && c.writeClosed
+	c.mu.Unlock()
+	if done {
+		c.once.Do(c.release)
+	}
+}
+
+func (c *releaseOnCloseConn) CloseWrite() error {
+	defer c.halfClosed(false)
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+func (c *releaseOnCloseConn) CloseRead() error {
+	defer c.halfClosed(true)
+	if hc, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return hc.CloseRead()
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+/*************************************************************************
+> File Name: replay.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-19 10:48:31 星期一
+> Content: 重放抓包记录中的请求 可修改后重新发送并对比响应
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/elazarl/goproxy"
+)
+
+var (
+	ErrProxyNotStarted = errors.New("proxy server is not started")
+	ErrCaptureDisabled = errors.New("flow capture is disabled")
+	ErrFlowNotFound    = errors.New("flow not found")
+	// 抓包时请求体超过MaxFlowBodySize被截断 重放需通过ReplayOptions.Body提供完整的请求体
+	ErrTruncatedBody = errors.New("captured request body is truncated")
+	// 超过该行数的body不做逐行对比
+	maxDiffLines = 2000
+)
+
+// 重放时对原请求的修改 零值字段沿用原请求
+type ReplayOptions struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	// 非nil时替换原请求头
+	Header http.Header `json:"header"`
+	// 非nil时替换原请求体
+	Body []byte `json:"body"`
+	// 跳过中间件直接通过代理的transport发送
+	SkipMiddlewares bool `json:"skipMiddlewares"`
+}
+
+// 请求头的差异
+type HeaderDiff struct {
+	Name string   `json:"name"`
+	Old  []string `json:"old,omitempty"`
+	New  []string `json:"new,omitempty"`
+}
+
+// 新旧响应的差异
+type FlowDiff struct {
+	// 状态码变化 如"200 OK -> 404 Not Found"
+	Status string       `json:"status,omitempty"`
+	Header []HeaderDiff `json:"header,omitempty"`
+	// 逐行对比的结果 以"+"/"-"/" "开头
+	Body []string `json:"body,omitempty"`
+}
+
+type ReplayResult struct {
+	Original *Flow     `json:"original"`
+	Replayed *Flow     `json:"replayed"`
+	Diff     *FlowDiff `json:"diff"`
+}
+
+// 重放指定id的抓包记录
+func (p *SimpleProxyServer) Replay(id int64, opt *ReplayOptions) (*ReplayResult, error) {
+	if p.proxy == nil {
+		return nil, ErrProxyNotStarted
+	}
+	if p.flows == nil {
+		return nil, ErrCaptureDisabled
+	}
+	if opt == nil {
+		opt = &ReplayOptions{}
+	}
+	orig := p.flows.Get(id)
+	if orig == nil {
+		return nil, ErrFlowNotFound
+	}
+	req, err := newReplayRequest(orig.Request, opt)
+	if err != nil {
+		return nil, err
+	}
+	ctx := &goproxy.ProxyCtx{Req: req, Proxy: p.proxy}
+	flow := &Flow{
+		ClientAddr: "replay",
+		StartTime:  time.Now(),
+		Request:    p.flows.captureRequest(req),
+		ReplayOf:   id,
+	}
+	var resp *http.Response
+	if opt.SkipMiddlewares {
+		resp, err = ctx.RoundTrip(req)
+	} else {
+		resp, err = p.roundTripWithMiddlewares(req, ctx)
+	}
+	flow.Duration = time.Since(flow.StartTime)
+	if err != nil {
+		flow.Error = err.Error()
+	}
+	if resp != nil {
+		flow.Response = p.flows.captureResponse(resp)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	p.flows.Add(flow)
+	return &ReplayResult{
+		Original: orig,
+		Replayed: flow,
+		Diff:     diffResponses(orig.Response, flow.Response),
+	}, nil
+}
+
+// 依次执行中间件的勾子并发送请求 与goproxy处理请求的流程一致
+func (p *SimpleProxyServer) roundTripWithMiddlewares(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+	var resp *http.Response
+	for _, m := range p.middlewares {
+		if !m.RequestCondition(req, ctx) {
+			continue
+		}
+		req, resp = m.OnRequest(req, ctx)
+		if resp != nil {
+			break
+		}
+	}
+	if resp == nil {
+		var err error
+		ctx.Req = req
+		if resp, err = ctx.RoundTrip(req); err != nil {
+			ctx.Error = err
+		}
+	}
+	for _, m := range p.middlewares {
+		ctx.Resp = resp
+		if m.ResponseCondition(resp, ctx) {
+			resp = m.OnResponse(resp, ctx)
+		}
+	}
+	if resp == nil && ctx.Error != nil {
+		return nil, ctx.Error
+	}
+	return resp, nil
+}
+
+func newReplayRequest(fr *FlowRequest, opt *ReplayOptions) (*http.Request, error) {
+	method, rawURL, header, body := fr.Method, fr.URL, fr.Header, fr.Body
+	if opt.Method != "" {
+		method = opt.Method
+	}
+	if opt.URL != "" {
+		rawURL = opt.URL
+	}
+	if opt.Header != nil {
+		header = opt.Header
+	}
+	if opt.Body != nil {
+		body = opt.Body
+	} else if fr.Truncated {
+		return nil, ErrTruncatedBody
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if !u.IsAbs() {
+		return nil, fmt.Errorf("replay url must be absolute: %s", rawURL)
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	// 与goproxy转发请求时一样去掉逐跳的请求头
+	for _, key := range []string{"Accept-Encoding", "Proxy-Connection", "Proxy-Authorization", "Connection", "Content-Length"} {
+		req.Header.Del(key)
+	}
+	return req, nil
+}
+
+// 对比新旧响应
+func diffResponses(prev, cur *FlowResponse) *FlowDiff {
+	diff := &FlowDiff{}
+	oldStatus, newStatus := "<none>", "<none>"
+	var oldHeader, newHeader http.Header
+	var oldBody, newBody []byte
+	if prev != nil {
+		oldStatus, oldHeader, oldBody = prev.Status, prev.Header, prev.Body
+	}
+	if cur != nil {
+		newStatus, newHeader, newBody = cur.Status, cur.Header, cur.Body
+	}
+	if oldStatus != newStatus {
+		diff.Status = oldStatus + " -> " + newStatus
+	}
+	diff.Header = diffHeaders(oldHeader, newHeader)
+	diff.Body = diffBodies(oldBody, newBody)
+	return diff
+}
+
+func diffHeaders(prev, cur http.Header) []HeaderDiff {
+	names := make(map[string]struct{})
+	for k := range prev {
+		names[k] = struct{}{}
+	}
+	for k := range cur {
+		names[k] = struct{}{}
+	}
+	var diffs []HeaderDiff
+	for k := range names {
+		if strings.Join(prev[k], "\n") != strings.Join(cur[k], "\n") {
+			diffs = append(diffs, HeaderDiff{Name: k, Old: prev[k], New: cur[k]})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Name < diffs[j].Name })
+	return diffs
+}
+
+// 逐行对比body 非文本或过大的body只给出摘要
+func diffBodies(prev, cur []byte) []string {
+	if bytes.Equal(prev, cur) {
+		return nil
+	}
+	if !utf8.Valid(prev) || !utf8.Valid(cur) {
+		return []string{fmt.Sprintf("binary body differs: %d bytes -> %d bytes", len(prev), len(cur))}
+	}
+	a, b := splitLines(prev), splitLines(cur)
+	if len(a) > maxDiffLines || len(b) > maxDiffLines {
+		return []string{fmt.Sprintf("body differs: %d lines -> %d lines", len(a), len(b))}
+	}
+	// 最长公共子序列
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var lines []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, " "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, "-"+a[i])
+			i++
+		default:
+			lines = append(lines, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, "+"+b[j])
+	}
+	return lines
+}
+
+func splitLines(b []byte) []string {
+	if len(b) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
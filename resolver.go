@@ -0,0 +1,624 @@
+/*************************************************************************
+> File Name: resolver.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 06:41:19 星期二
+> Content: 出站连接的域名解析 静态解析(支持通配符)、按域名指定上游DNS、DoT/DoH及按TTL缓存
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	ErrDNSDisabled       = errors.New("dns is not configured")
+	ErrNoDNSAnswer       = errors.New("no dns answer")
+	ErrUnknownDNSScheme  = errors.New("unknown dns server scheme")
+	ErrDNSResponseFailed = errors.New("dns query failed")
+	// 系统解析的结果没有TTL 使用该值缓存
+	systemDNSTTL        = 30 * time.Second
+	defaultDNSTimeout   = 5 * time.Second
+	defaultDNSCacheSize = 4096
+	// udp响应的最大长度
+	dnsUDPSize = 1232
+)
+
+// 解析结果的来源
+const (
+	DNSSourceHosts  = "hosts"
+	DNSSourceCache  = "cache"
+	DNSSourceSystem = "system"
+	DNSSourceServer = "server"
+)
+
+// 为匹配的域名(包括子域名)指定上游DNS
+type DNSRule struct {
+	Domains []string `json:"domains"`
+	Servers []string `json:"servers"`
+}
+
+type DNSOptions struct {
+	// 静态解析 域名到IP 支持*.example.com
+	Hosts map[string][]string `json:"hosts"`
+	// hosts格式的文件 与Hosts合并
+	HostsFile string `json:"hostsFile"`
+	// 默认的上游DNS 为空时使用系统解析
+	// 支持8.8.8.8(udp 53端口)、tcp://8.8.8.8:53、tls://1.1.1.1:853(DoT)及https://dns.google/dns-query(DoH)
+	Servers []string `json:"servers"`
+	// 按顺序匹配 匹配的域名使用指定的上游DNS
+	Rules []DNSRule `json:"rules"`
+	// 每次查询的超时 默认5s
+	Timeout time.Duration `json:"timeout"`
+	// 最多缓存的域名数 默认4096 小于0时不缓存
+	CacheSize int `json:"cacheSize"`
+	// 缓存时间的上限 为0时按记录的TTL
+	MaxTTL time.Duration `json:"maxTTL"`
+	// 以Info级别记录每次解析 否则为Debug
+	LogQueries bool `json:"logQueries"`
+}
+
+// 从json文件加载DNS的配置
+func LoadDNSOptions(path string) (*DNSOptions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	opt := &DNSOptions{}
+	if err := json.Unmarshal(data, opt); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return opt, nil
+}
+
+// 一次解析的结果
+type DNSResult struct {
+	Host   string   `json:"host"`
+	IPs    []net.IP `json:"ips"`
+	Source string   `json:"source"`
+	// 来源为server时使用的上游DNS
+	Server   string        `json:"server,omitempty"`
+	TTL      time.Duration `json:"ttl"`
+	Duration time.Duration `json:"duration"`
+}
+
+// 出站连接使用的解析器
+type Resolver struct {
+	opt   DNSOptions
+	hosts map[string][]net.IP
+	// 通配的静态解析 按配置的顺序匹配
+	wildcards []dnsHost
+	servers   []*dnsServer
+	rules     []dnsRule
+	client    *http.Client
+
+	mu       sync.Mutex
+	cache    map[string]*dnsCacheEntry
+	inflight map[string]*dnsCall
+}
+
+type dnsHost struct {
+	pattern string
+	ips     []net.IP
+}
+
+type dnsRule struct {
+	domains []string
+	servers []*dnsServer
+}
+
+type dnsServer struct {
+	addr   string
+	scheme string
+	// DoH的地址
+	url string
+}
+
+type dnsCacheEntry struct {
+	result  DNSResult
+	expires time.Time
+}
+
+// 合并相同域名的并发查询
+type dnsCall struct {
+	done   chan struct{}
+	result *DNSResult
+	err    error
+}
+
+func NewResolver(opt DNSOptions) (*Resolver, error) {
+	if opt.Timeout <= 0 {
+		opt.Timeout = defaultDNSTimeout
+	}
+	if opt.CacheSize == 0 {
+		opt.CacheSize = defaultDNSCacheSize
+	}
+	r := &Resolver{
+		opt:      opt,
+		hosts:    make(map[string][]net.IP),
+		client:   &http.Client{Timeout: opt.Timeout},
+		cache:    make(map[string]*dnsCacheEntry),
+		inflight: make(map[string]*dnsCall),
+	}
+	if opt.HostsFile != "" {
+		if err := r.loadHostsFile(opt.HostsFile); err != nil {
+			return nil, err
+		}
+	}
+	for host, addrs := range opt.Hosts {
+		var ips []net.IP
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q for host %s", addr, host)
+			}
+			ips = append(ips, ip)
+		}
+		r.addHost(host, ips)
+	}
+	var err error
+	if r.servers, err = parseDNSServers(opt.Servers); err != nil {
+		return nil, err
+	}
+	for _, rule := range opt.Rules {
+		servers, err := parseDNSServers(rule.Servers)
+		if err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, dnsRule{domains: rule.Domains, servers: servers})
+	}
+	return r, nil
+}
+
+func (r *Resolver) addHost(host string, ips []net.IP) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.HasPrefix(host, "*.") {
+		r.wildcards = append(r.wildcards, dnsHost{pattern: host, ips: ips})
+		return
+	}
+	r.hosts[host] = append(r.hosts[host], ips...)
+}
+
+// 读取hosts格式的文件 每行为IP及其域名 #之后为注释
+func (r *Resolver) loadHostsFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, host := range fields[1:] {
+			r.addHost(host, []net.IP{ip})
+		}
+	}
+	return scanner.Err()
+}
+
+func parseDNSServers(servers []string) ([]*dnsServer, error) {
+	var result []*dnsServer
+	for _, s := range servers {
+		server := &dnsServer{scheme: "udp", addr: s}
+		if scheme, rest, ok := strings.Cut(s, "://"); ok {
+			server.scheme, server.addr = scheme, rest
+		}
+		switch server.scheme {
+		case "udp", "tcp":
+			server.addr = dnsServerAddr(server.addr, "53")
+		case "tls":
+			server.addr = dnsServerAddr(server.addr, "853")
+		case "https":
+			u, err := url.Parse(s)
+			if err != nil {
+				return nil, err
+			}
+			server.url, server.addr = u.String(), u.Host
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrUnknownDNSScheme, s)
+		}
+		result = append(result, server)
+	}
+	return result, nil
+}
+
+// 没有端口时使用默认端口
+func dnsServerAddr(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// 域名匹配 pattern同时匹配其子域名
+func domainMatches(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimPrefix(strings.TrimSuffix(pattern, "."), "*."))
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+// 解析域名 依次查找静态解析、缓存及上游DNS
+func (r *Resolver) Lookup(ctx context.Context, host string) (*DNSResult, error) {
+	start := time.Now()
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip := net.ParseIP(host); ip != nil {
+		return &DNSResult{Host: host, IPs: []net.IP{ip}, Source: DNSSourceHosts}, nil
+	}
+	if ips := r.staticIPs(host); len(ips) > 0 {
+		return &DNSResult{Host: host, IPs: ips, Source: DNSSourceHosts, Duration: time.Since(start)}, nil
+	}
+	r.mu.Lock()
+	if entry, ok := r.cache[host]; ok && time.Now().Before(entry.expires) {
+		r.mu.Unlock()
+		result := entry.result
+		result.Source, result.TTL, result.Duration = DNSSourceCache, time.Until(entry.expires), time.Since(start)
+		return &result, nil
+	}
+	call, ok := r.inflight[host]
+	if !ok {
+		call = &dnsCall{done: make(chan struct{})}
+		r.inflight[host] = call
+		go r.resolve(host, call)
+	}
+	r.mu.Unlock()
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	result := *call.result
+	result.Duration = time.Since(start)
+	return &result, nil
+}
+
+func (r *Resolver) staticIPs(host string) []net.IP {
+	if ips, ok := r.hosts[host]; ok {
+		return ips
+	}
+	for _, h := range r.wildcards {
+		if hostMatches(h.pattern, host) {
+			return h.ips
+		}
+	}
+	return nil
+}
+
+// 查询并写入缓存 不使用请求的context 避免一个请求取消后影响其他等待的请求
+func (r *Resolver) resolve(host string, call *dnsCall) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.opt.Timeout)
+	defer cancel()
+	call.result, call.err = r.query(ctx, host)
+	r.mu.Lock()
+	delete(r.inflight, host)
+	if call.err == nil && r.opt.CacheSize > 0 && call.result.TTL > 0 {
+		if len(r.cache) >= r.opt.CacheSize {
+			r.evict()
+		}
+		r.cache[host] = &dnsCacheEntry{result: *call.result, expires: time.Now().Add(call.result.TTL)}
+	}
+	r.mu.Unlock()
+	close(call.done)
+}
+
+// 删除过期的缓存 仍然已满时删除任意一个
+func (r *Resolver) evict() {
+	now := time.Now()
+	for host, entry := range r.cache {
+		if now.After(entry.expires) {
+			delete(r.cache, host)
+		}
+	}
+	for host := range r.cache {
+		if len(r.cache) < r.opt.CacheSize {
+			break
+		}
+		delete(r.cache, host)
+	}
+}
+
+// 清空缓存
+func (r *Resolver) FlushCache() {
+	r.mu.Lock()
+	r.cache = make(map[string]*dnsCacheEntry)
+	r.mu.Unlock()
+}
+
+// 缓存中未过期的结果
+func (r *Resolver) Cache() []DNSResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	var results []DNSResult
+	for _, entry := range r.cache {
+		if now.Before(entry.expires) {
+			result := entry.result
+			result.TTL = entry.expires.Sub(now)
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// 按规则选择上游DNS 依次尝试直到成功
+func (r *Resolver) query(ctx context.Context, host string) (*DNSResult, error) {
+	servers := r.servers
+	for _, rule := range r.rules {
+		matched := false
+		for _, d := range rule.domains {
+			if domainMatches(d, host) {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			servers = rule.servers
+			break
+		}
+	}
+	if len(servers) == 0 {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		result := &DNSResult{Host: host, Source: DNSSourceSystem, TTL: r.capTTL(systemDNSTTL)}
+		for _, addr := range addrs {
+			result.IPs = append(result.IPs, addr.IP)
+		}
+		return result, nil
+	}
+	var lastErr error
+	for _, server := range servers {
+		ips, ttl, err := r.queryServer(ctx, server, host)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", server.addr, err)
+			continue
+		}
+		return &DNSResult{Host: host, IPs: ips, Source: DNSSourceServer, Server: server.addr, TTL: r.capTTL(ttl)}, nil
+	}
+	return nil, lastErr
+}
+
+func (r *Resolver) capTTL(ttl time.Duration) time.Duration {
+	if r.opt.MaxTTL > 0 && ttl > r.opt.MaxTTL {
+		return r.opt.MaxTTL
+	}
+	return ttl
+}
+
+// 同时查询A及AAAA记录 TTL为所有记录中最小的
+func (r *Resolver) queryServer(ctx context.Context, server *dnsServer, host string) ([]net.IP, time.Duration, error) {
+	type answer struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	answers := make([]answer, len(types))
+	var wg sync.WaitGroup
+	for i, t := range types {
+		wg.Add(1)
+		go func(i int, t dnsmessage.Type) {
+			defer wg.Done()
+			a := &answers[i]
+			a.ips, a.ttl, a.err = r.exchange(ctx, server, host, t)
+		}(i, t)
+	}
+	wg.Wait()
+	var (
+		ips     []net.IP
+		ttl     time.Duration = -1
+		lastErr error
+	)
+	for _, a := range answers {
+		if a.err != nil {
+			lastErr = a.err
+			continue
+		}
+		ips = append(ips, a.ips...)
+		if len(a.ips) > 0 && (ttl < 0 || a.ttl < ttl) {
+			ttl = a.ttl
+		}
+	}
+	if len(ips) == 0 {
+		if lastErr == nil {
+			lastErr = ErrNoDNSAnswer
+		}
+		return nil, 0, lastErr
+	}
+	return ips, ttl, nil
+}
+
+// 发送一次查询 解析响应中的A或AAAA记录
+func (r *Resolver) exchange(ctx context.Context, server *dnsServer, host string, t dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	// 随机的ID 防止伪造udp响应 DoH使用固定的ID 便于缓存
+	var id uint16
+	if server.scheme != "https" {
+		var b [2]byte
+		rand.Read(b[:])
+		id = binary.BigEndian.Uint16(b[:])
+	}
+	question := dnsmessage.Question{Name: name, Type: t, Class: dnsmessage.ClassINET}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	var resp []byte
+	switch server.scheme {
+	case "udp":
+		resp, err = r.exchangeUDP(ctx, server.addr, query, func(resp []byte) bool {
+			return dnsResponseMatches(resp, id, question)
+		})
+		// 响应被截断时改用tcp
+		if err == nil && len(resp) > 2 && resp[2]&0x02 != 0 {
+			resp, err = r.exchangeStream(ctx, server, query)
+		}
+	case "https":
+		resp, err = r.exchangeHTTPS(ctx, server.url, query)
+	default:
+		resp, err = r.exchangeStream(ctx, server, query)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if !dnsResponseMatches(resp, id, question) {
+		return nil, 0, fmt.Errorf("%w: response does not match the query", ErrDNSResponseFailed)
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		return nil, 0, err
+	}
+	if m.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("%w: %s", ErrDNSResponseFailed, m.RCode)
+	}
+	var (
+		ips []net.IP
+		ttl uint32
+	)
+	for _, a := range m.Answers {
+		var ip net.IP
+		switch body := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		default:
+			continue
+		}
+		if len(ips) == 0 || a.Header.TTL < ttl {
+			ttl = a.Header.TTL
+		}
+		ips = append(ips, ip)
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// 响应的ID及问题与查询一致
+func dnsResponseMatches(resp []byte, id uint16, q dnsmessage.Question) bool {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil || h.ID != id || !h.Response {
+		return false
+	}
+	rq, err := p.Question()
+	if err != nil {
+		return false
+	}
+	return rq.Type == q.Type && rq.Class == q.Class && strings.EqualFold(rq.Name.String(), q.Name.String())
+}
+
+func (r *Resolver) exchangeUDP(ctx context.Context, addr string, query []byte, match func([]byte) bool) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// 忽略ID或问题不一致的响应
+		if match(buf[:n]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// tcp及DoT 消息以2字节的长度开头
+func (r *Resolver) exchangeStream(ctx context.Context, server *dnsServer, query []byte) ([]byte, error) {
+	var (
+		d    net.Dialer
+		conn net.Conn
+		err  error
+	)
+	if server.scheme == "tls" {
+		host, _, _ := net.SplitHostPort(server.addr)
+		td := tls.Dialer{NetDialer: &d, Config: &tls.Config{ServerName: host}}
+		conn, err = td.DialContext(ctx, "tcp", server.addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", server.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// DoH(RFC 8484) 以POST发送
+func (r *Resolver) exchangeHTTPS(ctx context.Context, url string, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrDNSResponseFailed, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+}
@@ -0,0 +1,125 @@
+/*************************************************************************
+> File Name: resolver_test.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 21:05:12 星期二
+> Content: 测试DNS响应与查询的ID及问题的匹配
+*************************************************************************/
+
+package gproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func testDNSQuestion(t *testing.T, host string, typ dnsmessage.Type) dnsmessage.Question {
+	t.Helper()
+	name, err := dnsmessage.NewName(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dnsmessage.Question{Name: name, Type: typ, Class: dnsmessage.ClassINET}
+}
+
+// 构造一个响应 问题为A时带上ip的记录
+func testDNSResponse(id uint16, q dnsmessage.Question, ip net.IP) []byte {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, Response: true},
+		Questions: []dnsmessage.Question{q},
+	}
+	if ip != nil && q.Type == dnsmessage.TypeA {
+		var a [4]byte
+		copy(a[:], ip.To4())
+		msg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: a},
+		}}
+	}
+	b, _ := msg.Pack()
+	return b
+}
+
+func TestDNSResponseMatches(t *testing.T) {
+	q := testDNSQuestion(t, "example.com.", dnsmessage.TypeA)
+	query, err := (&dnsmessage.Message{Header: dnsmessage.Header{ID: 7}, Questions: []dnsmessage.Question{q}}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		resp []byte
+		want bool
+	}{
+		{"match", testDNSResponse(7, q, nil), true},
+		{"name case", testDNSResponse(7, testDNSQuestion(t, "EXAMPLE.com.", dnsmessage.TypeA), nil), true},
+		{"id", testDNSResponse(8, q, nil), false},
+		{"name", testDNSResponse(7, testDNSQuestion(t, "evil.com.", dnsmessage.TypeA), nil), false},
+		{"type", testDNSResponse(7, testDNSQuestion(t, "example.com.", dnsmessage.TypeAAAA), nil), false},
+		{"not response", query, false},
+		{"garbage", []byte{0, 7, 0x80}, false},
+	}
+	for _, c := range cases {
+		if got := dnsResponseMatches(c.resp, 7, q); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// udp上先收到ID或问题不一致的伪造响应时忽略 使用之后一致的响应
+func TestResolverIgnoresSpoofedUDPResponses(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	evil := testDNSQuestion(t, "evil.com.", dnsmessage.TypeA).Name
+	go func() {
+		buf := make([]byte, dnsUDPSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			spoofed := q
+			spoofed.Name = evil
+			conn.WriteTo(testDNSResponse(h.ID+1, q, net.IPv4(10, 0, 0, 66)), addr)
+			conn.WriteTo(testDNSResponse(h.ID, spoofed, net.IPv4(10, 0, 0, 66)), addr)
+			conn.WriteTo(testDNSResponse(h.ID, q, net.IPv4(10, 0, 0, 1)), addr)
+		}
+	}()
+	r, err := NewResolver(DNSOptions{Servers: []string{conn.LocalAddr().String()}, CacheSize: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := r.Lookup(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.IPs) != 1 || !result.IPs[0].Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("got %v, want [10.0.0.1]", result.IPs)
+	}
+}
+
+func TestNewResolverInvalidOptions(t *testing.T) {
+	for _, opt := range []DNSOptions{
+		{Servers: []string{"quic://1.1.1.1"}},
+		{Hosts: map[string][]string{"example.com": {"not-an-ip"}}},
+	} {
+		if r, err := NewResolver(opt); err == nil || r != nil {
+			t.Errorf("%+v: got %v, %v", opt, r, err)
+		}
+	}
+}
@@ -0,0 +1,431 @@
+/*************************************************************************
+> File Name: reverse.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 03:47:10 星期二
+> Content: 反向代理 非代理请求按Host及路径转发到后端 经过与正向代理相同的中间件
+*************************************************************************/
+
+package gproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+var (
+	ErrReverseDisabled    = errors.New("reverse proxy is disabled")
+	ErrUnknownBalance     = errors.New("unknown load balancing strategy")
+	ErrNoReverseBackend   = errors.New("no reverse proxy backend")
+	defaultReverseTimeout = 10 * time.Second
+)
+
+// 负载均衡策略
+const (
+	// 轮询 默认
+	ReverseRoundRobin = "round_robin"
+	// 随机
+	ReverseRandom = "random"
+	// 按客户端ip选择 同一客户端固定使用同一后端
+	ReverseIPHash = "ip_hash"
+)
+
+// 反向代理的路由
+type ReverseRoute struct {
+	// 匹配的Host 支持*.example.com 为空时匹配全部
+	Host string `json:"host"`
+	// 匹配的路径前缀 如/api 匹配/api及/api/下的路径
+	PathPrefix string `json:"pathPrefix"`
+	// 转发前去掉路径前缀
+	StripPrefix bool `json:"stripPrefix"`
+	// 后端地址 如http://10.0.0.1:8080 可带路径前缀
+	Backends []string `json:"backends"`
+	Balance  string   `json:"balance"`
+	// 保持客户端请求的Host 默认使用后端的host
+	PreserveHost bool `json:"preserveHost"`
+}
+
+type ReverseCertificate struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+}
+
+type ReverseOptions struct {
+	Routes []ReverseRoute `json:"routes"`
+	// 终止TLS的监听地址 如:443 为空时只在代理的地址上接收http请求
+	TLSAddr string `json:"tlsAddr"`
+	// 按SNI选择证书 没有匹配时使用第一个
+	Certificates []ReverseCertificate `json:"certificates"`
+	// 后端连接失败后在该时间内不再被选择 默认10s
+	FailTimeout time.Duration `json:"failTimeout"`
+}
+
+// 从json文件加载反向代理配置
+func LoadReverseOptions(path string) (*ReverseOptions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	opt := &ReverseOptions{}
+	if err := json.Unmarshal(data, opt); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return opt, nil
+}
+
+// 路由及其后端的状态
+type ReverseRouteStatus struct {
+	ReverseRoute
+	Status []ReverseBackendStatus `json:"status"`
+}
+
+type ReverseBackendStatus struct {
+	URL      string `json:"url"`
+	Healthy  bool   `json:"healthy"`
+	Requests int64  `json:"requests"`
+	Failures int64  `json:"failures"`
+}
+
+type reverseProxy struct {
+	mu          sync.RWMutex
+	routes      []*reverseRoute
+	failTimeout time.Duration
+}
+
+type reverseRoute struct {
+	ReverseRoute
+	backends []*reverseBackend
+	next     atomic.Uint64
+}
+
+type reverseBackend struct {
+	url *url.URL
+	// 连接失败后不再选择的截止时间
+	downUntil atomic.Int64
+	requests  atomic.Int64
+	failures  atomic.Int64
+}
+
+type reverseTargetKey struct{}
+
+// 请求转发到的后端 保存在请求的context中
+type reverseTarget struct {
+	route   *reverseRoute
+	backend *reverseBackend
+	tried   []*reverseBackend
+	// 客户端请求的scheme、host及路径
+	scheme string
+	host   string
+	path   string
+	query  string
+}
+
+func newReverseProxy(opt ReverseOptions) (*reverseProxy, error) {
+	r := &reverseProxy{failTimeout: opt.FailTimeout}
+	if r.failTimeout <= 0 {
+		r.failTimeout = defaultReverseTimeout
+	}
+	if err := r.SetRoutes(opt.Routes); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// 替换全部路由
+func (r *reverseProxy) SetRoutes(routes []ReverseRoute) error {
+	compiled := make([]*reverseRoute, 0, len(routes))
+	for _, route := range routes {
+		switch route.Balance {
+		case "", ReverseRoundRobin, ReverseRandom, ReverseIPHash:
+		default:
+			return fmt.Errorf("%w: %q", ErrUnknownBalance, route.Balance)
+		}
+		if len(route.Backends) == 0 {
+			return fmt.Errorf("%w: %s%s", ErrNoReverseBackend, route.Host, route.PathPrefix)
+		}
+		rt := &reverseRoute{ReverseRoute: route}
+		for _, backend := range route.Backends {
+			u, err := url.Parse(backend)
+			if err != nil {
+				return err
+			}
+			if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+				return fmt.Errorf("invalid reverse proxy backend: %q", backend)
+			}
+			rt.backends = append(rt.backends, &reverseBackend{url: u})
+		}
+		compiled = append(compiled, rt)
+	}
+	r.mu.Lock()
+	r.routes = compiled
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *reverseProxy) Status() []ReverseRouteStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	now := time.Now().UnixNano()
+	routes := make([]ReverseRouteStatus, 0, len(r.routes))
+	for _, rt := range r.routes {
+		s := ReverseRouteStatus{ReverseRoute: rt.ReverseRoute}
+		for _, b := range rt.backends {
+			s.Status = append(s.Status, ReverseBackendStatus{
+				URL:      b.url.String(),
+				Healthy:  b.downUntil.Load() <= now,
+				Requests: b.requests.Load(),
+				Failures: b.failures.Load(),
+			})
+		}
+		routes = append(routes, s)
+	}
+	return routes
+}
+
+// 选择最具体的路由 精确的Host优先于通配 其次为更长的路径前缀
+func (r *reverseProxy) match(req *http.Request) *reverseRoute {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var (
+		best      *reverseRoute
+		bestScore = -1
+	)
+	for _, rt := range r.routes {
+		if !hostMatches(rt.Host, host) || !pathHasPrefix(req.URL.Path, rt.PathPrefix) {
+			continue
+		}
+		score := len(rt.PathPrefix)
+		if rt.Host != "" && rt.Host != "*" {
+			score += 1 << 20
+			if !strings.HasPrefix(rt.Host, "*.") {
+				score += 1 << 21
+			}
+		}
+		if score > bestScore {
+			best, bestScore = rt, score
+		}
+	}
+	return best
+}
+
+// 按路径段匹配前缀 /api匹配/api及/api/x 不匹配/apix
+func pathHasPrefix(path, prefix string) bool {
+	if prefix == "" || strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(path, prefix)
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// 选择后端 跳过已尝试及失败的后端 全部失败时仍从未尝试的后端中选择
+func (rt *reverseRoute) pick(req *http.Request, tried []*reverseBackend) *reverseBackend {
+	now := time.Now().UnixNano()
+	var healthy, untried []*reverseBackend
+	for _, b := range rt.backends {
+		if containsBackend(tried, b) {
+			continue
+		}
+		untried = append(untried, b)
+		if b.downUntil.Load() <= now {
+			healthy = append(healthy, b)
+		}
+	}
+	candidates := healthy
+	if len(candidates) == 0 {
+		candidates = untried
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	switch rt.Balance {
+	case ReverseRandom:
+		return candidates[rand.IntN(len(candidates))]
+	case ReverseIPHash:
+		h := fnv.New32a()
+		h.Write([]byte(clientIP(req)))
+		return candidates[h.Sum32()%uint32(len(candidates))]
+	}
+	return candidates[(rt.next.Add(1)-1)%uint64(len(candidates))]
+}
+
+func containsBackend(backends []*reverseBackend, b *reverseBackend) bool {
+	for _, v := range backends {
+		if v == b {
+			return true
+		}
+	}
+	return false
+}
+
+// 将请求改写为发往后端的绝对地址
+func (t *reverseTarget) use(req *http.Request, b *reverseBackend) {
+	t.backend = b
+	t.tried = append(t.tried, b)
+	b.requests.Add(1)
+	path := t.path
+	if t.route.StripPrefix {
+		path = "/" + strings.TrimPrefix(strings.TrimPrefix(path, t.route.PathPrefix), "/")
+	}
+	u := *b.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = ""
+	switch {
+	case u.RawQuery == "":
+		u.RawQuery = t.query
+	case t.query != "":
+		u.RawQuery += "&" + t.query
+	}
+	req.URL = &u
+	if !t.route.PreserveHost {
+		req.Host = u.Host
+	}
+}
+
+// 将后端返回的Location改写为客户端访问的地址
+func (t *reverseTarget) rewriteLocation(resp *http.Response) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return
+	}
+	u, err := url.Parse(location)
+	if err != nil || u.Host != t.backend.url.Host {
+		return
+	}
+	u.Scheme, u.Host = t.scheme, t.host
+	u.Path = strings.TrimPrefix(u.Path, strings.TrimSuffix(t.backend.url.Path, "/"))
+	if t.route.StripPrefix {
+		u.Path = strings.TrimSuffix(t.route.PathPrefix, "/") + "/" + strings.TrimPrefix(u.Path, "/")
+	}
+	u.RawPath = ""
+	resp.Header.Set("Location", u.String())
+}
+
+// 按路由转发非代理请求 没有匹配的路由时返回false
+func (p *SimpleProxyServer) serveReverse(w http.ResponseWriter, r *http.Request) bool {
+	route := p.reverse.match(r)
+	if route == nil {
+		return false
+	}
+	t := &reverseTarget{route: route, scheme: "http", host: r.Host, path: r.URL.Path, query: r.URL.RawQuery}
+	if r.TLS != nil {
+		t.scheme = "https"
+	}
+	b := route.pick(r, nil)
+	if b == nil {
+		http.Error(w, ErrNoReverseBackend.Error(), http.StatusBadGateway)
+		return true
+	}
+	if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+		r.Header.Set("X-Forwarded-For", prior+", "+clientIP(r))
+	} else {
+		r.Header.Set("X-Forwarded-For", clientIP(r))
+	}
+	r.Header.Set("X-Forwarded-Host", r.Host)
+	r.Header.Set("X-Forwarded-Proto", t.scheme)
+	r = r.WithContext(context.WithValue(r.Context(), reverseTargetKey{}, t))
+	t.use(r, b)
+	p.proxy.ServeHTTP(w, r)
+	return true
+}
+
+// 反向代理TLS地址的处理 只转发匹配路由的请求 没有匹配的路由时返回404
+// 该地址面向公网 拒绝CONNECT及绝对URI的请求 不作为正向代理使用
+func (p *SimpleProxyServer) serveReverseOnly(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect || r.URL.IsAbs() {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	pw := &proxyResponseWriter{ResponseWriter: w}
+	r = r.WithContext(context.WithValue(r.Context(), responseWriterKey{}, pw))
+	if !p.serveReverse(pw, r) {
+		http.NotFound(w, r)
+		return
+	}
+	pw.writeTrailers()
+}
+
+// 在所有中间件之前处理后端的响应
+// 后端连接失败时标记该后端 没有请求体的请求换一个后端重试 均失败时返回502
+func (p *SimpleProxyServer) reverseResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if ctx.Req == nil {
+		return resp
+	}
+	t, ok := ctx.Req.Context().Value(reverseTargetKey{}).(*reverseTarget)
+	if !ok {
+		return resp
+	}
+	if resp == nil && ctx.Error != nil {
+		t.backend.failures.Add(1)
+		t.backend.downUntil.Store(time.Now().Add(p.reverse.failTimeout).UnixNano())
+		for ctx.Req.Body == nil || ctx.Req.Body == http.NoBody {
+			b := t.route.pick(ctx.Req, t.tried)
+			if b == nil {
+				break
+			}
+			ctx.Warnf("Retry %s on %s: %v", t.path, b.url, ctx.Error)
+			t.use(ctx.Req, b)
+			r, err := ctx.RoundTrip(ctx.Req)
+			if err == nil {
+				resp, ctx.Error = r, nil
+				break
+			}
+			ctx.Error = err
+			b.failures.Add(1)
+			b.downUntil.Store(time.Now().Add(p.reverse.failTimeout).UnixNano())
+		}
+		if resp == nil {
+			if errResp := upstreamTLSErrorResponse(ctx.Req, ctx.Error); errResp != nil {
+				return errResp
+			}
+			return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway, ctx.Error.Error())
+		}
+	}
+	if resp != nil {
+		t.rewriteLocation(resp)
+	}
+	return resp
+}
+
+// 使用配置的证书终止TLS 请求与代理地址上的非代理请求同样按路由转发
+func (p *SimpleProxyServer) serveReverseTLS() {
+	config := &tls.Config{}
+	for _, c := range p.Reverse.Certificates {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			p.Logger.WithField("err", err.Error()).Error("Failed To Load Reverse Proxy Certificate")
+			return
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	server := &http.Server{
+		Addr:        p.Reverse.TLSAddr,
+		Handler:     http.HandlerFunc(p.serveReverseOnly),
+		TLSConfig:   config,
+		ReadTimeout: 10 * time.Second,
+		// 与代理地址一致 长度未知的响应在写入时延长
+		WriteTimeout: defaultWriteTimeout,
+		IdleTimeout:  30 * time.Second,
+	}
+	p.Logger.Infof("Starting Reverse Proxy On %s", p.Reverse.TLSAddr)
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		p.Logger.WithField("err", err.Error()).Error("Start Reverse Proxy Failed!")
+	}
+}
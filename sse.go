@@ -0,0 +1,217 @@
+/*************************************************************************
+> File Name: sse.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 03:12:26 星期二
+> Content: 按事件转发text/event-stream响应 供中间件观察、修改或丢弃单个事件
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// 超过该大小的事件原样转发 之后的数据不再按事件拆分
+var maxServerSentEventSize = 1 << 20
+
+// 一个SSE事件 data有多行时以\n连接
+type ServerSentEvent struct {
+	ID    string `json:"id,omitempty"`
+	Event string `json:"event,omitempty"`
+	Data  string `json:"data"`
+	Retry string `json:"retry,omitempty"`
+	// 注释行 不含开头的冒号
+	Comments []string `json:"comments,omitempty"`
+}
+
+// 需要处理SSE事件的中间件可实现该接口 只含注释的心跳不经过中间件
+// 返回修改后的事件 drop为true时丢弃该事件
+type EventStreamMiddleware interface {
+	OnEvent(event *ServerSentEvent, ctx *goproxy.ProxyCtx) (*ServerSentEvent, bool)
+}
+
+// 是否为SSE响应
+func isEventStream(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// 编码为event-stream格式 以空行结尾
+func (e *ServerSentEvent) Bytes() []byte {
+	var b bytes.Buffer
+	for _, c := range e.Comments {
+		b.WriteString(":" + c + "\n")
+	}
+	if e.ID != "" {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Event != "" {
+		b.WriteString("event: " + e.Event + "\n")
+	}
+	if e.Retry != "" {
+		b.WriteString("retry: " + e.Retry + "\n")
+	}
+	for _, line := range strings.Split(e.Data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return b.Bytes()
+}
+
+// 解析一个事件 只含注释或空行时dispatch为false
+func parseServerSentEvent(raw []byte) (e *ServerSentEvent, dispatch bool) {
+	e = &ServerSentEvent{}
+	var data []string
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		if comment, ok := strings.CutPrefix(line, ":"); ok {
+			e.Comments = append(e.Comments, comment)
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch name {
+		case "id":
+			e.ID = value
+		case "event":
+			e.Event = value
+		case "data":
+			data = append(data, value)
+		case "retry":
+			e.Retry = value
+		default:
+			continue
+		}
+		dispatch = true
+	}
+	e.Data = strings.Join(data, "\n")
+	return e, dispatch
+}
+
+// 实现了EventStreamMiddleware的中间件
+func (p *SimpleProxyServer) eventStreamMiddlewares() []EventStreamMiddleware {
+	var hooks []EventStreamMiddleware
+	for _, m := range p.middlewares {
+		if em, ok := m.(EventStreamMiddleware); ok {
+			hooks = append(hooks, em)
+		}
+	}
+	return hooks
+}
+
+// 有中间件或开启抓包时按事件拆分响应 压缩的响应直接转发
+func (p *SimpleProxyServer) filterEventStream(resp *http.Response, flow *Flow, ctx *goproxy.ProxyCtx) {
+	hooks := p.eventStreamMiddlewares()
+	if resp.Body == nil || resp.Body == http.NoBody || len(hooks) == 0 && flow == nil {
+		return
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return
+	}
+	resp.Body = &eventStreamBody{
+		ReadCloser: resp.Body,
+		r:          bufio.NewReader(resp.Body),
+		p:          p,
+		ctx:        ctx,
+		hooks:      hooks,
+		flow:       flow,
+	}
+}
+
+// 逐个读取事件的body 行尾为\n或\r\n
+type eventStreamBody struct {
+	io.ReadCloser
+	r     *bufio.Reader
+	p     *SimpleProxyServer
+	ctx   *goproxy.ProxyCtx
+	hooks []EventStreamMiddleware
+	flow  *Flow
+	// 待返回的数据
+	buf []byte
+	err error
+	// 遇到过大的事件后直接转发
+	passthrough bool
+}
+
+func (b *eventStreamBody) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		if b.passthrough {
+			return b.r.Read(p)
+		}
+		b.buf, b.err = b.next()
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+// 读取到空行为止 返回转发的数据 事件被丢弃时为空 不完整的事件原样转发
+func (b *eventStreamBody) next() ([]byte, error) {
+	var raw []byte
+	for {
+		line, err := b.r.ReadSlice('\n')
+		raw = append(raw, line...)
+		if len(raw) > maxServerSentEventSize {
+			b.passthrough = true
+			return raw, nil
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			return raw, err
+		}
+		if len(line) == 1 || len(line) == 2 && line[0] == '\r' {
+			break
+		}
+	}
+	event, dispatch := parseServerSentEvent(raw)
+	if !dispatch {
+		return raw, nil
+	}
+	original := event.Bytes()
+	for _, hook := range b.hooks {
+		var drop bool
+		if event, drop = hook.OnEvent(event, b.ctx); drop || event == nil {
+			b.record(event, true)
+			return nil, nil
+		}
+	}
+	b.record(event, false)
+	if modified := event.Bytes(); !bytes.Equal(modified, original) {
+		return modified, nil
+	}
+	return raw, nil
+}
+
+func (b *eventStreamBody) record(event *ServerSentEvent, dropped bool) {
+	if b.flow == nil || event == nil {
+		return
+	}
+	data, _ := json.Marshal(event)
+	b.p.flows.addMessage(b.flow, &FlowMessage{
+		Time:      time.Now(),
+		Direction: WebSocketDownstream,
+		Payload:   []byte(event.Data),
+		Size:      int64(len(event.Data)),
+		Dropped:   dropped,
+		JSON:      data,
+	})
+}
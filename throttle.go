@@ -0,0 +1,403 @@
+/*************************************************************************
+> File Name: throttle.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-19 18:03:29 星期一
+> Content: 带宽限制及弱网模拟 同时作用于MITM的请求与CONNECT隧道
+*************************************************************************/
+
+package gproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// 限速的范围
+const (
+	// 所有流量共享带宽
+	ThrottleGlobal = "global"
+	// 每个客户端ip独享带宽
+	ThrottlePerClient = "client"
+	// 每个目标域名独享带宽
+	ThrottlePerHost = "host"
+)
+
+// 网络状况 带宽单位为字节每秒 0表示不限制
+type NetworkProfile struct {
+	Name string `json:"name"`
+	// 每个请求或连接增加的往返延迟
+	Latency       time.Duration `json:"latency"`
+	DownloadBytes int64         `json:"downloadBytes"`
+	UploadBytes   int64         `json:"uploadBytes"`
+	// 每次传输数据时发生停顿的概率及停顿时长 用于模拟丢包重传
+	StallProbability float64       `json:"stallProbability"`
+	StallDuration    time.Duration `json:"stallDuration"`
+}
+
+// 预置的网络状况
+var (
+	Profile3G = NetworkProfile{
+		Name:          "3g",
+		Latency:       300 * time.Millisecond,
+		DownloadBytes: 780 * 1000 / 8,
+		UploadBytes:   330 * 1000 / 8,
+	}
+	ProfileSlow4G = NetworkProfile{
+		Name:          "slow-4g",
+		Latency:       150 * time.Millisecond,
+		DownloadBytes: 1600 * 1000 / 8,
+		UploadBytes:   750 * 1000 / 8,
+	}
+	ProfileSatellite = NetworkProfile{
+		Name:             "satellite",
+		Latency:          600 * time.Millisecond,
+		DownloadBytes:    10 * 1000 * 1000 / 8,
+		UploadBytes:      2 * 1000 * 1000 / 8,
+		StallProbability: 0.01,
+		StallDuration:    time.Second,
+	}
+	NetworkProfiles = map[string]NetworkProfile{
+		Profile3G.Name:        Profile3G,
+		ProfileSlow4G.Name:    ProfileSlow4G,
+		ProfileSatellite.Name: ProfileSatellite,
+	}
+	ErrUnknownThrottleScope = errors.New("unknown throttle scope")
+	// 超过该时长未传输数据的带宽被清理 按客户端或域名限速时避免无限增长
+	throttleLinkIdle = time.Minute
+)
+
+// 令牌桶 令牌可以透支 透支的部分需要等待补充
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// 取出n个令牌 返回需要等待的时间
+func (b *tokenBucket) reserve(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// 令牌足够时取出n个令牌
+func (b *tokenBucket) allow(n float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// 一个限速范围内的上下行带宽
+type throttleLink struct {
+	profile  NetworkProfile
+	download *tokenBucket
+	upload   *tokenBucket
+	// 最后一次使用的时间(UnixNano)
+	lastUsed atomic.Int64
+}
+
+func newThrottleLink(profile NetworkProfile) *throttleLink {
+	l := &throttleLink{profile: profile}
+	l.lastUsed.Store(time.Now().UnixNano())
+	if profile.DownloadBytes > 0 {
+		// 允许突发十分之一秒的流量
+		l.download = newTokenBucket(float64(profile.DownloadBytes), float64(profile.DownloadBytes)/10)
+	}
+	if profile.UploadBytes > 0 {
+		l.upload = newTokenBucket(float64(profile.UploadBytes), float64(profile.UploadBytes)/10)
+	}
+	return l
+}
+
+// 每次读写的最大字节数 使流量更平滑
+func (l *throttleLink) chunk(b *tokenBucket) int {
+	if b == nil {
+		return 32 * 1024
+	}
+	return max(int(b.burst), 512)
+}
+
+// 传输n个字节前需要等待的时间
+func (l *throttleLink) delay(b *tokenBucket, n int) time.Duration {
+	l.lastUsed.Store(time.Now().UnixNano())
+	var d time.Duration
+	if b != nil {
+		d = b.reserve(float64(n))
+	}
+	if l.profile.StallProbability > 0 && rand.Float64() < l.profile.StallProbability {
+		d += l.profile.StallDuration
+	}
+	return d
+}
+
+// 带宽限制中间件
+type ThrottleMiddleware struct {
+	mu      sync.Mutex
+	profile NetworkProfile
+	scope   string
+	// 只对匹配的域名限速 为空时作用于全部
+	hosts []string
+	links map[string]*throttleLink
+	// 上次清理空闲带宽的时间
+	lastCleanup time.Time
+}
+
+func NewThrottleMiddleware(profile NetworkProfile, scope string, hosts ...string) (*ThrottleMiddleware, error) {
+	m := &ThrottleMiddleware{hosts: hosts}
+	if err := m.SetProfile(profile, scope); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// 运行时切换网络状况 已建立的隧道沿用原来的配置
+func (m *ThrottleMiddleware) SetProfile(profile NetworkProfile, scope string) error {
+	if scope == "" {
+		scope = ThrottleGlobal
+	}
+	if scope != ThrottleGlobal && scope != ThrottlePerClient && scope != ThrottlePerHost {
+		return ErrUnknownThrottleScope
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.profile, m.scope = profile, scope
+	m.links = make(map[string]*throttleLink)
+	return nil
+}
+
+func (m *ThrottleMiddleware) Profile() (NetworkProfile, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.profile, m.scope
+}
+
+func (m *ThrottleMiddleware) matchHost(host string) bool {
+	if len(m.hosts) == 0 {
+		return true
+	}
+	for _, h := range m.hosts {
+		if hostMatches(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// 获取请求所属范围的带宽
+func (m *ThrottleMiddleware) link(req *http.Request) *throttleLink {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var key string
+	switch m.scope {
+	case ThrottlePerClient:
+		key = clientIP(req)
+	case ThrottlePerHost:
+		key = req.URL.Hostname()
+	}
+	l, ok := m.links[key]
+	if !ok {
+		if now := time.Now(); now.Sub(m.lastCleanup) >= throttleLinkIdle {
+			m.cleanup(now)
+			m.lastCleanup = now
+		}
+		l = newThrottleLink(m.profile)
+		m.links[key] = l
+	}
+	l.lastUsed.Store(time.Now().UnixNano())
+	return l
+}
+
+// 清理空闲的带宽 调用时需持有锁 仍在使用的连接持有原来的带宽不受影响
+func (m *ThrottleMiddleware) cleanup(now time.Time) {
+	for key, l := range m.links {
+		if now.Sub(time.Unix(0, l.lastUsed.Load())) >= throttleLinkIdle {
+			delete(m.links, key)
+		}
+	}
+}
+
+// 请求的客户端ip
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func (m *ThrottleMiddleware) RequestCondition(req *http.Request, _ *goproxy.ProxyCtx) bool {
+	return req.URL != nil && m.matchHost(req.URL.Hostname())
+}
+
+func (m *ThrottleMiddleware) OnRequest(req *http.Request, _ *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	l := m.link(req)
+	if l.profile.Latency > 0 {
+		extendWriteDeadline(req, l.profile.Latency)
+		select {
+		case <-time.After(l.profile.Latency):
+		case <-req.Context().Done():
+		}
+	}
+	if req.Body != nil && req.Body != http.NoBody && l.upload != nil {
+		req.Body = &throttledBody{ReadCloser: req.Body, link: l, bucket: l.upload}
+	}
+	return req, nil
+}
+
+func (m *ThrottleMiddleware) ResponseCondition(resp *http.Response, ctx *goproxy.ProxyCtx) bool {
+	return resp != nil && resp.Body != nil && ctx.Req != nil && m.RequestCondition(ctx.Req, ctx)
+}
+
+func (m *ThrottleMiddleware) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	l := m.link(ctx.Req)
+	if l.download != nil || l.profile.StallProbability > 0 {
+		resp.Body = &throttledBody{ReadCloser: resp.Body, link: l, bucket: l.download, req: ctx.Req}
+	}
+	return resp
+}
+
+// 包装CONNECT隧道的连接
+func (m *ThrottleMiddleware) WrapConn(conn net.Conn, req *http.Request) net.Conn {
+	if !m.matchHost(req.URL.Hostname()) {
+		return conn
+	}
+	l := m.link(req)
+	if l.profile.Latency > 0 {
+		time.Sleep(l.profile.Latency)
+	}
+	return &throttledConn{Conn: conn, link: l}
+}
+
+// 注册限速相关的管理接口
+func (m *ThrottleMiddleware) RegisterAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/throttle", func(w http.ResponseWriter, _ *http.Request) {
+		profile, scope := m.Profile()
+		writeJSON(w, map[string]interface{}{"profile": profile, "scope": scope}, http.StatusOK)
+	})
+	// 请求体为{"profile": {...}, "scope": "client"} profile只有name时使用预置的网络状况
+	mux.HandleFunc("PUT /admin/throttle", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Profile NetworkProfile `json:"profile"`
+			Scope   string         `json:"scope"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		if preset, ok := NetworkProfiles[body.Profile.Name]; ok && body.Profile == (NetworkProfile{Name: body.Profile.Name}) {
+			body.Profile = preset
+		}
+		if err := m.SetProfile(body.Profile, body.Scope); err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// 限速的body
+type throttledBody struct {
+	io.ReadCloser
+	link   *throttleLink
+	bucket *tokenBucket
+	// 响应体所属的请求 用于延长写超时
+	req *http.Request
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if chunk := b.link.chunk(b.bucket); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if d := b.link.delay(b.bucket, n); d > 0 {
+			if b.req != nil {
+				extendWriteDeadline(b.req, d)
+			}
+			time.Sleep(d)
+		}
+	}
+	return n, err
+}
+
+// 限速的隧道连接
+type throttledConn struct {
+	net.Conn
+	link *throttleLink
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	if chunk := c.link.chunk(c.link.download); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		time.Sleep(c.link.delay(c.link.download, n))
+	}
+	return n, err
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	var written int
+	chunk := c.link.chunk(c.link.upload)
+	for len(p) > 0 {
+		n := min(len(p), chunk)
+		time.Sleep(c.link.delay(c.link.upload, n))
+		n, err := c.Conn.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// goproxy在双方都支持半关闭时使用CloseWrite/CloseRead
+func (c *throttledConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+func (c *throttledConn) CloseRead() error {
+	if hc, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return hc.CloseRead()
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+/*************************************************************************
+> File Name: transparent.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 04:25:37 星期二
+> Content: 透明代理 接收iptables重定向的连接 TLS按SNI、http按Host转发 经过与代理请求相同的中间件及MITM
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrOriginalDstUnsupported = errors.New("original destination is not supported on this platform")
+	// 等待客户端发送数据的时间 超时后按原始目标地址直接转发(如服务端先发送数据的协议)
+	transparentSniffTimeout = 3 * time.Second
+	errClientHelloRead      = errors.New("client hello read")
+	// 判断是否为http请求的方法前缀
+	httpMethodPrefixes = []string{"GET ", "POST", "PUT ", "HEAD", "DELE", "OPTI", "PATC", "TRAC", "CONN"}
+)
+
+// 接收透明代理的连接
+func (p *SimpleProxyServer) serveTransparent() {
+	l, err := listenTransparent(p.TransparentAddr, p.TransparentTProxy)
+	if err != nil {
+		p.Logger.WithField("err", err.Error()).Error("Start Transparent Proxy Failed!")
+		return
+	}
+	p.Logger.Infof("Starting Transparent Proxy On %s", p.TransparentAddr)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			p.Logger.WithField("err", err.Error()).Warn("Transparent Proxy Accept Failed")
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go p.handleTransparent(conn)
+	}
+}
+
+// 连接的原始目标地址 获取失败或目标为透明代理自身时返回nil 此时只按SNI或Host转发
+func (p *SimpleProxyServer) transparentDst(conn net.Conn) *net.TCPAddr {
+	getDst := p.OriginalDst
+	if getDst == nil {
+		getDst = func(conn net.Conn) (*net.TCPAddr, error) {
+			return originalDst(conn, p.TransparentTProxy)
+		}
+	}
+	dst, err := getDst(conn)
+	if err != nil {
+		return nil
+	}
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && !p.TransparentTProxy && local.IP.Equal(dst.IP) && local.Port == dst.Port {
+		return nil
+	}
+	return dst
+}
+
+func (p *SimpleProxyServer) handleTransparent(conn net.Conn) {
+	dst := p.transparentDst(conn)
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(transparentSniffTimeout))
+	first, err := br.Peek(1)
+	if err != nil {
+		conn.SetReadDeadline(time.Time{})
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() && dst != nil {
+			p.transparentConnect(conn, br, dst.String())
+			return
+		}
+		conn.Close()
+		return
+	}
+	switch {
+	case first[0] == 0x16:
+		sni, hello, err := readClientHello(br)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			p.Logger.WithField("err", err.Error()).Debug("Cannot Read Client Hello")
+		}
+		host := ""
+		if dst != nil {
+			host = dst.String()
+		}
+		if sni != "" {
+			port := "443"
+			if dst != nil {
+				port = strconv.Itoa(dst.Port)
+			}
+			host = net.JoinHostPort(sni, port)
+		}
+		if host == "" {
+			conn.Close()
+			return
+		}
+		p.transparentConnect(conn, io.MultiReader(bytes.NewReader(hello), br), host)
+	case isHTTPRequest(br):
+		conn.SetReadDeadline(time.Time{})
+		remoteAddr := conn.RemoteAddr().String()
+		p.serveConn(context.Background(), &bufferedConn{Conn: conn, r: br}, func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = transparentHost(r.Host, dst)
+			r.RemoteAddr = remoteAddr
+		})
+	case dst != nil:
+		conn.SetReadDeadline(time.Time{})
+		p.transparentConnect(conn, br, dst.String())
+	default:
+		conn.Close()
+	}
+}
+
+// http请求的目标 Host中没有端口时使用原始目标的端口
+func transparentHost(host string, dst *net.TCPAddr) string {
+	if host == "" {
+		if dst == nil {
+			return ""
+		}
+		return dst.String()
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil && dst != nil && dst.Port != 80 {
+		return net.JoinHostPort(host, strconv.Itoa(dst.Port))
+	}
+	return host
+}
+
+func isHTTPRequest(br *bufio.Reader) bool {
+	n := br.Buffered()
+	if n > 4 {
+		n = 4
+	}
+	b, _ := br.Peek(n)
+	for _, prefix := range httpMethodPrefixes {
+		if len(b) > 0 && prefix[:len(b)] == string(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// 读取ClientHello中的SNI 返回已读取的数据 用于转发给上游或MITM
+func readClientHello(r io.Reader) (string, []byte, error) {
+	var (
+		buf bytes.Buffer
+		sni string
+	)
+	err := tls.Server(&sniffConn{r: io.TeeReader(r, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if errors.Is(err, errClientHelloRead) {
+		err = nil
+	}
+	return sni, buf.Bytes(), err
+}
+
+// 只读的连接 用于解析ClientHello
+type sniffConn struct {
+	r io.Reader
+}
+
+func (c *sniffConn) Read(b []byte) (int, error)       { return c.r.Read(b) }
+func (c *sniffConn) Write(b []byte) (int, error)      { return 0, io.ErrClosedPipe }
+func (c *sniffConn) Close() error                     { return nil }
+func (c *sniffConn) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (c *sniffConn) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+func (c *sniffConn) SetDeadline(time.Time) error      { return nil }
+func (c *sniffConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *sniffConn) SetWriteDeadline(time.Time) error { return nil }
+
+// 以CONNECT请求交给goproxy 与代理的CONNECT请求一样经过ConnectMiddleware及MITM
+func (p *SimpleProxyServer) transparentConnect(conn net.Conn, r io.Reader, host string) {
+	client := &transparentConn{Conn: conn, r: r}
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: host},
+		Host:       host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	p.serveHTTP(&transparentResponseWriter{conn: client, header: make(http.Header)}, req)
+}
+
+// 透明代理的客户端连接 丢弃写给客户端的CONNECT响应 响应不是200时丢弃之后的全部数据
+type transparentConn struct {
+	net.Conn
+	r           io.Reader
+	header      []byte
+	established bool
+	rejected    bool
+}
+
+func (c *transparentConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *transparentConn) Write(b []byte) (int, error) {
+	switch {
+	case c.established:
+		return c.Conn.Write(b)
+	case c.rejected:
+		return len(b), nil
+	}
+	c.header = append(c.header, b...)
+	i := bytes.Index(c.header, []byte("\r\n\r\n"))
+	if i < 0 {
+		return len(b), nil
+	}
+	if !bytes.HasPrefix(c.header, []byte("HTTP/1.0 200")) && !bytes.HasPrefix(c.header, []byte("HTTP/1.1 200")) {
+		c.rejected = true
+		return len(b), nil
+	}
+	c.established = true
+	if rest := c.header[i+4:]; len(rest) > 0 {
+		if _, err := c.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	c.header = nil
+	return len(b), nil
+}
+
+// 交给goproxy处理CONNECT请求的ResponseWriter
+type transparentResponseWriter struct {
+	conn   *transparentConn
+	header http.Header
+}
+
+func (w *transparentResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *transparentResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *transparentResponseWriter) WriteHeader(int) {}
+
+func (w *transparentResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
@@ -0,0 +1,84 @@
+//go:build linux
+
+/*************************************************************************
+> File Name: transparent_linux.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 04:41:02 星期二
+> Content: linux上通过SO_ORIGINAL_DST或TPROXY获取透明代理连接的原始目标地址
+*************************************************************************/
+
+package gproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// netfilter中的SO_ORIGINAL_DST及IP6T_SO_ORIGINAL_DST
+const soOriginalDst = 80
+
+// REDIRECT时通过SO_ORIGINAL_DST获取 TPROXY时连接的本地地址即为原始目标地址
+func originalDst(conn net.Conn, tproxy bool) (*net.TCPAddr, error) {
+	if tproxy {
+		if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			return addr, nil
+		}
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("not a tcp connection")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	var (
+		addr *net.TCPAddr
+		serr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		if local != nil && local.IP.To4() == nil {
+			var info *syscall.IPv6MTUInfo
+			if info, serr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst); serr == nil {
+				// Port按网络字节序存放
+				var port [2]byte
+				binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+				addr = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(binary.BigEndian.Uint16(port[:]))}
+			}
+			return
+		}
+		var mreq *syscall.IPv6Mreq
+		// 返回的是sockaddr_in 端口及地址为网络字节序
+		if mreq, serr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst); serr == nil {
+			b := mreq.Multiaddr
+			addr = &net.TCPAddr{IP: net.IPv4(b[4], b[5], b[6], b[7]), Port: int(b[2])<<8 | int(b[3])}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, serr
+}
+
+// TPROXY需要在监听的socket上设置IP_TRANSPARENT
+func listenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if tproxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
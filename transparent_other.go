@@ -0,0 +1,31 @@
+//go:build !linux
+
+/*************************************************************************
+> File Name: transparent_other.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 04:43:18 星期二
+> Content: 非linux平台不支持获取原始目标地址 只按SNI或Host转发
+*************************************************************************/
+
+package gproxy
+
+import (
+	"net"
+)
+
+func originalDst(conn net.Conn, tproxy bool) (*net.TCPAddr, error) {
+	if tproxy {
+		if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			return addr, nil
+		}
+	}
+	return nil, ErrOriginalDstUnsupported
+}
+
+func listenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	if tproxy {
+		return nil, ErrOriginalDstUnsupported
+	}
+	return net.Listen("tcp", addr)
+}
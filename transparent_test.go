@@ -0,0 +1,206 @@
+/*************************************************************************
+> File Name: transparent_test.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 22:51:33 星期二
+> Content: 测试透明代理按SNI及Host转发 原始目标地址由OriginalDst提供
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 启动透明代理 原始目标地址为dst中的值 为nil时视为无法获取
+func startTransparentProxy(t *testing.T, mitm bool, dst *atomic.Pointer[net.TCPAddr]) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	p := NewSimpleProxy(&ProxyOptions{
+		Addr:            "127.0.0.1:0",
+		HttpsMitm:       mitm,
+		TransparentAddr: addr,
+		OriginalDst: func(net.Conn) (*net.TCPAddr, error) {
+			if d := dst.Load(); d != nil {
+				return d, nil
+			}
+			return nil, ErrOriginalDstUnsupported
+		},
+	})
+	go p.ListenAndServe()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 与本机地址端口相同但不可达的原始目标 用于确认按SNI或Host而不是原始目标转发
+func unreachableDst(t *testing.T, addr string) *net.TCPAddr {
+	t.Helper()
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: a.Port}
+}
+
+func TestTransparentSNI(t *testing.T) {
+	up := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "tls %s", r.URL.Path)
+	}))
+	defer up.Close()
+	for _, mitm := range []bool{false, true} {
+		var dst atomic.Pointer[net.TCPAddr]
+		addr := startTransparentProxy(t, mitm, &dst)
+		// 目标的端口取自原始目标地址 主机取自SNI
+		dst.Store(unreachableDst(t, up.Listener.Addr().String()))
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("mitm=%v: %v", mitm, err)
+		}
+		fmt.Fprint(conn, "GET /sni HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("mitm=%v: %v", mitm, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		conn.Close()
+		if string(body) != "tls /sni" {
+			t.Errorf("mitm=%v: got %q", mitm, body)
+		}
+		// MITM时由代理签发证书 否则为上游的证书
+		issuer := conn.ConnectionState().PeerCertificates[0].Issuer.CommonName
+		if upstream := up.Certificate().Issuer.CommonName; (issuer == upstream) == mitm {
+			t.Errorf("mitm=%v: certificate issued by %q", mitm, issuer)
+		}
+	}
+}
+
+func TestTransparentHost(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "http %s %s", r.Host, r.URL.Path)
+	}))
+	defer up.Close()
+	var dst atomic.Pointer[net.TCPAddr]
+	addr := startTransparentProxy(t, false, &dst)
+	dst.Store(unreachableDst(t, up.Listener.Addr().String()))
+	_, port, _ := net.SplitHostPort(up.Listener.Addr().String())
+	// Host中没有端口时使用原始目标的端口 转发时保持客户端的Host
+	for _, host := range []string{"localhost", "localhost:" + port, "127.0.0.1:" + port, "[::ffff:127.0.0.1]:" + port} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "GET /host HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", host)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", host, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		conn.Close()
+		if want := "http " + host + " /host"; string(body) != want {
+			t.Errorf("%s: got %q, want %q", host, body, want)
+		}
+	}
+}
+
+// 既不是TLS也不是http时按原始目标地址直接转发
+func TestTransparentRawTunnel(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	var dst atomic.Pointer[net.TCPAddr]
+	addr := startTransparentProxy(t, false, &dst)
+	dst.Store(l.Addr().(*net.TCPAddr))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "SSH-2.0-test\r\n")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "SSH-2.0-test\r\n" {
+		t.Errorf("got %q, %v", line, err)
+	}
+}
+
+func TestTransparentHostPort(t *testing.T) {
+	dst := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8080}
+	cases := []struct {
+		host string
+		dst  *net.TCPAddr
+		want string
+	}{
+		{"example.com", dst, "example.com:8080"},
+		{"example.com:9090", dst, "example.com:9090"},
+		{"example.com", &net.TCPAddr{IP: dst.IP, Port: 80}, "example.com"},
+		{"example.com", nil, "example.com"},
+		{"", dst, "10.0.0.1:8080"},
+		{"", nil, ""},
+	}
+	for _, c := range cases {
+		if got := transparentHost(c.host, c.dst); got != c.want {
+			t.Errorf("transparentHost(%q, %v) = %q, want %q", c.host, c.dst, got, c.want)
+		}
+	}
+}
+
+func TestReadClientHello(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: "sni.example.com", InsecureSkipVerify: true}).Handshake()
+		client.Close()
+	}()
+	defer server.Close()
+	sni, hello, err := readClientHello(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sni != "sni.example.com" {
+		t.Errorf("sni: got %q", sni)
+	}
+	// 返回的数据为完整的ClientHello记录 可原样转发
+	if len(hello) < 5 || hello[0] != 0x16 || int(hello[3])<<8|int(hello[4]) != len(hello)-5 {
+		t.Errorf("hello: got %d bytes", len(hello))
+	}
+	if _, _, err := readClientHello(strings.NewReader("\x16\x03\x01\x00")); err == nil {
+		t.Error("expected an error for a truncated client hello")
+	}
+}
@@ -0,0 +1,245 @@
+/*************************************************************************
+> File Name: upstreamtls.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 06:02:45 星期二
+> Content: 按主机配置与上游建立TLS连接的策略 根证书、跳过验证、TLS版本、加密套件、SNI及客户端证书
+*************************************************************************/
+
+package gproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+var (
+	ErrUnknownTLSVersion  = errors.New("unknown tls version")
+	ErrUnknownCipherSuite = errors.New("unknown cipher suite")
+	ErrInvalidRootCA      = errors.New("no certificate found in root ca file")
+	// 可配置的最低TLS版本
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+)
+
+// 与上游建立TLS连接的策略
+type UpstreamTLSPolicy struct {
+	// 匹配的主机 支持*.example.com 为空时匹配全部主机
+	Hosts []string `json:"hosts"`
+	// 信任的根证书(PEM) 在系统根证书之外额外信任
+	RootCAFiles []string `json:"rootCAFiles"`
+	// 只信任RootCAFiles 不使用系统根证书
+	NoSystemRoots bool `json:"noSystemRoots"`
+	// 不验证上游的证书
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+	// 最低TLS版本 1.0、1.1、1.2或1.3 默认为1.2
+	MinVersion string `json:"minVersion"`
+	// 允许的加密套件 如TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 只作用于TLS1.2及以下
+	CipherSuites []string `json:"cipherSuites"`
+	// 握手时使用的SNI 同时用于验证证书 为空时使用请求的主机
+	ServerName string `json:"serverName"`
+	// 向上游提供的客户端证书(mTLS)
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+}
+
+type UpstreamTLSOptions struct {
+	// 按顺序匹配 没有匹配的主机使用系统根证书验证
+	Policies []UpstreamTLSPolicy `json:"policies"`
+}
+
+// 从json文件加载上游TLS的策略
+func LoadUpstreamTLSOptions(path string) (*UpstreamTLSOptions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	opt := &UpstreamTLSOptions{}
+	if err := json.Unmarshal(data, opt); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return opt, nil
+}
+
+type upstreamTLS struct {
+	policies []*upstreamTLSPolicy
+	// 没有匹配的策略时使用
+	fallback *tls.Config
+}
+
+type upstreamTLSPolicy struct {
+	UpstreamTLSPolicy
+	config *tls.Config
+}
+
+func newUpstreamTLS(opt UpstreamTLSOptions) (*upstreamTLS, error) {
+	u := &upstreamTLS{fallback: &tls.Config{}}
+	for _, policy := range opt.Policies {
+		config, err := policy.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("upstream tls policy %v: %w", policy.Hosts, err)
+		}
+		u.policies = append(u.policies, &upstreamTLSPolicy{UpstreamTLSPolicy: policy, config: config})
+	}
+	return u, nil
+}
+
+func (o *UpstreamTLSPolicy) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: o.InsecureSkipVerify,
+		ServerName:         o.ServerName,
+	}
+	if o.MinVersion != "" {
+		version, ok := tlsVersions[o.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownTLSVersion, o.MinVersion)
+		}
+		config.MinVersion = version
+	}
+	for _, name := range o.CipherSuites {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownCipherSuite, name)
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+	if len(o.RootCAFiles) > 0 || o.NoSystemRoots {
+		pool := x509.NewCertPool()
+		if !o.NoSystemRoots {
+			if system, err := x509.SystemCertPool(); err == nil {
+				pool = system
+			}
+		}
+		for _, path := range o.RootCAFiles {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("%w: %s", ErrInvalidRootCA, path)
+			}
+		}
+		config.RootCAs = pool
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, s := range suites {
+			if s.Name == name {
+				return s.ID, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// 主机对应的tls配置 返回的配置可以修改
+func (u *upstreamTLS) config(host string) *tls.Config {
+	config := u.fallback
+	for _, policy := range u.policies {
+		if policy.match(host) {
+			config = policy.config
+			break
+		}
+	}
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	return config
+}
+
+func (p *upstreamTLSPolicy) match(host string) bool {
+	if len(p.Hosts) == 0 {
+		return true
+	}
+	for _, h := range p.Hosts {
+		if hostMatches(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// 代替Transport的TLS握手 按主机的策略与上游建立TLS连接
+// 经由环境变量中的上级代理时由Transport自行握手 不使用该策略
+func (p *SimpleProxyServer) dialUpstreamTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := p.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	config := p.upstreamTLS.config(host)
+	config.NextProtos = []string{"http/1.1"}
+	if p.MitmHTTP2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// 与上游的TLS握手失败时返回说明原因的错误页 其他错误返回nil
+func upstreamTLSErrorResponse(req *http.Request, err error) *http.Response {
+	var (
+		verifyErr *tls.CertificateVerificationError
+		title     string
+		details   []string
+	)
+	switch {
+	case errors.As(err, &verifyErr):
+		title = "上游证书无效"
+		for _, cert := range verifyErr.UnverifiedCertificates {
+			details = append(details, fmt.Sprintf("subject: %s, issuer: %s, dns: %s, 有效期: %s ~ %s",
+				cert.Subject, cert.Issuer, strings.Join(cert.DNSNames, ","),
+				cert.NotBefore.Format("2006-01-02"), cert.NotAfter.Format("2006-01-02")))
+		}
+		details = append(details, "上游使用私有CA时请在UpstreamTLS中为该主机配置RootCAFiles")
+	// 对方发送的alert为未导出的类型 按错误信息判断
+	case strings.Contains(err.Error(), "tls: "):
+		title = "与上游的TLS握手失败"
+		details = append(details, "请检查UpstreamTLS中该主机的MinVersion、CipherSuites及客户端证书")
+	default:
+		return nil
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "<html><head><meta charset=\"utf-8\"><title>%s</title></head><body>\n", title)
+	fmt.Fprintf(&b, "<h1>%s</h1>\n<p>%s</p>\n<pre>%s</pre>\n<ul>\n", title, html.EscapeString(req.URL.Host), html.EscapeString(err.Error()))
+	for _, d := range details {
+		fmt.Fprintf(&b, "<li>%s</li>\n", html.EscapeString(d))
+	}
+	b.WriteString("</ul>\n</body></html>\n")
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeHtml, http.StatusBadGateway, b.String())
+	resp.Header.Set("X-Gproxy-Error", "upstream-tls")
+	return resp
+}
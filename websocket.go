@@ -0,0 +1,496 @@
+/*************************************************************************
+> File Name: websocket.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 00:52:40 星期二
+> Content: 转发websocket连接 按帧解析消息 供中间件丢弃、修改或注入消息并记录到抓包中
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"golang.org/x/net/http/httpguts"
+)
+
+var (
+	// 超过该大小的消息不再合并 直接转发各个帧且不经过中间件
+	maxWebSocketMessageSize = int64(16 << 20)
+	ErrWebSocketNotFound    = errors.New("websocket not found")
+	errWebSocketControl     = errors.New("invalid websocket control frame")
+	// 正在转发的websocket连接 key为握手请求的ctx
+	webSockets sync.Map
+)
+
+// 消息的方向
+const (
+	// 客户端->上游
+	WebSocketUpstream = "upstream"
+	// 上游->客户端
+	WebSocketDownstream = "downstream"
+)
+
+// RFC 6455中的opcode
+const (
+	WebSocketContinuation = 0x0
+	WebSocketText         = 0x1
+	WebSocketBinary       = 0x2
+	WebSocketClose        = 0x8
+	WebSocketPing         = 0x9
+	WebSocketPong         = 0xa
+)
+
+// 需要处理websocket消息的中间件可实现该接口 分片的消息合并后交给中间件 控制帧同样经过中间件
+// 返回修改后的payload drop为true时丢弃该消息 注入消息使用SendWebSocketMessage
+type WebSocketMiddleware interface {
+	OnMessage(direction string, opcode int, payload []byte, ctx *goproxy.ProxyCtx) ([]byte, bool)
+}
+
+// 正在转发的websocket连接的信息
+type WebSocketInfo struct {
+	Session    int64     `json:"session"`
+	URL        string    `json:"url"`
+	ClientAddr string    `json:"clientAddr"`
+	StartTime  time.Time `json:"startTime"`
+	// 抓包记录的id 未开启抓包时为0
+	FlowID int64 `json:"flowId,omitempty"`
+}
+
+// 是否为websocket的握手请求
+func isWebSocketUpgrade(req *http.Request) bool {
+	return httpguts.HeaderValuesContainsToken(req.Header["Connection"], "upgrade") &&
+		httpguts.HeaderValuesContainsToken(req.Header["Upgrade"], "websocket")
+}
+
+// 实现了WebSocketMiddleware的中间件
+func (p *SimpleProxyServer) webSocketMiddlewares() []WebSocketMiddleware {
+	var hooks []WebSocketMiddleware
+	for _, m := range p.middlewares {
+		if wm, ok := m.(WebSocketMiddleware); ok {
+			hooks = append(hooks, wm)
+		}
+	}
+	return hooks
+}
+
+// 在所有中间件之后处理websocket握手请求 代替goproxy中直接拷贝数据的实现
+// 接管客户端连接后返回的响应只用于结束goproxy的处理 不会写给客户端
+func (p *SimpleProxyServer) serveWebSocket(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	w := proxyWriter(ctx.Req)
+	if w == nil {
+		return req, nil
+	}
+	hooks := p.webSocketMiddlewares()
+	intercept := len(hooks) > 0 || p.flows != nil
+	if intercept {
+		// 不协商permessage-deflate 使消息以明文传输
+		req.Header.Del("Sec-WebSocket-Extensions")
+	}
+	upstream, err := p.dialWebSocket(req)
+	if err != nil {
+		ctx.Warnf("Cannot dial websocket %s: %v", req.URL, err)
+		ctx.Error = err
+		if resp := upstreamTLSErrorResponse(req, err); resp != nil {
+			return req, resp
+		}
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, err.Error())
+	}
+	client, rw, err := w.Hijack()
+	if err != nil {
+		upstream.Close()
+		ctx.Warnf("Cannot hijack websocket client %s: %v", req.URL, err)
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusInternalServerError, err.Error())
+	}
+	defer client.Close()
+	defer upstream.Close()
+	if err := p.proxyWebSocket(req, ctx, client, rw.Reader, upstream, hooks, intercept); err != nil {
+		ctx.Warnf("Websocket %s: %v", req.URL, err)
+	}
+	return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusSwitchingProtocols, "")
+}
+
+// 建立到websocket上游的连接 https需要进行TLS握手
+func (p *SimpleProxyServer) dialWebSocket(req *http.Request) (net.Conn, error) {
+	secure := req.URL.Scheme == "https" || req.URL.Scheme == "wss"
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		port := "80"
+		if secure {
+			port = "443"
+		}
+		addr = net.JoinHostPort(req.URL.Hostname(), port)
+	}
+	conn, err := p.connectDial(req, "tcp", addr)
+	if err != nil || !secure {
+		return conn, err
+	}
+	var config *tls.Config
+	switch {
+	case p.upstreamTLS != nil:
+		config = p.upstreamTLS.config(req.URL.Hostname())
+	case p.proxy.Tr != nil && p.proxy.Tr.TLSClientConfig != nil:
+		config = p.proxy.Tr.TLSClientConfig.Clone()
+		config.ServerName = req.URL.Hostname()
+	default:
+		config = &tls.Config{ServerName: req.URL.Hostname()}
+	}
+	config.NextProtos = []string{"http/1.1"}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(req.Context()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// 转发握手请求及响应 握手成功后转发消息直到任一方关闭连接
+func (p *SimpleProxyServer) proxyWebSocket(req *http.Request, ctx *goproxy.ProxyCtx, client net.Conn, clientReader *bufio.Reader, upstream net.Conn, hooks []WebSocketMiddleware, intercept bool) error {
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	if err := req.Write(upstream); err != nil {
+		return err
+	}
+	upstreamReader := bufio.NewReader(upstream)
+	resp, err := http.ReadResponse(upstreamReader, req)
+	if err != nil {
+		ctx.Error = err
+		resp = goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, err.Error())
+	}
+	var flow *Flow
+	if p.flows != nil {
+		flow = p.flows.pendingFlow(ctx)
+	}
+	resp = p.filterResponse(resp, ctx)
+	if resp == nil {
+		return ctx.Error
+	}
+	defer resp.Body.Close()
+	if err := resp.Write(client); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil
+	}
+	c := &webSocketConn{
+		ctx:      ctx,
+		hooks:    hooks,
+		flow:     flow,
+		flows:    p.flows,
+		client:   webSocketPeer{conn: client},
+		upstream: webSocketPeer{conn: upstream},
+		info: WebSocketInfo{
+			Session:    ctx.Session,
+			URL:        req.URL.String(),
+			ClientAddr: req.RemoteAddr,
+			StartTime:  time.Now(),
+		},
+	}
+	if flow != nil {
+		c.info.FlowID = flow.ID
+	}
+	webSockets.Store(ctx, c)
+	defer webSockets.Delete(ctx)
+	errc := make(chan error, 2)
+	relay := func(direction string, src *bufio.Reader, dst net.Conn) {
+		if intercept {
+			errc <- c.relay(direction, src)
+			return
+		}
+		_, err := io.Copy(dst, src)
+		errc <- err
+	}
+	go relay(WebSocketUpstream, clientReader, upstream)
+	go relay(WebSocketDownstream, upstreamReader, client)
+	err = <-errc
+	client.Close()
+	upstream.Close()
+	<-errc
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+type webSocketPeer struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// 一个正在转发的websocket连接
+type webSocketConn struct {
+	ctx      *goproxy.ProxyCtx
+	hooks    []WebSocketMiddleware
+	flow     *Flow
+	flows    *FlowStore
+	client   webSocketPeer
+	upstream webSocketPeer
+	info     WebSocketInfo
+}
+
+// 消息的接收方
+func (c *webSocketConn) peer(direction string) *webSocketPeer {
+	if direction == WebSocketUpstream {
+		return &c.upstream
+	}
+	return &c.client
+}
+
+// 转发一个方向的帧 数据帧合并为完整的消息后交给中间件
+func (c *webSocketConn) relay(direction string, src *bufio.Reader) error {
+	var (
+		opcode  int
+		message []byte
+		// 当前消息过大或使用了扩展 直接转发帧
+		passthrough bool
+		size        int64
+	)
+	for {
+		h, err := readWebSocketFrameHeader(src)
+		if err != nil {
+			return err
+		}
+		if h.opcode >= WebSocketClose {
+			if !h.fin || h.length > 125 {
+				return errWebSocketControl
+			}
+			payload, err := h.readPayload(src)
+			if err != nil {
+				return err
+			}
+			if err := c.deliver(direction, h.opcode, payload); err != nil {
+				return err
+			}
+			continue
+		}
+		if h.opcode != WebSocketContinuation {
+			opcode, message, size = h.opcode, nil, 0
+		}
+		size += h.length
+		if passthrough || h.rsv != 0 || int64(len(message))+h.length > maxWebSocketMessageSize {
+			if err := c.passthrough(direction, h, src, !passthrough, opcode, message); err != nil {
+				return err
+			}
+			passthrough = !h.fin
+			if h.fin {
+				c.record(direction, &FlowMessage{Opcode: opcode, Payload: message, Size: size, Truncated: true})
+				message = nil
+			}
+			continue
+		}
+		payload, err := h.readPayload(src)
+		if err != nil {
+			return err
+		}
+		message = append(message, payload...)
+		if h.fin {
+			if err := c.deliver(direction, opcode, message); err != nil {
+				return err
+			}
+			message = nil
+		}
+	}
+}
+
+// 原样转发一个帧 first为true时先转发已合并的分片
+func (c *webSocketConn) passthrough(direction string, h *webSocketFrameHeader, src io.Reader, first bool, opcode int, message []byte) error {
+	peer := c.peer(direction)
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if first && len(message) > 0 {
+		if err := writeWebSocketFrame(peer.conn, false, opcode, message, direction == WebSocketUpstream); err != nil {
+			return err
+		}
+	}
+	if _, err := peer.conn.Write(h.raw); err != nil {
+		return err
+	}
+	_, err := io.CopyN(peer.conn, src, h.length)
+	return err
+}
+
+// 依次交给中间件处理后发给接收方
+func (c *webSocketConn) deliver(direction string, opcode int, payload []byte) error {
+	for _, hook := range c.hooks {
+		var drop bool
+		if payload, drop = hook.OnMessage(direction, opcode, payload, c.ctx); drop {
+			c.record(direction, &FlowMessage{Opcode: opcode, Payload: payload, Size: int64(len(payload)), Dropped: true})
+			return nil
+		}
+	}
+	c.record(direction, &FlowMessage{Opcode: opcode, Payload: payload, Size: int64(len(payload))})
+	return c.write(direction, opcode, payload)
+}
+
+// 发送一条完整的消息 发往上游的帧需要掩码
+func (c *webSocketConn) write(direction string, opcode int, payload []byte) error {
+	peer := c.peer(direction)
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	return writeWebSocketFrame(peer.conn, true, opcode, payload, direction == WebSocketUpstream)
+}
+
+// 记录消息到抓包中
+func (c *webSocketConn) record(direction string, m *FlowMessage) {
+	if c.flow == nil {
+		return
+	}
+	m.Time = time.Now()
+	m.Direction = direction
+	c.flows.addMessage(c.flow, m)
+}
+
+// 向websocket连接注入一条消息 ctx为握手请求的ctx 可在OnMessage中调用
+func SendWebSocketMessage(ctx *goproxy.ProxyCtx, direction string, opcode int, payload []byte) error {
+	v, ok := webSockets.Load(ctx)
+	if !ok {
+		return ErrWebSocketNotFound
+	}
+	return v.(*webSocketConn).send(direction, opcode, payload)
+}
+
+func (c *webSocketConn) send(direction string, opcode int, payload []byte) error {
+	if direction != WebSocketUpstream && direction != WebSocketDownstream {
+		return errors.New("unknown websocket direction: " + direction)
+	}
+	if opcode >= WebSocketClose && len(payload) > 125 {
+		return errWebSocketControl
+	}
+	c.record(direction, &FlowMessage{Opcode: opcode, Payload: payload, Size: int64(len(payload)), Injected: true})
+	return c.write(direction, opcode, payload)
+}
+
+// 帧头 raw为读取到的原始字节
+type webSocketFrameHeader struct {
+	fin    bool
+	rsv    byte
+	opcode int
+	masked bool
+	mask   [4]byte
+	length int64
+	raw    []byte
+}
+
+func readWebSocketFrameHeader(r io.Reader) (*webSocketFrameHeader, error) {
+	raw := make([]byte, 2, 14)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	h := &webSocketFrameHeader{
+		fin:    raw[0]&0x80 != 0,
+		rsv:    raw[0] & 0x70,
+		opcode: int(raw[0] & 0x0f),
+		masked: raw[1]&0x80 != 0,
+		length: int64(raw[1] & 0x7f),
+	}
+	var n int
+	switch h.length {
+	case 126:
+		n = 2
+	case 127:
+		n = 8
+	}
+	if h.masked {
+		n += 4
+	}
+	raw = raw[:2+n]
+	if _, err := io.ReadFull(r, raw[2:]); err != nil {
+		return nil, err
+	}
+	ext := raw[2:]
+	switch h.length {
+	case 126:
+		h.length, ext = int64(binary.BigEndian.Uint16(ext)), ext[2:]
+	case 127:
+		if ext[0]&0x80 != 0 {
+			return nil, errors.New("invalid websocket frame length")
+		}
+		h.length, ext = int64(binary.BigEndian.Uint64(ext)), ext[8:]
+	}
+	if h.masked {
+		copy(h.mask[:], ext)
+	}
+	h.raw = raw
+	return h, nil
+}
+
+// 读取并解除掩码
+func (h *webSocketFrameHeader) readPayload(r io.Reader) ([]byte, error) {
+	payload := make([]byte, h.length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if h.masked {
+		maskWebSocketPayload(payload, h.mask)
+	}
+	return payload, nil
+}
+
+func maskWebSocketPayload(payload []byte, mask [4]byte) {
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+}
+
+// 写出一个帧 masked为true时使用随机的掩码
+func writeWebSocketFrame(w io.Writer, fin bool, opcode int, payload []byte, masked bool) error {
+	b := make([]byte, 0, 14+len(payload))
+	b0 := byte(opcode) & 0x0f
+	if fin {
+		b0 |= 0x80
+	}
+	b = append(b, b0)
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, maskBit|byte(n))
+	case n <= 0xffff:
+		b = binary.BigEndian.AppendUint16(append(b, maskBit|126), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint64(append(b, maskBit|127), uint64(n))
+	}
+	if masked {
+		var mask [4]byte
+		rand.Read(mask[:])
+		b = append(b, mask[:]...)
+		start := len(b)
+		b = append(b, payload...)
+		maskWebSocketPayload(b[start:], mask)
+	} else {
+		b = append(b, payload...)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// 当前代理中正在转发的websocket连接
+func (p *SimpleProxyServer) webSocketConns() []*webSocketConn {
+	var conns []*webSocketConn
+	webSockets.Range(func(key, value interface{}) bool {
+		if key.(*goproxy.ProxyCtx).Proxy == p.proxy {
+			conns = append(conns, value.(*webSocketConn))
+		}
+		return true
+	})
+	return conns
+}
+
+// 管理接口注入消息的请求体 Binary为base64编码 不为空时发送二进制消息 否则发送Text
+type WebSocketSend struct {
+	Direction string `json:"direction"`
+	Text      string `json:"text"`
+	Binary    []byte `json:"binary"`
+}
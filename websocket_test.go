@@ -0,0 +1,230 @@
+/*************************************************************************
+> File Name: websocket_test.go
+> Author: sgs921107
+> Mail: 757513128@gmail.com
+> Created Time: 2026-10-20 22:20:05 星期二
+> Content: 测试websocket帧的解析、分片的合并、控制帧及超大消息的直接转发
+*************************************************************************/
+
+package gproxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+// 写入内存的连接
+type bufferConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *bufferConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
+
+type testWebSocketMessage struct {
+	direction string
+	opcode    int
+	payload   string
+}
+
+// 记录收到的消息 文本消息转为大写 内容为drop的消息丢弃
+type testWebSocketHook struct {
+	messages []testWebSocketMessage
+}
+
+func (h *testWebSocketHook) OnMessage(direction string, opcode int, payload []byte, _ *goproxy.ProxyCtx) ([]byte, bool) {
+	h.messages = append(h.messages, testWebSocketMessage{direction, opcode, string(payload)})
+	if string(payload) == "drop" {
+		return payload, true
+	}
+	if opcode == WebSocketText {
+		return bytes.ToUpper(payload), false
+	}
+	return payload, false
+}
+
+type testWebSocketFrame struct {
+	fin     bool
+	rsv     byte
+	opcode  int
+	masked  bool
+	payload string
+}
+
+func webSocketFrame(t *testing.T, fin bool, opcode int, payload string, masked bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := writeWebSocketFrame(&buf, fin, opcode, []byte(payload), masked); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readWebSocketFrames(t *testing.T, data []byte) []testWebSocketFrame {
+	t.Helper()
+	var frames []testWebSocketFrame
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		h, err := readWebSocketFrameHeader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := h.readPayload(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, testWebSocketFrame{h.fin, h.rsv, h.opcode, h.masked, string(payload)})
+	}
+	return frames
+}
+
+// 将frames作为direction方向的输入转发 返回写给接收方的帧及relay的结果
+func relayWebSocketFrames(t *testing.T, direction string, hook *testWebSocketHook, frames ...[]byte) ([]testWebSocketFrame, error) {
+	t.Helper()
+	client, upstream := &bufferConn{}, &bufferConn{}
+	c := &webSocketConn{
+		hooks:    []WebSocketMiddleware{hook},
+		client:   webSocketPeer{conn: client},
+		upstream: webSocketPeer{conn: upstream},
+	}
+	err := c.relay(direction, bufio.NewReader(bytes.NewReader(bytes.Join(frames, nil))))
+	out := upstream
+	if direction == WebSocketDownstream {
+		out = client
+	}
+	return readWebSocketFrames(t, out.buf.Bytes()), err
+}
+
+func TestReadWebSocketFrameHeader(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xffff, 0x10000} {
+		payload := strings.Repeat("x", n)
+		frames := readWebSocketFrames(t, webSocketFrame(t, true, WebSocketBinary, payload, true))
+		if len(frames) != 1 || !frames[0].masked || frames[0].payload != payload {
+			t.Errorf("length %d: got %d frames", n, len(frames))
+		}
+	}
+	// 64位长度的最高位必须为0
+	b := []byte{0x82, 127, 0x80, 0, 0, 0, 0, 0, 0, 0}
+	if _, err := readWebSocketFrameHeader(bytes.NewReader(b)); err == nil {
+		t.Error("expected an error for an invalid length")
+	}
+	if _, err := readWebSocketFrameHeader(bytes.NewReader([]byte{0x81, 0xfe, 0})); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated header: got %v", err)
+	}
+}
+
+// 分片的消息合并后交给中间件 分片之间的控制帧立即转发
+func TestWebSocketRelayFragmented(t *testing.T) {
+	hook := &testWebSocketHook{}
+	frames, err := relayWebSocketFrames(t, WebSocketUpstream, hook,
+		webSocketFrame(t, false, WebSocketText, "hel", true),
+		webSocketFrame(t, true, WebSocketPing, "p", true),
+		webSocketFrame(t, false, WebSocketContinuation, "lo ", true),
+		webSocketFrame(t, true, WebSocketContinuation, "world", true),
+		webSocketFrame(t, true, WebSocketText, "drop", true),
+		webSocketFrame(t, true, WebSocketBinary, "\x00\x01", true),
+	)
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("relay: %v", err)
+	}
+	wantMessages := []testWebSocketMessage{
+		{WebSocketUpstream, WebSocketPing, "p"},
+		{WebSocketUpstream, WebSocketText, "hello world"},
+		{WebSocketUpstream, WebSocketText, "drop"},
+		{WebSocketUpstream, WebSocketBinary, "\x00\x01"},
+	}
+	if !slices.Equal(hook.messages, wantMessages) {
+		t.Errorf("messages: got %v, want %v", hook.messages, wantMessages)
+	}
+	// 发往上游的帧需要掩码
+	wantFrames := []testWebSocketFrame{
+		{true, 0, WebSocketPing, true, "p"},
+		{true, 0, WebSocketText, true, "HELLO WORLD"},
+		{true, 0, WebSocketBinary, true, "\x00\x01"},
+	}
+	if !slices.Equal(frames, wantFrames) {
+		t.Errorf("frames: got %v, want %v", frames, wantFrames)
+	}
+}
+
+// 发往客户端的帧不使用掩码
+func TestWebSocketRelayDownstream(t *testing.T) {
+	hook := &testWebSocketHook{}
+	frames, err := relayWebSocketFrames(t, WebSocketDownstream, hook,
+		webSocketFrame(t, true, WebSocketText, "hi", false),
+		webSocketFrame(t, true, WebSocketClose, "\x03\xe8", false),
+	)
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("relay: %v", err)
+	}
+	wantFrames := []testWebSocketFrame{
+		{true, 0, WebSocketText, false, "HI"},
+		{true, 0, WebSocketClose, false, "\x03\xe8"},
+	}
+	if !slices.Equal(frames, wantFrames) {
+		t.Errorf("frames: got %v, want %v", frames, wantFrames)
+	}
+}
+
+func TestWebSocketRelayInvalidControlFrame(t *testing.T) {
+	cases := map[string][]byte{
+		"fragmented": webSocketFrame(t, false, WebSocketPing, "p", true),
+		"too long":   webSocketFrame(t, true, WebSocketPong, strings.Repeat("x", 126), true),
+	}
+	for name, frame := range cases {
+		if _, err := relayWebSocketFrames(t, WebSocketUpstream, &testWebSocketHook{}, frame); !errors.Is(err, errWebSocketControl) {
+			t.Errorf("%s: got %v, want %v", name, err, errWebSocketControl)
+		}
+	}
+}
+
+// 超过大小的消息及使用了扩展(rsv)的消息原样转发 不经过中间件
+func TestWebSocketRelayPassthrough(t *testing.T) {
+	defer func(size int64) { maxWebSocketMessageSize = size }(maxWebSocketMessageSize)
+	maxWebSocketMessageSize = 10
+	compressed := webSocketFrame(t, true, WebSocketText, "deflated", true)
+	compressed[0] |= 0x40
+	hook := &testWebSocketHook{}
+	frames, err := relayWebSocketFrames(t, WebSocketUpstream, hook,
+		// 第二个分片超过大小 已合并的分片先作为未结束的帧转发
+		webSocketFrame(t, false, WebSocketText, "aaaaaa", true),
+		webSocketFrame(t, false, WebSocketContinuation, "bbbbbb", true),
+		webSocketFrame(t, true, WebSocketPing, "p", true),
+		webSocketFrame(t, true, WebSocketContinuation, "c", true),
+		webSocketFrame(t, true, WebSocketBinary, strings.Repeat("z", 11), true),
+		compressed,
+		webSocketFrame(t, true, WebSocketText, "ok", true),
+	)
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("relay: %v", err)
+	}
+	wantMessages := []testWebSocketMessage{
+		{WebSocketUpstream, WebSocketPing, "p"},
+		{WebSocketUpstream, WebSocketText, "ok"},
+	}
+	if !slices.Equal(hook.messages, wantMessages) {
+		t.Errorf("messages: got %v, want %v", hook.messages, wantMessages)
+	}
+	wantFrames := []testWebSocketFrame{
+		{false, 0, WebSocketText, true, "aaaaaa"},
+		{false, 0, WebSocketContinuation, true, "bbbbbb"},
+		{true, 0, WebSocketPing, true, "p"},
+		{true, 0, WebSocketContinuation, true, "c"},
+		{true, 0, WebSocketBinary, true, strings.Repeat("z", 11)},
+		{true, 0x40, WebSocketText, true, "deflated"},
+		{true, 0, WebSocketText, true, "OK"},
+	}
+	if !slices.Equal(frames, wantFrames) {
+		t.Errorf("frames: got %v, want %v", frames, wantFrames)
+	}
+}